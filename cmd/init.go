@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/predakanga/image-updater/pkg"
+	"github.com/spf13/cobra"
+	"github.com/zclconf/go-cty/cty"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const initCheckTimeout = 30
+
+// Credentials are read from the environment by the generated config, rather than written to it
+const (
+	passwordEnvVar = "GIT_PASSWORD"
+	tokenEnvVar    = "GIT_TOKEN"
+)
+
+var initOpts struct {
+	output         string
+	force          bool
+	nonInteractive bool
+	skipCheck      bool
+
+	url            string
+	branch         string
+	username       string
+	password       string
+	token          string
+	committerName  string
+	committerEmail string
+
+	deployment string
+	deployType string
+	path       string
+	images     []string
+}
+
+// initCmd scaffolds a config file with a single repository and deployment
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate a config file, after checking that the repository can be reached",
+	Args:  cobra.NoArgs,
+	// Most failures are from the repository check, where the usage wouldn't help
+	SilenceUsage: true,
+	// NB: Execute prints the error
+	SilenceErrors: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(initOpts.output); err == nil && !initOpts.force {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", initOpts.output)
+		}
+		// Only ask for what wasn't given as a flag, and only if someone is there to answer
+		if !initOpts.nonInteractive && term.IsTerminal(int(os.Stdin.Fd())) {
+			if err := promptInitOptions(bufio.NewReader(os.Stdin)); err != nil {
+				return err
+			}
+		}
+		if initOpts.url == "" || initOpts.committerName == "" || initOpts.committerEmail == "" || len(initOpts.images) == 0 {
+			return fmt.Errorf("--repository-url, --committer-name, --committer-email and --image are required")
+		}
+		if initOpts.deployment == "" {
+			initOpts.deployment = repositoryName(initOpts.url)
+		}
+
+		repoCfg := pkg.RepositoryConfig{
+			Name:           repositoryName(initOpts.url),
+			Url:            initOpts.url,
+			Branch:         initOpts.branch,
+			Username:       initOpts.username,
+			Password:       initOpts.password,
+			Token:          initOpts.token,
+			CommitterName:  initOpts.committerName,
+			CommitterEmail: initOpts.committerEmail,
+		}
+		if !initOpts.skipCheck {
+			if err := checkRepository(repoCfg); err != nil {
+				return err
+			}
+			fmt.Printf("Repository %s is reachable\n", repoCfg.Url)
+		}
+
+		cfgBytes, err := generateConfig(repoCfg)
+		if err != nil {
+			return err
+		}
+		// Make sure that we'd be able to load what we've written
+		if _, err := pkg.ParseConfig(cfgBytes, initOpts.output); err != nil {
+			return fmt.Errorf("generated config is invalid: %w", err)
+		}
+		// NB: The config holds the webhook's secret key
+		if err := os.WriteFile(initOpts.output, cfgBytes, 0600); err != nil {
+			return fmt.Errorf("could not write config: %w", err)
+		}
+		fmt.Printf("Config written to %s\n", initOpts.output)
+		if initOpts.password != "" {
+			fmt.Printf("Set %s to the repository password before starting the server\n", passwordEnvVar)
+		}
+		if initOpts.token != "" {
+			fmt.Printf("Set %s to the repository token before starting the server\n", tokenEnvVar)
+		}
+
+		return nil
+	},
+}
+
+// promptInitOptions asks for each option which wasn't set by a flag
+func promptInitOptions(reader *bufio.Reader) error {
+	ask := func(label string, value *string, fallback string) error {
+		if *value != "" {
+			return nil
+		}
+		if fallback != "" {
+			fmt.Printf("%s [%s]: ", label, fallback)
+		} else {
+			fmt.Printf("%s: ", label)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if *value = strings.TrimSpace(line); *value == "" {
+			*value = fallback
+		}
+		return nil
+	}
+	askSecret := func(label string, value *string) error {
+		if *value != "" {
+			return nil
+		}
+		fmt.Printf("%s (leave empty for none): ", label)
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		*value = string(secret)
+		return err
+	}
+
+	if err := ask("Repository URL", &initOpts.url, ""); err != nil {
+		return err
+	}
+	if err := ask("Branch (empty for the default)", &initOpts.branch, ""); err != nil {
+		return err
+	}
+	if err := ask("Username (empty for none)", &initOpts.username, ""); err != nil {
+		return err
+	}
+	if initOpts.username != "" {
+		if err := askSecret("Password", &initOpts.password); err != nil {
+			return err
+		}
+	} else if err := askSecret("Token", &initOpts.token); err != nil {
+		return err
+	}
+	if err := ask("Committer name", &initOpts.committerName, "image-updater"); err != nil {
+		return err
+	}
+	if err := ask("Committer email", &initOpts.committerEmail, ""); err != nil {
+		return err
+	}
+	if err := ask("Deployment name", &initOpts.deployment, repositoryName(initOpts.url)); err != nil {
+		return err
+	}
+	if err := ask("File to update", &initOpts.path, initOpts.path); err != nil {
+		return err
+	}
+	if len(initOpts.images) == 0 {
+		var images string
+		if err := ask("Images to update, separated by commas", &images, ""); err != nil {
+			return err
+		}
+		for _, image := range strings.Split(images, ",") {
+			if image = strings.TrimSpace(image); image != "" {
+				initOpts.images = append(initOpts.images, image)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRepository lists the repository's branch, to prove the credentials work before they're written
+func checkRepository(cfg pkg.RepositoryConfig) error {
+	repo, err := pkg.NewRepository(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), initCheckTimeout*time.Second)
+	defer cancel()
+	if _, err := repo.Head(ctx); err != nil {
+		return fmt.Errorf("could not reach repository, use --skip-check to write the config anyway: %w", err)
+	}
+
+	return nil
+}
+
+// generateConfig renders the config file, referring to any credentials through environment variables
+func generateConfig(repoCfg pkg.RepositoryConfig) ([]byte, error) {
+	secretKey := make([]byte, 32)
+	if _, err := rand.Read(secretKey); err != nil {
+		return nil, fmt.Errorf("could not generate secret key: %w", err)
+	}
+	envCall := func(name string) hclwrite.Tokens {
+		return hclwrite.TokensForFunctionCall("env", hclwrite.TokensForValue(cty.StringVal(name)))
+	}
+
+	file := hclwrite.NewEmptyFile()
+	root := file.Body()
+	root.SetAttributeValue("secret_key", cty.StringVal(hex.EncodeToString(secretKey)))
+	root.AppendNewline()
+
+	repo := root.AppendNewBlock("repository", []string{repoCfg.Name}).Body()
+	repo.SetAttributeValue("url", cty.StringVal(repoCfg.Url))
+	if repoCfg.Branch != "" {
+		repo.SetAttributeValue("branch", cty.StringVal(repoCfg.Branch))
+	}
+	if repoCfg.Username != "" {
+		repo.SetAttributeValue("username", cty.StringVal(repoCfg.Username))
+	}
+	if repoCfg.Password != "" {
+		repo.SetAttributeRaw("password", envCall(passwordEnvVar))
+	}
+	if repoCfg.Token != "" {
+		repo.SetAttributeRaw("token", envCall(tokenEnvVar))
+	}
+	repo.SetAttributeValue("committer_name", cty.StringVal(repoCfg.CommitterName))
+	repo.SetAttributeValue("committer_email", cty.StringVal(repoCfg.CommitterEmail))
+	root.AppendNewline()
+
+	deployment := root.AppendNewBlock("deployment", []string{initOpts.deployment}).Body()
+	deployment.SetAttributeValue("repository", cty.StringVal(repoCfg.Name))
+	if initOpts.deployType != "" {
+		deployment.SetAttributeValue("type", cty.StringVal(initOpts.deployType))
+	}
+	deployment.SetAttributeValue("path", cty.StringVal(initOpts.path))
+	images := make([]cty.Value, 0, len(initOpts.images))
+	for _, image := range initOpts.images {
+		images = append(images, cty.StringVal(image))
+	}
+	deployment.SetAttributeValue("image", cty.ListVal(images))
+
+	return file.Bytes(), nil
+}
+
+// repositoryName guesses a name from a repository's URL, e.g. "api" for https://github.com/acme/api.git
+func repositoryName(repoUrl string) string {
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(repoUrl, "/")), ".git")
+	if name == "" || name == "." || name == "/" {
+		return "default"
+	}
+
+	return name
+}
+
+func init() {
+	flags := initCmd.Flags()
+	flags.StringVarP(&initOpts.output, "output", "o", "image-updater.hcl", "where to write the config file")
+	flags.BoolVar(&initOpts.force, "force", false, "overwrite the config file if it exists")
+	flags.BoolVar(&initOpts.nonInteractive, "non-interactive", false, "never prompt, using only the flags given")
+	flags.BoolVar(&initOpts.skipCheck, "skip-check", false, "don't check that the repository can be reached")
+
+	flags.StringVar(&initOpts.url, "repository-url", "", "URL of the repository to update")
+	flags.StringVar(&initOpts.branch, "branch", "", "branch to update, instead of the repository's default")
+	flags.StringVar(&initOpts.username, "username", "", "username for the repository")
+	flags.StringVar(&initOpts.password, "password", "", "password for the repository, which is only used for the check")
+	flags.StringVar(&initOpts.token, "token", "", "token for the repository, which is only used for the check")
+	flags.StringVar(&initOpts.committerName, "committer-name", "", "name to commit updates as")
+	flags.StringVar(&initOpts.committerEmail, "committer-email", "", "email to commit updates as")
+
+	flags.StringVar(&initOpts.deployment, "deployment", "", "name of the deployment (default is the repository's name)")
+	flags.StringVar(&initOpts.deployType, "type", "", "type of the deployment's files: kustomize, helm, manifest or regex")
+	flags.StringVar(&initOpts.path, "path", "kustomization.yaml", "file to update, relative to the repository")
+	flags.StringSliceVar(&initOpts.images, "image", nil, "image to update, which may be repeated")
+
+	rootCmd.AddCommand(initCmd)
+}
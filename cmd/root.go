@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"runtime/debug"
 	"strings"
 	"time"
 )
@@ -20,6 +21,7 @@ const baseLogLevel = log.InfoLevel
 
 var cfgFile string
 var verbosity int
+var checkOnly bool
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -54,7 +56,10 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			log.WithError(err).Fatal("Config file loading failed")
 		}
-		// Before anything else, update our log level if required
+		// Before anything else, update our log format and level if required
+		if err := pkg.ConfigureLogging(cfg); err != nil {
+			log.WithError(err).Fatal("Invalid logging config")
+		}
 		if cfg.LogLevel != "" {
 			newLevel, err := log.ParseLevel(cfg.LogLevel)
 			if err != nil {
@@ -68,12 +73,30 @@ var rootCmd = &cobra.Command{
 		log.Debugf("Config loaded: %+v", cfg)
 
 		// Create the app server
-		srv := pkg.NewServer(cfg)
+		srv, err := pkg.NewServer(cfg)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid config")
+		}
+		// Misconfigured deployments would otherwise only fail once their first update arrives
+		if checkOnly || cfg.StartupCheck != "" {
+			problems := srv.CheckDeployments(context.Background())
+			if len(problems) > 0 && (checkOnly || cfg.StartupCheck == pkg.StartupCheckFail) {
+				log.Fatalf("%d deployment(s) failed their startup check", len(problems))
+			}
+			if checkOnly {
+				return
+			}
+		}
+		// Start any background consumers alongside it
+		consumerCtx, stopConsumers := context.WithCancel(context.Background())
+		defer stopConsumers()
+		srv.RunConsumers(consumerCtx)
 		// Set up interrupts
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt)
 		go func() {
 			<-sigChan
+			stopConsumers()
 			ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
 			defer cancel()
 			if err := srv.Shutdown(ctx); err != nil {
@@ -89,8 +112,19 @@ var rootCmd = &cobra.Command{
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute(version string) {
+func Execute(version string, commit string, date string) {
+	// Builds without linker flags can still tell which commit they came from
+	if commit == "unknown" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					commit = setting.Value
+				}
+			}
+		}
+	}
 	rootCmd.Version = version
+	pkg.SetBuildInfo(version, commit, date)
 	cobra.CheckErr(rootCmd.Execute())
 }
 
@@ -99,8 +133,9 @@ func Execute(version string) {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.image-updater.conf or /etc/image-updater.conf)")
+	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file or directory of .hcl files (default is $HOME/.image-updater.conf or /etc/image-updater.conf)")
 	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "Increase log verbosity")
+	rootCmd.Flags().BoolVar(&checkOnly, "check", false, "Check every deployment's paths and images, then exit")
 
 	pkg.AddFlags(rootCmd)
 }
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/predakanga/image-updater/pkg"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+const testKeyEnvVar = "IMAGE_UPDATER_KEY"
+
+var testOpts struct {
+	server       string
+	key          string
+	deployment   string
+	tag          string
+	images       map[string]string
+	extra        map[string]string
+	authorizedBy string
+	dryRun       bool
+	timeout      time.Duration
+}
+
+// testCmd sends an update request to a running server, authenticated with the same key as real callers
+var testCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send an update request to a running server and print its response",
+	Args:  cobra.NoArgs,
+	// Most failures are from the server, where the usage wouldn't help
+	SilenceUsage: true,
+	// NB: Execute prints the error
+	SilenceErrors: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if testOpts.deployment == "" || (testOpts.tag == "" && len(testOpts.images) == 0) {
+			return fmt.Errorf("--deployment and either --tag or --image are required")
+		}
+		// Fall back to the key from the environment or config file, if there is one
+		key := testOpts.key
+		if key == "" {
+			key = os.Getenv(testKeyEnvVar)
+		}
+		if key == "" && cfgFile != "" {
+			cfg, err := pkg.LoadConfig(cfgFile, pflag.NewFlagSet("test", pflag.ContinueOnError))
+			if err != nil {
+				return fmt.Errorf("could not load config for its secret_key: %w", err)
+			}
+			key = cfg.SecretKey
+		}
+
+		payload := map[string]interface{}{
+			"deployment":    testOpts.deployment,
+			"authorized_by": testOpts.authorizedBy,
+		}
+		if testOpts.tag != "" {
+			payload["tag_name"] = testOpts.tag
+		}
+		if len(testOpts.images) > 0 {
+			payload["images"] = testOpts.images
+		}
+		if testOpts.dryRun {
+			payload["dry_run"] = true
+		}
+		for field, value := range testOpts.extra {
+			payload[field] = value
+		}
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimRight(testOpts.server, "/")+"/", bytes.NewReader(payloadBytes))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-Key", key)
+		}
+		client := http.Client{Timeout: testOpts.timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("request failed: %w", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("could not read response: %w", err)
+		}
+
+		fmt.Printf("Status: %s\n", resp.Status)
+		if requestID := resp.Header.Get("X-Request-Id"); requestID != "" {
+			fmt.Printf("Request ID: %s\n", requestID)
+		}
+		pretty := bytes.Buffer{}
+		if err := json.Indent(&pretty, body, "", "  "); err == nil {
+			fmt.Println(strings.TrimSpace(pretty.String()))
+		} else if len(body) > 0 {
+			fmt.Println(strings.TrimSpace(string(body)))
+		}
+		// Anything the server turned away counts as a failed test
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("update was not accepted")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	authorizedBy := "image-updater test"
+	if current, err := user.Current(); err == nil {
+		authorizedBy = fmt.Sprintf("image-updater test (%s)", current.Username)
+	}
+
+	flags := testCmd.Flags()
+	flags.StringVar(&testOpts.server, "server", "http://localhost:8080", "URL of the running server")
+	flags.StringVar(&testOpts.key, "key", "", "secret key for the server (default is $IMAGE_UPDATER_KEY, or the secret_key from --config)")
+	flags.StringVar(&testOpts.deployment, "deployment", "", "deployment to update")
+	flags.StringVar(&testOpts.tag, "tag", "", "tag to update every image to")
+	flags.StringToStringVar(&testOpts.images, "image", nil, "independent tags for each image, as name=tag")
+	flags.StringToStringVar(&testOpts.extra, "extra", nil, "extra fields for the payload, as name=value")
+	flags.StringVar(&testOpts.authorizedBy, "authorized-by", authorizedBy, "who the update is attributed to")
+	flags.BoolVar(&testOpts.dryRun, "dry-run", false, "apply the update without pushing it")
+	flags.DurationVar(&testOpts.timeout, "timeout", 2*time.Minute, "how long to wait for a response")
+
+	rootCmd.AddCommand(testCmd)
+}
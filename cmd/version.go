@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/predakanga/image-updater/pkg"
+	"github.com/spf13/cobra"
+	"os"
+	"runtime"
+)
+
+var versionOutput string
+
+// versionInfo is the JSON form of the version command's output
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// versionCmd prints details of the build, for inventory tooling as much as for people
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the version, commit and build details",
+	Args:  cobra.NoArgs,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info := versionInfo{
+			Version:   pkg.Version,
+			Commit:    pkg.Commit,
+			BuildDate: pkg.BuildDate,
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		}
+		switch versionOutput {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(info)
+		case "text":
+			fmt.Printf("Version:    %s\n", info.Version)
+			fmt.Printf("Commit:     %s\n", info.Commit)
+			fmt.Printf("Build date: %s\n", info.BuildDate)
+			fmt.Printf("Go version: %s\n", info.GoVersion)
+			fmt.Printf("Platform:   %s\n", info.Platform)
+			return nil
+		default:
+			return fmt.Errorf("invalid output format: %s", versionOutput)
+		}
+	},
+}
+
+func init() {
+	versionCmd.Flags().StringVarP(&versionOutput, "output", "o", "text", "output format, text or json")
+	rootCmd.AddCommand(versionCmd)
+}
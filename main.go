@@ -2,8 +2,13 @@ package main
 
 import "github.com/predakanga/image-updater/cmd"
 
-var version = "0.0.0"
+// Set by the release build's linker flags
+var (
+	version = "0.0.0"
+	commit  = "unknown"
+	date    = "unknown"
+)
 
 func main() {
-	cmd.Execute(version)
+	cmd.Execute(version, commit, date)
 }
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// adminDeployment describes a deployment and its most recent update
+type adminDeployment struct {
+	Name            string        `json:"name"`
+	Repository      string        `json:"repository"`
+	Type            string        `json:"type"`
+	Paths           []string      `json:"paths"`
+	Images          []string      `json:"images"`
+	ApplicationName string        `json:"argocd_app,omitempty"`
+	ArgoServer      string        `json:"argocd_server,omitempty"`
+	Group           string        `json:"group,omitempty"`
+	Pinned          bool          `json:"pinned,omitempty"`
+	LastUpdate      *HistoryEntry `json:"last_update,omitempty"`
+}
+
+// adminRepository describes a repository and whether an update is currently using it
+type adminRepository struct {
+	Name    string   `json:"name"`
+	Url     string   `json:"url"`
+	Mirrors []string `json:"mirrors,omitempty"`
+	Branch  string   `json:"branch,omitempty"`
+	Ref     string   `json:"ref,omitempty"`
+	PushRef string   `json:"push_ref,omitempty"`
+	Locked  bool     `json:"locked"`
+}
+
+// AdminHandler serves the admin API, for runtime introspection
+//
+// GET  /admin/deployments               lists deployments and their last update
+// GET  /admin/repositories              lists repositories and their lock status
+// POST /admin/deployments/{name}/resync re-triggers the sync of the last update
+type AdminHandler struct {
+	server *WebhookServer
+}
+
+func (h AdminHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "deployments":
+		if req.Method != http.MethodGet {
+			writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		writeJSON(resp, http.StatusOK, h.deployments())
+	case len(parts) == 1 && parts[0] == "repositories":
+		if req.Method != http.MethodGet {
+			writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		writeJSON(resp, http.StatusOK, h.repositories())
+	case len(parts) == 3 && parts[0] == "deployments" && parts[2] == "resync":
+		if req.Method != http.MethodPost {
+			writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		writeResponse(resp, h.resync(parts[1]))
+	default:
+		writeResponse(resp, newResponse(http.StatusNotFound, "Not found"))
+	}
+}
+
+func (h AdminHandler) deployments() []adminDeployment {
+	deployments := h.server.allDeployments()
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Name < deployments[j].Name
+	})
+	toRet := make([]adminDeployment, 0, len(deployments))
+	for _, deployment := range deployments {
+		entry := adminDeployment{
+			Name:            deployment.Name,
+			Repository:      deployment.RepositoryName,
+			Type:            deployment.Type,
+			Paths:           deployment.Paths(),
+			Images:          deployment.Images,
+			ApplicationName: deployment.ApplicationName,
+			ArgoServer:      deployment.ArgoServer,
+			Group:           deployment.Group,
+			Pinned:          deployment.Pinned,
+		}
+		if last, ok := h.server.state.LastUpdate(deployment.Name); ok {
+			entry.LastUpdate = &last
+		}
+		toRet = append(toRet, entry)
+	}
+
+	return toRet
+}
+
+func (h AdminHandler) repositories() []adminRepository {
+	repositories := h.server.allRepositories()
+	toRet := make([]adminRepository, 0, len(repositories))
+	for name, repo := range repositories {
+		// NB: This is only a snapshot, the lock may change hands immediately afterwards
+		entry := adminRepository{Name: name, Url: repo.url, Mirrors: repo.mirrors, Branch: repo.branch, Locked: repo.Locked()}
+		if repo.branch == "" {
+			entry.Ref = repo.ref.String()
+		}
+		entry.PushRef = repo.pushRef.String()
+		toRet = append(toRet, entry)
+	}
+	sort.Slice(toRet, func(i, j int) bool {
+		return toRet[i].Name < toRet[j].Name
+	})
+
+	return toRet
+}
+
+// resync triggers ArgoCD, Flux or a rollout again for a deployment's most recent update
+func (h AdminHandler) resync(name string) UpdateResponse {
+	deployment, ok := h.server.lookupDeployment(name)
+	if !ok {
+		return newResponse(http.StatusNotFound, "Deployment not found")
+	}
+	last, ok := h.server.state.LastUpdate(name)
+	if !ok {
+		return newResponse(http.StatusConflict, "Deployment has not been updated")
+	}
+	payload := UpdateRequest{
+		Deployment:   deployment.Name,
+		TagName:      last.TagName,
+		AuthorizedBy: "admin",
+	}
+	job := h.server.jobs.Create(payload)
+	if h.server.startSync(job, deployment, payload, last.Revision) == "" {
+		job.SetStatus(StatusFailed, last.Revision, "Deployment has nothing to sync")
+		return newResponse(http.StatusConflict, "Deployment has nothing to sync")
+	}
+	log.WithFields(log.Fields{"deployment": name, "revision": last.Revision, "job_id": job.ID}).Info("Manual re-sync triggered")
+
+	toRet := newResponse(http.StatusAccepted, fmt.Sprintf("Re-syncing %s", last.Revision))
+	toRet.JobId = job.ID
+	toRet.Revision = last.Revision
+	return toRet
+}
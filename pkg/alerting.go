@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+var consecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "image_updater",
+	Subsystem: "deployment",
+	Name:      "consecutive_failures",
+	Help:      "The number of updates to each deployment which have failed since the last success",
+}, []string{"deployment"})
+
+// failureTracker counts each deployment's consecutive failed updates, so that someone can be alerted
+// when a deployment keeps failing, rather than only when it fails once
+type failureTracker struct {
+	threshold int
+	mutex     sync.Mutex
+	counts    map[string]int
+	alerted   map[string]bool
+}
+
+func newFailureTracker(threshold int) *failureTracker {
+	return &failureTracker{
+		threshold: threshold,
+		counts:    make(map[string]int),
+		alerted:   make(map[string]bool),
+	}
+}
+
+// record notes a job's final status, returning the event to alert with, if any
+// NB: Only statuses which end an update count, so syncing doesn't reset a run of failures
+func (t *failureTracker) record(deployment *Deployment, status string) (string, int) {
+	threshold := t.threshold
+	if deployment.FailureThreshold > 0 {
+		threshold = deployment.FailureThreshold
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch status {
+	case StatusFailed, StatusSyncFailed, StatusDegraded:
+		t.counts[deployment.Name]++
+		count := t.counts[deployment.Name]
+		consecutiveFailures.WithLabelValues(deployment.Name).Set(float64(count))
+		if threshold > 0 && count >= threshold && !t.alerted[deployment.Name] {
+			t.alerted[deployment.Name] = true
+			return EventRepeatedFailures, count
+		}
+	case StatusUpdated, StatusSynced, StatusHealthy:
+		count := t.counts[deployment.Name]
+		delete(t.counts, deployment.Name)
+		consecutiveFailures.WithLabelValues(deployment.Name).Set(0)
+		if t.alerted[deployment.Name] {
+			delete(t.alerted, deployment.Name)
+			return EventRecovered, count
+		}
+	}
+
+	return "", 0
+}
+
+// trackOutcome alerts the deployment's notifiers once it has failed too many times in a row,
+// and again once it recovers
+func (s *WebhookServer) trackOutcome(deployment *Deployment, payload UpdateRequest, status string, message string) {
+	event, count := s.failures.record(deployment, status)
+	switch event {
+	case EventRepeatedFailures:
+		log.WithField("deployment", deployment.Name).Warnf("Deployment has failed %d times in a row", count)
+		s.notify(deployment, notification{
+			Event:   event,
+			Message: fmt.Sprintf("Failed %d times in a row, most recently: %s", count, message),
+			Payload: payload,
+			Fields:  map[string]string{"failures": fmt.Sprint(count), "status": status},
+		})
+	case EventRecovered:
+		log.WithField("deployment", deployment.Name).Infof("Deployment recovered after %d failures", count)
+		s.notify(deployment, notification{
+			Event:   event,
+			Message: fmt.Sprintf("Updated to %s after %d failures", payload.Tags(), count),
+			Payload: payload,
+			Fields:  map[string]string{"failures": fmt.Sprint(count), "status": status},
+		})
+	}
+}
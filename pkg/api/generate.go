@@ -0,0 +1,4 @@
+// Package api contains the protobuf definitions for image-updater's gRPC API
+package api
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative pkg/api/image_updater.proto
@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const approvalExpiry = 86400
+const approvalCheckInterval = 60
+
+// approvalRequest is the body expected when approving or rejecting an update
+type approvalRequest struct {
+	ApprovedBy string `json:"approved_by"`
+}
+
+// requestApproval stores the job's update until somebody approves it
+func (s *WebhookServer) requestApproval(job *Job, deployment *Deployment, payload UpdateRequest) {
+	now := time.Now()
+	s.state.AddPending(PendingUpdate{
+		ID:           job.ID,
+		Deployment:   deployment.Name,
+		TagName:      payload.TagName,
+		Images:       payload.Images,
+		AuthorizedBy: payload.AuthorizedBy,
+		RequestedAt:  now,
+		ExpiresAt:    now.Add(deployment.ApprovalExpiry),
+		job:          job,
+		payload:      payload,
+	})
+	job.SetStatus(StatusPending, "", "Waiting for approval")
+	s.notify(deployment, notification{
+		Event:   EventApprovalRequested,
+		Message: fmt.Sprintf("Update to %s by %s is awaiting approval", payload.Tags(), payload.AuthorizedBy),
+		Payload: payload,
+		Fields:  map[string]string{"job_id": job.ID},
+	})
+}
+
+// expireApprovals periodically discards stale pending updates until the context is cancelled
+func (s *WebhookServer) expireApprovals(ctx context.Context) {
+	ticker := time.NewTicker(approvalCheckInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, update := range s.state.ExpirePending(now) {
+				s.finishPending(update, StatusExpired, "Approval expired")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// finishPending resolves a pending update's job without running it
+func (s *WebhookServer) finishPending(update PendingUpdate, status string, message string) {
+	log.WithFields(log.Fields{"deployment": update.Deployment, "job_id": update.ID}).Infof("Pending update %s: %s", status, message)
+	deployment, ok := s.lookupDeployment(update.Deployment)
+	if !ok {
+		// The deployment has since been removed, so there's nobody to tell
+		update.job.SetStatus(status, "", message)
+		return
+	}
+	s.resolveJob(update.job, deployment, update.payload, status, "", message)
+}
+
+// ApprovalHandler serves the approval queue, which shares the admin API's authentication
+//
+// GET  /approvals/              lists updates awaiting approval
+// POST /approvals/{id}/approve  commits a pending update
+// POST /approvals/{id}/reject   discards a pending update
+type ApprovalHandler struct {
+	server *WebhookServer
+}
+
+func (h ApprovalHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/approvals/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		if req.Method != http.MethodGet {
+			writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		writeJSON(resp, http.StatusOK, h.server.state.Pending())
+	case len(parts) == 2 && (parts[1] == "approve" || parts[1] == "reject"):
+		if req.Method != http.MethodPost {
+			writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		var body approvalRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.ApprovedBy == "" {
+			writeResponse(resp, newResponse(http.StatusBadRequest, "Missing field: approved_by"))
+			return
+		}
+		if parts[1] == "approve" {
+			writeResponse(resp, h.approve(parts[0], body.ApprovedBy))
+		} else {
+			writeResponse(resp, h.reject(parts[0], body.ApprovedBy))
+		}
+	default:
+		writeResponse(resp, newResponse(http.StatusNotFound, "Not found"))
+	}
+}
+
+// approve runs a pending update in the background, as it has already been accepted once
+func (h ApprovalHandler) approve(id string, approvedBy string) UpdateResponse {
+	update, ok := h.server.state.TakePending(id)
+	if !ok {
+		return newResponse(http.StatusNotFound, "Pending update not found")
+	}
+	// Requiring approval is pointless if people can approve their own changes
+	if approvedBy == update.AuthorizedBy {
+		h.server.state.AddPending(update)
+		return newResponse(http.StatusForbidden, "Updates cannot be approved by their author")
+	}
+	deployment, ok := h.server.lookupDeployment(update.Deployment)
+	if !ok {
+		h.server.finishPending(update, StatusFailed, "Deployment no longer exists")
+		return newResponse(http.StatusNotFound, "Deployment not found")
+	}
+	logData := requestLogFields(update.payload)
+	logData["tag"], logData["approved_by"], logData["job_id"] = update.payload.Tags(), approvedBy, update.job.ID
+	log.WithFields(logData).Info("Pending update approved")
+	update.job.SetStatus(StatusRunning, "", fmt.Sprintf("Approved by %s", approvedBy))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.server.timeoutsFor(deployment, update.payload).Update)
+		defer cancel()
+		h.server.runApprovedUpdate(ctx, update.job, deployment, update.payload, logData)
+	}()
+
+	toRet := newResponse(http.StatusAccepted, fmt.Sprintf("Approved by %s", approvedBy))
+	toRet.JobId = update.ID
+	return toRet
+}
+
+func (h ApprovalHandler) reject(id string, rejectedBy string) UpdateResponse {
+	update, ok := h.server.state.TakePending(id)
+	if !ok {
+		return newResponse(http.StatusNotFound, "Pending update not found")
+	}
+	h.server.finishPending(update, StatusRejected, fmt.Sprintf("Rejected by %s", rejectedBy))
+
+	toRet := newResponse(http.StatusOK, fmt.Sprintf("Rejected by %s", rejectedBy))
+	toRet.JobId = update.ID
+	return toRet
+}
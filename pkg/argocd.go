@@ -6,65 +6,130 @@ import (
 	"fmt"
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/session"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/argoproj/gitops-engine/pkg/sync/common"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+	"sync"
 	"time"
 )
 
 const argoTimeout = 300
 
-func (s *WebhookServer) argoSync(applicationName string, waitForRevision string) {
+// defaultArgoServer names the argocd block without a name, and the deprecated top-level attributes
+const defaultArgoServer = "default"
+
+var errArgoDegraded = errors.New("application is degraded")
+var errArgoSyncWindow = errors.New("sync window is closed")
+
+var argoSyncResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "argocd",
+	Name:      "syncs_total",
+	Help:      "The number of ArgoCD syncs, by application and result",
+}, []string{"application", "result"})
+
+func (s *WebhookServer) argoSync(job *Job, deployment *Deployment, payload UpdateRequest, waitForRevision string) {
+	applicationName := deployment.ApplicationName
+	job.SetStatus(StatusSyncing, waitForRevision, "")
 	// Set up a context so that we don't retry forever
-	ctx, cancel := context.WithTimeout(context.Background(), argoTimeout*time.Second)
+	timeout := deployment.ArgoTimeout
+	if timeout == 0 {
+		timeout = s.timeoutsFor(deployment, payload).ArgoCD
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	ctx, done := s.syncs.begin(ctx, syncKey{s.argoFor(deployment), applicationName}, payload.Tags())
+	defer done()
+	startTime := time.Now()
 	// Retry with exponential backoff, in case the argo server is unavailable
+	var result string
 	err := backoff.Retry(func() error {
-		return s.doArgoSync(ctx, applicationName, waitForRevision)
+		var err error
+		result, err = s.doArgoSync(ctx, deployment, waitForRevision)
+		return err
 	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+	logFields := requestLogFields(payload)
+	logFields["job_id"] = job.ID
+	logFields["application"] = applicationName
+	logFields["revision"] = waitForRevision
+	logFields["sync_ms"] = time.Since(startTime).Milliseconds()
+	note := notification{
+		Payload: payload,
+		Fields:  map[string]string{"revision": waitForRevision, "application": applicationName},
+	}
+	if superseded := supersededBy(ctx); superseded != nil {
+		// The newer revision's sync will deploy this one's changes too
+		log.WithFields(logFields).Info("ArgoCD sync was superseded")
+		argoSyncResults.WithLabelValues(applicationName, "superseded").Inc()
+		s.resolveJob(job, deployment, payload, StatusUnchanged, waitForRevision, fmt.Sprintf("Sync %v", superseded))
+		return
+	}
 	if err != nil {
-		logFields := map[string]interface{}{
-			"application": applicationName,
-			"revision":    waitForRevision,
-		}
+		result = StatusSyncFailed
 		if errors.Is(err, context.DeadlineExceeded) {
 			log.WithFields(logFields).Warn("Timed out waiting for ArgoCD sync")
+			argoSyncResults.WithLabelValues(applicationName, "timeout").Inc()
+		} else if errors.Is(err, errArgoDegraded) {
+			log.WithFields(logFields).Warn("ArgoCD application became degraded")
+			argoSyncResults.WithLabelValues(applicationName, StatusDegraded).Inc()
+			result = StatusDegraded
 		} else {
 			log.WithError(err).WithFields(logFields).Warn("Could not trigger ArgoCD sync")
+			argoSyncResults.WithLabelValues(applicationName, StatusSyncFailed).Inc()
 		}
+		note.Event = EventSyncFailed
+		note.Message = fmt.Sprintf("ArgoCD sync of %s failed: %v", applicationName, err)
+		s.notify(deployment, note)
+		s.resolveJob(job, deployment, payload, result, waitForRevision, err.Error())
+		return
+	}
+	log.WithFields(logFields).Debug("Sync timings")
+	argoSyncResults.WithLabelValues(applicationName, result).Inc()
+	note.Event = EventSyncSucceeded
+	note.Message = fmt.Sprintf("ArgoCD application %s synchronized to %s", applicationName, payload.Tags())
+	if result == StatusHealthy {
+		note.Message = fmt.Sprintf("ArgoCD application %s is healthy at %s", applicationName, payload.Tags())
 	}
+	s.notify(deployment, note)
+	s.resolveJob(job, deployment, payload, result, waitForRevision, "")
 }
 
-func (s *WebhookServer) doArgoSync(ctx context.Context, applicationName string, waitForRevision string) error {
+func (s *WebhookServer) doArgoSync(ctx context.Context, deployment *Deployment, waitForRevision string) (string, error) {
+	applicationName := deployment.ApplicationName
 	logFields := map[string]interface{}{
 		"application": applicationName,
 		"revision":    waitForRevision,
 	}
-	// Open a connection to the ArgoCD server
-	client, err := apiclient.NewClient(&apiclient.ClientOptions{
-		ServerAddr: s.argoUrl,
-		AuthToken:  s.argoToken,
-	})
-	if err != nil {
-		return fmt.Errorf("connecting to argocd failed: %w", err)
-	}
-	closer, appClient, err := client.NewApplicationClient()
+	// Reuse the shared connection to the deployment's ArgoCD server
+	argo := s.argoFor(deployment)
+	client, appClient, err := argo.applications()
 	if err != nil {
-		return fmt.Errorf("creating application client failed: %w", err)
+		return "", err
 	}
-	defer closer.Close()
 	// Fetch the application to make sure we're authenticated
 	if _, err := appClient.Get(ctx, &application.ApplicationQuery{Name: &applicationName}); err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
-			return backoff.Permanent(err)
+			return "", backoff.Permanent(err)
 		}
 		if errStatus, ok := status.FromError(err); ok {
 			if errStatus.Code() == codes.Unauthenticated || errStatus.Code() == codes.PermissionDenied {
-				return backoff.Permanent(err)
+				return "", backoff.Permanent(err)
+			}
+			// Reconnect on the next attempt if the server went away
+			if errStatus.Code() == codes.Unavailable {
+				argo.reset()
 			}
 		}
-		return err
+		return "", err
 	}
 	// Wait for ArgoCD to notify us that the revision is available
 	revChan := client.WatchApplicationWithRetry(ctx, applicationName, "")
@@ -78,14 +143,244 @@ func (s *WebhookServer) doArgoSync(ctx context.Context, applicationName string,
 				ready = true
 			}
 		case <-ctx.Done():
-			return ctx.Err()
+			return "", ctx.Err()
 		}
 	}
-	// Finally, trigger the synchronization
-	if _, err := appClient.Sync(ctx, &application.ApplicationSyncRequest{Name: &applicationName}); err != nil {
-		return fmt.Errorf("synchronizing application failed: %w", err)
+	// Sync windows are only enforced for manual syncs if the project says so, so check them ourselves if asked
+	if deployment.ArgoSync.RespectSyncWindows {
+		windows, err := appClient.GetApplicationSyncWindows(ctx, &application.ApplicationSyncWindowsQuery{Name: &applicationName})
+		if err != nil {
+			return "", fmt.Errorf("fetching sync windows failed: %w", err)
+		}
+		if windows.CanSync != nil && !*windows.CanSync {
+			return "", backoff.Permanent(errArgoSyncWindow)
+		}
+	}
+	// Then trigger the synchronization
+	if _, err := appClient.Sync(ctx, argoSyncRequest(applicationName, deployment.ArgoSync)); err != nil {
+		return "", fmt.Errorf("synchronizing application failed: %w", err)
 	}
 	log.WithFields(logFields).Info("Application synchronized")
+	if !deployment.ArgoWaitHealthy {
+		return StatusSynced, nil
+	}
+
+	// Finally, wait for the rollout to finish one way or the other
+	// NB: The sync has been accepted, so failures from here on shouldn't trigger another one
+	if err := waitForHealthy(ctx, client, applicationName, waitForRevision); err != nil {
+		return "", backoff.Permanent(err)
+	}
+	log.WithFields(logFields).Info("Application is healthy")
+
+	return StatusHealthy, nil
+}
+
+// validateArgoSync checks that a deployment's sync options will be accepted by ArgoCD
+func validateArgoSync(cfg ArgoSyncConfig) error {
+	for _, option := range cfg.Options {
+		if !strings.Contains(option, "=") {
+			return fmt.Errorf("invalid argocd_sync option %q, expected Key=value", option)
+		}
+	}
+	if cfg.RetryLimit < 0 {
+		return fmt.Errorf("invalid argocd_sync retry_limit: %d", cfg.RetryLimit)
+	}
+	for _, duration := range []string{cfg.RetryBackoff, cfg.RetryMaxDuration} {
+		if duration == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(duration); err != nil {
+			return fmt.Errorf("invalid argocd_sync retry duration: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// argoSyncRequest builds the sync request for an application, including any configured options
+func argoSyncRequest(applicationName string, cfg ArgoSyncConfig) *application.ApplicationSyncRequest {
+	toRet := &application.ApplicationSyncRequest{Name: &applicationName}
+	if cfg.Prune {
+		toRet.Prune = &cfg.Prune
+	}
+	if cfg.Force {
+		// NB: Force is only honoured by ArgoCD as part of a strategy
+		toRet.Strategy = &v1alpha1.SyncStrategy{
+			Hook: &v1alpha1.SyncStrategyHook{
+				SyncStrategyApply: v1alpha1.SyncStrategyApply{Force: true},
+			},
+		}
+	}
+	options := append([]string(nil), cfg.Options...)
+	if cfg.ApplyOutOfSyncOnly {
+		options = append(options, "ApplyOutOfSyncOnly=true")
+	}
+	if len(options) > 0 {
+		toRet.SyncOptions = &application.SyncOptions{Items: options}
+	}
+	if cfg.RetryLimit > 0 {
+		toRet.RetryStrategy = &v1alpha1.RetryStrategy{Limit: cfg.RetryLimit}
+		if cfg.RetryBackoff != "" || cfg.RetryFactor != 0 || cfg.RetryMaxDuration != "" {
+			toRet.RetryStrategy.Backoff = &v1alpha1.Backoff{
+				Duration:    cfg.RetryBackoff,
+				MaxDuration: cfg.RetryMaxDuration,
+			}
+			if cfg.RetryFactor != 0 {
+				toRet.RetryStrategy.Backoff.Factor = &cfg.RetryFactor
+			}
+		}
+	}
+
+	return toRet
+}
+
+// waitForHealthy watches an application until its sync of the given revision has succeeded and it is
+// healthy, or it has failed or become degraded
+func waitForHealthy(ctx context.Context, client apiclient.Client, applicationName string, revision string) error {
+	appChan := client.WatchApplicationWithRetry(ctx, applicationName, "")
+	for {
+		select {
+		case event := <-appChan:
+			app := event.Application
+			opState := app.Status.OperationState
+			// Only judge the application once the operation for our revision is underway
+			if opState == nil || opState.SyncResult == nil || opState.SyncResult.Revision != revision {
+				continue
+			}
+			if opState.Phase == common.OperationFailed || opState.Phase == common.OperationError {
+				return fmt.Errorf("sync operation failed: %s", opState.Message)
+			}
+			if app.Status.Health.Status == health.HealthStatusDegraded {
+				return errArgoDegraded
+			}
+			if opState.Phase == common.OperationSucceeded &&
+				app.Status.Sync.Status == v1alpha1.SyncStatusCodeSynced &&
+				app.Status.Health.Status == health.HealthStatusHealthy {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkCredentials verifies that the ArgoCD token is still accepted
+func (c *ArgoClient) checkCredentials(ctx context.Context) error {
+	client, err := c.client()
+	if err != nil {
+		return err
+	}
+	closer, sessionClient, err := client.NewSessionClient()
+	if err != nil {
+		return fmt.Errorf("creating session client failed: %w", err)
+	}
+	defer closer.Close()
+	userInfo, err := sessionClient.GetUserInfo(ctx, &session.GetUserInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("fetching user info failed: %w", err)
+	}
+	if !userInfo.LoggedIn {
+		return fmt.Errorf("token is not logged in")
+	}
 
 	return nil
 }
+
+// argoFor returns the ArgoCD server which syncs a deployment, or nil if there isn't one
+// NB: Deployments which don't name a server use the only one configured, or the unnamed one
+func (s *WebhookServer) argoFor(deployment *Deployment) *ArgoClient {
+	if deployment.ArgoServer != "" {
+		return s.argoServers[deployment.ArgoServer]
+	}
+	if len(s.argoServers) == 1 {
+		for _, client := range s.argoServers {
+			return client
+		}
+	}
+
+	return s.argoServers[defaultArgoServer]
+}
+
+// checkArgoServer makes sure that the ArgoCD server a deployment names exists
+func (s *WebhookServer) checkArgoServer(deployment *Deployment) error {
+	if deployment.ArgoServer == "" {
+		return nil
+	}
+	if _, ok := s.argoServers[deployment.ArgoServer]; !ok {
+		return fmt.Errorf("deployment %s uses unknown argocd server: %s", deployment.Name, deployment.ArgoServer)
+	}
+
+	return nil
+}
+
+// ArgoClient lazily connects to ArgoCD, and keeps the connection for reuse between syncs
+type ArgoClient struct {
+	options   apiclient.ClientOptions
+	mutex     sync.Mutex
+	apiClient apiclient.Client
+	closer    io.Closer
+	appClient application.ApplicationServiceClient
+}
+
+func NewArgoClient(cfg ArgoConfig) *ArgoClient {
+	return &ArgoClient{
+		options: apiclient.ClientOptions{
+			ServerAddr: cfg.Url,
+			AuthToken:  cfg.Token,
+			Insecure:   cfg.Insecure,
+			PlainText:  cfg.PlainText,
+			GRPCWeb:    cfg.GRPCWeb,
+		},
+	}
+}
+
+func (c *ArgoClient) client() (apiclient.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.connect()
+}
+
+// connect creates the API client if required
+// NB: Must be called with the mutex held
+func (c *ArgoClient) connect() (apiclient.Client, error) {
+	if c.apiClient != nil {
+		return c.apiClient, nil
+	}
+	apiClient, err := apiclient.NewClient(&c.options)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to argocd failed: %w", err)
+	}
+	c.apiClient = apiClient
+
+	return apiClient, nil
+}
+
+// applications returns the API client along with a shared application service connection
+func (c *ArgoClient) applications() (apiclient.Client, application.ApplicationServiceClient, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	apiClient, err := c.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.appClient == nil {
+		closer, appClient, err := apiClient.NewApplicationClient()
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating application client failed: %w", err)
+		}
+		c.closer, c.appClient = closer, appClient
+	}
+
+	return apiClient, c.appClient, nil
+}
+
+// reset drops the cached connection, so that the next caller reconnects
+func (c *ArgoClient) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closer != nil {
+		_ = c.closer.Close()
+	}
+	c.apiClient, c.closer, c.appClient = nil, nil, nil
+}
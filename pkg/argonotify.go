@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sigs.k8s.io/json"
+)
+
+// Events sent by Argo CD Notifications, named after its default triggers
+const (
+	argoEventDeployed       = "on-deployed"
+	argoEventHealthDegraded = "on-health-degraded"
+	argoEventSyncFailed     = "on-sync-failed"
+)
+
+// argoNotification is the body expected from the Argo CD Notifications webhook service, e.g.
+//
+//	{"app": "{{.app.metadata.name}}", "event": "on-deployed", "revision": "{{.app.status.sync.revision}}"}
+type argoNotification struct {
+	App      string `json:"app"`
+	Event    string `json:"event"`
+	Revision string `json:"revision"`
+}
+
+// ArgoNotificationHandler receives events from Argo CD Notifications, and uses them to resolve
+// the jobs which triggered the matching sync
+type ArgoNotificationHandler struct {
+	server *WebhookServer
+}
+
+func (h ArgoNotificationHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	bodyBytes, rejection := readPayload(req, h.server.maxJSONDepth)
+	if rejection != nil {
+		writeResponse(resp, *rejection)
+		return
+	}
+	var event argoNotification
+	if strictErr, err := json.UnmarshalStrict(bodyBytes, &event, json.DisallowDuplicateFields); err != nil || len(strictErr) > 0 {
+		writeResponse(resp, newResponse(http.StatusBadRequest, "Failed to decode payload"))
+		return
+	}
+	if event.App == "" || event.Event == "" {
+		writeResponse(resp, newResponse(http.StatusBadRequest, fmt.Sprintf("%v: app, event", missingFieldError)))
+		return
+	}
+	logFields := log.Fields{"application": event.App, "event": event.Event, "revision": event.Revision}
+
+	var status, eventName string
+	switch event.Event {
+	case argoEventDeployed:
+		status, eventName = StatusHealthy, EventSyncSucceeded
+	case argoEventHealthDegraded:
+		status, eventName = StatusDegraded, EventSyncFailed
+	case argoEventSyncFailed:
+		status, eventName = StatusSyncFailed, EventSyncFailed
+	default:
+		log.WithFields(logFields).Debug("Ignoring ArgoCD notification")
+		writeResponse(resp, newResponse(http.StatusAccepted, "Event ignored"))
+		return
+	}
+	log.WithFields(logFields).Info("Received ArgoCD notification")
+
+	for _, deployment := range h.server.allDeployments() {
+		if deployment.ApplicationName != event.App {
+			continue
+		}
+		h.server.handleArgoEvent(deployment, event, status, eventName)
+	}
+
+	writeResponse(resp, newResponse(http.StatusAccepted, "OK"))
+}
+
+// handleArgoEvent resolves the deployment's job for the event's revision, if there is one outstanding
+func (s *WebhookServer) handleArgoEvent(deployment *Deployment, event argoNotification, status string, eventName string) {
+	job, ok := s.jobs.Latest(func(state JobState) bool {
+		return state.Deployment == deployment.Name && (event.Revision == "" || state.Revision == event.Revision)
+	})
+	if !ok {
+		return
+	}
+	state := job.State()
+	payload := UpdateRequest{
+		Deployment:   state.Deployment,
+		Images:       state.Images,
+		AuthorizedBy: state.AuthorizedBy,
+		RequestID:    state.RequestID,
+	}
+	// The job's tag name joins independently tagged images together, so it's only a tag on its own
+	if len(state.Images) == 0 {
+		payload.TagName = state.TagName
+	}
+	message := fmt.Sprintf("ArgoCD reported %s for %s", event.Event, event.App)
+
+	// Jobs which have already reached a final health don't need resolving again
+	if state.Status == StatusSyncing || state.Status == StatusSynced || state.Status == StatusUpdated {
+		s.resolveJob(job, deployment, payload, status, state.Revision, message)
+	}
+	s.notify(deployment, notification{
+		Event:   eventName,
+		Message: message,
+		Payload: payload,
+		Fields:  map[string]string{"revision": state.Revision, "application": event.App},
+	})
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultRetryAfter = 30
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "image_updater",
+		Subsystem: "pipeline",
+		Name:      "queue_depth",
+		Help:      "The number of updates in the pipeline for each configured repository or template, including those holding its locks",
+	}, []string{"repository"})
+	shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "image_updater",
+		Subsystem: "pipeline",
+		Name:      "shed_total",
+		Help:      "The number of requests turned away because their repository's queue was full, by configured repository or template and source",
+	}, []string{"repository", "source"})
+)
+
+// backlog counts the updates in the pipeline for each repository, so that requests can be turned away
+// once too many are waiting on the repository's lock, rather than piling up until they time out
+type backlog struct {
+	maxDepth   int
+	retryAfter time.Duration
+	mutex      sync.Mutex
+	depths     map[string]int
+	// Metrics are labelled by the configured repository or template, as payloads can choose template URLs
+	labelDepths map[string]int
+}
+
+func newBacklog(cfg *BackpressureConfig) (*backlog, error) {
+	toRet := &backlog{
+		retryAfter:  defaultRetryAfter * time.Second,
+		depths:      make(map[string]int),
+		labelDepths: make(map[string]int),
+	}
+	if cfg == nil {
+		return toRet, nil
+	}
+	if cfg.MaxQueueDepth < 0 {
+		return nil, fmt.Errorf("max_queue_depth cannot be negative")
+	}
+	toRet.maxDepth = cfg.MaxQueueDepth
+	if cfg.RetryAfter != "" {
+		retryAfter, err := time.ParseDuration(cfg.RetryAfter)
+		if err != nil || retryAfter < time.Second {
+			return nil, fmt.Errorf("invalid retry_after: %s", cfg.RetryAfter)
+		}
+		toRet.retryAfter = retryAfter
+	}
+
+	return toRet, nil
+}
+
+// backlogKey names the repository an update will lock
+// NB: Dynamic repositories are counted separately from the deployment's own
+func backlogKey(deployment *Deployment, payload UpdateRequest) string {
+	if payload.RepositoryUrl != "" {
+		return payload.RepositoryUrl
+	}
+
+	return deployment.RepositoryName
+}
+
+// enter adds an update to the repository's queue, unless it's already full
+func (b *backlog) enter(key string, label string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxDepth > 0 && b.depths[key] >= b.maxDepth {
+		return false
+	}
+	b.depths[key]++
+	b.labelDepths[label]++
+	queueDepth.WithLabelValues(label).Set(float64(b.labelDepths[label]))
+
+	return true
+}
+
+// leave removes a finished update from the repository's queue
+func (b *backlog) leave(key string, label string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.depths[key]--; b.depths[key] <= 0 {
+		delete(b.depths, key)
+	}
+	if b.labelDepths[label]--; b.labelDepths[label] <= 0 {
+		delete(b.labelDepths, label)
+	}
+	queueDepth.WithLabelValues(label).Set(float64(b.labelDepths[label]))
+}
+
+// admit reserves a place in the pipeline for an update, returning a response if it should be shed instead
+// NB: The place is given up by submit once the update finishes
+func (s *WebhookServer) admit(deployment *Deployment, payload UpdateRequest, source string) *UpdateResponse {
+	if s.backlog.enter(backlogKey(deployment, payload), deployment.RepositoryName) {
+		return nil
+	}
+	shedRequests.WithLabelValues(deployment.RepositoryName, source).Inc()
+	log.WithFields(requestLogFields(payload)).WithField("source", source).Warn("Repository queue is full, shedding request")
+	toRet := newResponse(http.StatusServiceUnavailable, "Too many updates are queued for this repository")
+	toRet.RetryAfter = int(s.backlog.retryAfter.Seconds())
+
+	return &toRet
+}
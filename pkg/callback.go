@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const callbackRetries = 3
+
+// callbackBody is POSTed to the callback URL once an update has resolved
+type callbackBody struct {
+	JobId        string            `json:"job_id"`
+	Deployment   string            `json:"deployment"`
+	TagName      string            `json:"tag_name,omitempty"`
+	Images       map[string]string `json:"images,omitempty"`
+	AuthorizedBy string            `json:"authorized_by"`
+	Status       string            `json:"status"`
+	Revision     string            `json:"revision,omitempty"`
+	Message      string            `json:"message,omitempty"`
+}
+
+// resolveJob records the final status of a job, reports it to any callback URL, and counts it towards alerting
+func (s *WebhookServer) resolveJob(job *Job, deployment *Deployment, payload UpdateRequest, status string, revision string, message string) {
+	job.SetStatus(status, revision, message)
+	// Dry runs don't change anything, so nobody else needs to hear about them
+	if payload.DryRun {
+		return
+	}
+	s.trackOutcome(deployment, payload, status, message)
+	s.reportToSCM(deployment, payload, status, revision)
+	if status == StatusDegraded {
+		go s.rollback(deployment, revision)
+	}
+	s.sendCallback(deployment, payload, callbackBody{
+		JobId:    job.ID,
+		Status:   status,
+		Revision: revision,
+		Message:  message,
+	})
+}
+
+// sendCallback notifies the payload's (or failing that, the deployment's) callback URL in the background
+func (s *WebhookServer) sendCallback(deployment *Deployment, payload UpdateRequest, body callbackBody) {
+	callbackUrl := payload.CallbackUrl
+	if callbackUrl == "" {
+		callbackUrl = deployment.CallbackUrl
+	}
+	if callbackUrl == "" {
+		return
+	}
+	body.Deployment = deployment.Name
+	body.TagName = payload.TagName
+	body.Images = payload.Images
+	body.AuthorizedBy = payload.AuthorizedBy
+
+	go func() {
+		err := backoff.Retry(func() error {
+			return postJSON(callbackUrl, body)
+		}, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), callbackRetries))
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"deployment": deployment.Name,
+				"status":     body.Status,
+			}).Warn("Failed to deliver callback")
+		}
+	}()
+}
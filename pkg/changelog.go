@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const defaultChangelogEntry = "- {{ .date }}: {{ .name }} updated to {{ .tag }}{{ if .previous_tag }} from {{ .previous_tag }}{{ end }} by {{ .user }}"
+
+// Standard git trailers, which tools such as GitHub recognise
+const (
+	TrailerCoAuthoredBy = "Co-authored-by"
+	TrailerSignedOffBy  = "Signed-off-by"
+)
+
+// Changelog appends a templated line to a file in the repository for each update
+type Changelog struct {
+	Path    string
+	Entry   *template.Template
+	Prepend bool
+}
+
+func NewChangelog(cfg ChangelogConfig) (*Changelog, error) {
+	if cfg.Template == "" {
+		cfg.Template = defaultChangelogEntry
+	}
+	entry, err := template.New("").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse changelog template: %w", err)
+	}
+
+	return &Changelog{Path: cfg.Path, Entry: entry, Prepend: cfg.Prepend}, nil
+}
+
+// update adds an entry to the changelog, creating it if needed
+// NB: Prepended entries go after the file's title, if it starts with one
+func (c *Changelog) update(worktree *git.Worktree, templateData map[string]interface{}) error {
+	contents, err := readWorktreeFile(worktree, c.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	entry := bytes.Buffer{}
+	if err := c.Entry.Execute(&entry, templateData); err != nil {
+		return fmt.Errorf("failed to execute changelog template: %w", err)
+	}
+	line := strings.TrimRight(entry.String(), "\n") + "\n"
+
+	var updated string
+	if !c.Prepend {
+		updated = string(contents)
+		if updated != "" && !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+		updated += line
+	} else if title, rest, found := strings.Cut(string(contents), "\n"); found && strings.HasPrefix(title, "# ") {
+		updated = title + "\n\n" + line + strings.TrimLeft(rest, "\n")
+	} else {
+		updated = line + string(contents)
+	}
+
+	return writeWorktreeFile(worktree, c.Path, []byte(updated))
+}
+
+// trailer is a templated git trailer, such as "Signed-off-by: {{ .user }}"
+type trailer struct {
+	Key   string
+	Value *template.Template
+}
+
+func newTrailers(cfg TrailersConfig) ([]trailer, error) {
+	var toRet []trailer
+	add := func(key string, value string) error {
+		if strings.ContainsAny(key, ": \n") || key == "" {
+			return fmt.Errorf("invalid trailer: %q", key)
+		}
+		tpl, err := template.New("").Parse(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s trailer: %w", key, err)
+		}
+		toRet = append(toRet, trailer{Key: key, Value: tpl})
+		return nil
+	}
+	for _, value := range cfg.CoAuthoredBy {
+		if err := add(TrailerCoAuthoredBy, value); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range cfg.SignedOffBy {
+		if err := add(TrailerSignedOffBy, value); err != nil {
+			return nil, err
+		}
+	}
+	// Maps have no order, so keep the commit message stable
+	keys := make([]string, 0, len(cfg.Other))
+	for key := range cfg.Other {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := add(key, cfg.Other[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	return toRet, nil
+}
+
+// appendTrailers adds the trailers to the end of a commit message, skipping any which render empty
+func appendTrailers(message string, trailers []trailer, templateData map[string]interface{}) (string, error) {
+	var lines []string
+	for _, t := range trailers {
+		value := bytes.Buffer{}
+		if err := t.Value.Execute(&value, templateData); err != nil {
+			return "", fmt.Errorf("failed to execute %s trailer: %w", t.Key, err)
+		}
+		// NB: A newline would end the trailer block early
+		rendered := strings.Join(strings.Fields(value.String()), " ")
+		if rendered != "" {
+			lines = append(lines, t.Key+": "+rendered)
+		}
+	}
+	if len(lines) == 0 {
+		return message, nil
+	}
+
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(lines, "\n") + "\n", nil
+}
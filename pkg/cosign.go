@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// Media types accepted when resolving a tag to its digest
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// cosignPayload is the simple signing payload which cosign signs
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// ociManifest is the subset of an image manifest needed to find signatures
+type ociManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+func parsePublicKey(keyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// verifyCosign checks that an image tag has a signature made by the key, as stored by `cosign sign --key`,
+// returning the digest which was verified
+// NB: Only key-based signatures are supported; keyless signatures need the Sigstore trust roots
+func verifyCosign(ctx context.Context, registry *registryClient, key crypto.PublicKey, reference string, tag string) (string, error) {
+	host, repository := splitImageReference(reference)
+	digest, err := registry.resolve(ctx, host, repository, tag)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve tag: %w", err)
+	}
+
+	// Signatures are stored under a tag derived from the digest they sign
+	sigTag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	manifestBytes, _, err := registry.get(ctx, host, repository, "manifests/"+sigTag, manifestMediaTypes)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch signatures: %w", err)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", fmt.Errorf("could not decode signatures: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		payload, _, err := registry.get(ctx, host, repository, "blobs/"+layer.Digest, nil)
+		if err != nil {
+			return "", fmt.Errorf("could not fetch signature payload: %w", err)
+		}
+		if checkDigest(payload, layer.Digest) != nil || !verifySignature(key, payload, signature) {
+			continue
+		}
+		var decoded cosignPayload
+		if err := json.Unmarshal(payload, &decoded); err != nil {
+			continue
+		}
+		if decoded.Critical.Image.DockerManifestDigest == digest {
+			return digest, nil
+		}
+	}
+
+	return "", fmt.Errorf("no valid signature found for %s", digest)
+}
+
+func verifySignature(key crypto.PublicKey, payload []byte, signature []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	}
+
+	return false
+}
+
+func checkDigest(contents []byte, digest string) error {
+	sum := sha256.Sum256(contents)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return fmt.Errorf("digest mismatch")
+	}
+
+	return nil
+}
+
+// splitImageReference splits an image name into its registry host and repository, using the
+// same defaults as Docker
+func splitImageReference(reference string) (string, string) {
+	host, repository := "docker.io", reference
+	if idx := strings.IndexRune(reference, '/'); idx != -1 {
+		first := reference[:idx]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, repository = first, reference[idx+1:]
+		}
+	}
+	if host == "docker.io" && !strings.ContainsRune(repository, '/') {
+		repository = "library/" + repository
+	}
+
+	return host, repository
+}
+
+// registryClient makes authenticated requests to OCI registries
+type registryClient struct {
+	username string
+	password string
+}
+
+func newRegistryClient(username string, password string) *registryClient {
+	return &registryClient{username: username, password: password}
+}
+
+// resolve returns the digest that a tag currently points to
+func (c *registryClient) resolve(ctx context.Context, host string, repository string, tag string) (string, error) {
+	body, header, err := c.get(ctx, host, repository, "manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", err
+	}
+	if digest := header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, checkDigest(body, digest)
+	}
+	sum := sha256.Sum256(body)
+
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// get fetches a manifest or blob, authenticating if the registry asks us to
+func (c *registryClient) get(ctx context.Context, host string, repository string, resource string, accept []string) ([]byte, http.Header, error) {
+	apiHost := host
+	if host == "docker.io" {
+		apiHost = "registry-1.docker.io"
+	}
+	reqUrl := fmt.Sprintf("https://%s/v2/%s/%s", apiHost, repository, resource)
+
+	authorization := ""
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && authorization == "" {
+			if authorization, err = c.authorize(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, host)
+		}
+		return body, resp.Header, nil
+	}
+
+	return nil, nil, fmt.Errorf("not authorized by %s", host)
+}
+
+// authorize answers a registry's authentication challenge, returning an Authorization header
+func (c *registryClient) authorize(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.username, c.password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	// Bearer challenges send us to a token service, which may grant anonymous access
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm: %w", err)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned status %d", resp.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("could not decode token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and parameters
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			value, rest = rest[1:end+1], rest[min(end+2, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	return scheme, params
+}
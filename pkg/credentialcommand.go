@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const credentialCommandTimeout = 30
+
+// credentialCommandUrlEnv tells the command which URL is about to be fetched from or pushed to
+const credentialCommandUrlEnv = "IMAGE_UPDATER_REPOSITORY_URL"
+
+var credentialCommandRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "repository",
+	Name:      "credential_command_runs_total",
+	Help:      "The number of times a credential_command was run, by result",
+}, []string{"result"})
+
+// credentialCommand fetches short-lived credentials by running a program before each fetch and push
+// NB: There's no shell, so the command is split on whitespace and can't quote its arguments
+type credentialCommand struct {
+	args        []string
+	username    string
+	tokenScheme string
+	headers     map[string]string
+}
+
+// newCredentialCommand returns nil if there's no command, as the static credentials are used instead
+func newCredentialCommand(command string, username string, password string, token string, tokenScheme string, headers map[string]string) (*credentialCommand, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if password != "" || token != "" {
+		return nil, fmt.Errorf("credential_command cannot be combined with a password or token")
+	}
+
+	return &credentialCommand{args: args, username: username, tokenScheme: tokenScheme, headers: headers}, nil
+}
+
+// authMethod runs the command, which prints either a bare secret or git credential helper style lines
+// of username=, password= and token=. A bare secret is the password if a username is configured, and
+// otherwise a token.
+func (c *credentialCommand) authMethod(ctx context.Context, repoUrl string) (http.AuthMethod, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialCommandTimeout*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Env = append(os.Environ(), credentialCommandUrlEnv+"="+repoUrl)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		credentialCommandRuns.WithLabelValues("error").Inc()
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("credential_command failed: %w: %s", err, message)
+		}
+		return nil, fmt.Errorf("credential_command failed: %w", err)
+	}
+
+	username, password, token := c.parse(string(output))
+	if password == "" && token == "" {
+		credentialCommandRuns.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("credential_command printed no credentials")
+	}
+	toRet, err := newRepositoryAuth(username, password, token, c.tokenScheme, c.headers)
+	if err != nil {
+		credentialCommandRuns.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("credential_command: %w", err)
+	}
+	credentialCommandRuns.WithLabelValues("success").Inc()
+
+	return toRet, nil
+}
+
+func (c *credentialCommand) parse(output string) (string, string, string) {
+	username := c.username
+	var password, token string
+	helperFormat := false
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "username":
+			username, helperFormat = value, true
+		case "password":
+			password, helperFormat = value, true
+		case "token":
+			token, helperFormat = value, true
+		}
+	}
+	if helperFormat {
+		return username, password, token
+	}
+	if secret := strings.TrimSpace(output); username != "" {
+		password = secret
+	} else {
+		token = secret
+	}
+
+	return username, password, token
+}
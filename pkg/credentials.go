@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const credentialCheckTimeout = 30
+
+var credentialsValid = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "image_updater",
+	Subsystem: "credentials",
+	Name:      "valid",
+	Help:      "Whether the credentials for a repository or ArgoCD were accepted at the last check",
+}, []string{"type", "name"})
+
+// CredentialChecker periodically tests every configured credential
+type CredentialChecker struct {
+	interval time.Duration
+	server   *WebhookServer
+	// failing tracks which credentials have already been reported, so we only alert once
+	failing map[string]bool
+}
+
+func NewCredentialChecker(interval time.Duration, server *WebhookServer) *CredentialChecker {
+	return &CredentialChecker{
+		interval: interval,
+		server:   server,
+		failing:  make(map[string]bool),
+	}
+}
+
+// Run checks the credentials at every interval until the context is cancelled
+func (c *CredentialChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *CredentialChecker) checkAll(ctx context.Context) {
+	for name, repo := range c.server.allRepositories() {
+		c.check(ctx, "repository", name, repo.Check)
+	}
+	for name, argo := range c.server.argoServers {
+		c.check(ctx, "argocd", name, argo.checkCredentials)
+	}
+}
+
+func (c *CredentialChecker) check(ctx context.Context, kind string, name string, checkFunc func(context.Context) error) {
+	checkCtx, cancel := context.WithTimeout(ctx, credentialCheckTimeout*time.Second)
+	defer cancel()
+	logFields := log.Fields{"type": kind, "name": name}
+	key := kind + "/" + name
+
+	if err := checkFunc(checkCtx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		credentialsValid.WithLabelValues(kind, name).Set(0)
+		log.WithError(err).WithFields(logFields).Warn("Credential check failed")
+		if !c.failing[key] {
+			c.failing[key] = true
+			c.server.notify(nil, notification{
+				Event:   EventCredentialFailed,
+				Message: fmt.Sprintf("Credentials for %s %s are failing: %v", kind, name, err),
+				Fields:  map[string]string{"type": kind, "target": name},
+			})
+		}
+		return
+	}
+	credentialsValid.WithLabelValues(kind, name).Set(1)
+	if c.failing[key] {
+		log.WithFields(logFields).Info("Credential check recovered")
+		delete(c.failing, key)
+	}
+}
@@ -9,32 +9,250 @@ import (
 	"gopkg.in/yaml.v3"
 	"io"
 	"regexp"
-	"sigs.k8s.io/kustomize/api/types"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type Deployment struct {
 	Name            string
 	RepositoryName  string
-	KustomizePath   string
+	Type            string
+	Targets         []Target
 	CommitMessage   *template.Template
 	Images          []string
+	Notifiers       []*Notifier
 	ApplicationName string
+	ArgoServer      string // Empty for the default server
+	DuplicatePolicy string
+	Validate        string
+	CallbackUrl     string
+	ArgoWaitHealthy bool
+	ArgoTimeout     time.Duration // Zero defers to the repository or server timeouts
+	RollbackWindow  time.Duration
+	ArgoSync        ArgoSyncConfig
+	Flux            *FluxConfig
+	FluxTimeout     time.Duration
+	Rollout         *RolloutConfig
+	RolloutTimeout  time.Duration
+	Normalize       NormalizeConfig
+	Policy          *Policy
+	StateFile       string
+	Changelog       *Changelog
+	Trailers        []trailer
+	Labels          map[string]string
+	Group           string
+	Pinned          bool
+	IgnoreTags      []string
+	// FailureThreshold overrides the server's failure_alert_threshold, if set
+	FailureThreshold int
+
+	RequiresApproval bool
+	ApprovalExpiry   time.Duration
+	Freezes          []*FreezeWindow
+	FreezeAction     string
+
+	ExtraFields         mapset.Set[string]
+	RequiredExtraFields mapset.Set[string]
 }
 
+// Policies for handling images which are defined more than once
+const (
+	DuplicatesError       = "error"
+	DuplicatesUpdateAll   = "update-all"
+	DuplicatesUpdateFirst = "update-first"
+)
+
 var errorNoModification = errors.New("no changes made")
+var errDeploymentPinned = errors.New("deployment is pinned")
+var errTagIgnored = errors.New("tag is ignored by this deployment")
+var errLFSPointer = errors.New("file is stored in Git LFS")
+
+var lfsPointerPrefix = []byte("version https://git-lfs.github.com/spec/v1\n")
 
 func NewDeployment(cfg DeploymentConfig) (*Deployment, error) {
 	toRet := &Deployment{
 		Name:            cfg.Name,
 		RepositoryName:  cfg.Repository,
-		KustomizePath:   cfg.Path,
+		Type:            cfg.Type,
 		Images:          cfg.Images,
 		ApplicationName: cfg.ArgoName,
+		ArgoServer:      cfg.ArgoServer,
+		DuplicatePolicy: cfg.Duplicates,
+		Validate:        cfg.Validate,
+		CallbackUrl:     cfg.CallbackUrl,
+		ArgoWaitHealthy: cfg.ArgoWaitHealthy,
+		StateFile:       cfg.StateFile,
+		Labels:          cfg.Labels,
+		Group:           cfg.Group,
+		Pinned:          cfg.Pin,
+		IgnoreTags:      cfg.IgnoreTags,
+
+		FailureThreshold: cfg.FailureAlertThreshold,
+
+		RequiresApproval: cfg.RequiresApproval,
+		ApprovalExpiry:   approvalExpiry * time.Second,
+		FreezeAction:     cfg.FreezeAction,
+
+		ExtraFields:         mapset.NewSet[string](cfg.ExtraFields...),
+		RequiredExtraFields: mapset.NewSet[string](cfg.RequiredExtraFields...),
+	}
+	if toRet.FailureThreshold < 0 {
+		return nil, fmt.Errorf("failure_alert_threshold cannot be negative")
+	}
+	switch toRet.DuplicatePolicy {
+	case "":
+		toRet.DuplicatePolicy = DuplicatesError
+	case DuplicatesError, DuplicatesUpdateAll, DuplicatesUpdateFirst:
+	default:
+		return nil, fmt.Errorf("invalid duplicates policy: %s", toRet.DuplicatePolicy)
+	}
+	cfg.Duplicates = toRet.DuplicatePolicy
+	// The deployment's own paths come first, followed by the more specific targets
+	fileTarget, err := NewFileTarget(cfg)
+	if err != nil {
+		return nil, err
+	}
+	toRet.Type = fileTarget.Type
+	if len(fileTarget.Patterns) > 0 {
+		toRet.Targets = append(toRet.Targets, fileTarget)
+	}
+	for _, patchCfg := range cfg.Patches {
+		patch, err := NewPatch(patchCfg, cfg.Images)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Targets = append(toRet.Targets, patch)
+	}
+	defaultImage := ""
+	if len(cfg.Images) > 0 {
+		defaultImage = cfg.Images[0]
+	}
+	for _, replaceCfg := range cfg.Replaces {
+		replacement, err := NewReplacement(replaceCfg, defaultImage)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Targets = append(toRet.Targets, replacement)
+	}
+	for _, jsonnetCfg := range cfg.Jsonnet {
+		replacement, err := NewJsonnetReplacement(jsonnetCfg, defaultImage)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Targets = append(toRet.Targets, replacement)
+	}
+	for _, chartCfg := range cfg.Charts {
+		chart, err := NewHelmChart(chartCfg, defaultImage)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Targets = append(toRet.Targets, chart)
+	}
+	for _, freezeCfg := range cfg.Freezes {
+		window, err := NewFreezeWindow(freezeCfg)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Freezes = append(toRet.Freezes, window)
+	}
+	switch toRet.FreezeAction {
+	case "":
+		toRet.FreezeAction = FreezeActionReject
+	case FreezeActionReject, FreezeActionQueue:
+	default:
+		return nil, fmt.Errorf("invalid freeze_action: %s", toRet.FreezeAction)
+	}
+	for _, notifierCfg := range cfg.Notifiers {
+		notifier, err := NewNotifier(notifierCfg)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Notifiers = append(toRet.Notifiers, notifier)
+	}
+	if cfg.ArgoTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.ArgoTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argocd_timeout: %w", err)
+		}
+		toRet.ArgoTimeout = timeout
+	}
+	if cfg.RollbackWindow != "" {
+		window, err := time.ParseDuration(cfg.RollbackWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollback_on_degraded: %w", err)
+		}
+		toRet.RollbackWindow = window
+	}
+	if cfg.ApprovalExpiry != "" {
+		expiry, err := time.ParseDuration(cfg.ApprovalExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid approval_expiry: %w", err)
+		}
+		toRet.ApprovalExpiry = expiry
+	}
+	if cfg.ArgoSync != nil {
+		if err := validateArgoSync(*cfg.ArgoSync); err != nil {
+			return nil, err
+		}
+		toRet.ArgoSync = *cfg.ArgoSync
+	}
+	if cfg.Flux != nil {
+		if cfg.ArgoName != "" {
+			return nil, fmt.Errorf("argocd_app and flux cannot both be set")
+		}
+		flux := *cfg.Flux
+		if flux.Namespace == "" {
+			flux.Namespace = fluxDefaultNamespace
+		}
+		toRet.Flux = &flux
+		toRet.FluxTimeout = argoTimeout * time.Second
+		if flux.Timeout != "" {
+			timeout, err := time.ParseDuration(flux.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid flux timeout: %w", err)
+			}
+			toRet.FluxTimeout = timeout
+		}
+	}
+	if cfg.Rollout != nil {
+		if cfg.ArgoName != "" || cfg.Flux != nil {
+			return nil, fmt.Errorf("rollout cannot be combined with argocd_app or flux")
+		}
+		rollout := *cfg.Rollout
+		if err := validateRollout(&rollout); err != nil {
+			return nil, err
+		}
+		toRet.Rollout = &rollout
+		toRet.RolloutTimeout = argoTimeout * time.Second
+		if rollout.Timeout != "" {
+			timeout, err := time.ParseDuration(rollout.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rollout timeout: %w", err)
+			}
+			toRet.RolloutTimeout = timeout
+		}
+	}
+	if cfg.Policy != nil {
+		policy, err := NewPolicy(*cfg.Policy)
+		if err != nil {
+			return nil, err
+		}
+		toRet.Policy = policy
 	}
-	if toRet.KustomizePath == "" {
-		toRet.KustomizePath = "kustomization.yaml"
+	if cfg.Normalize != nil {
+		if cfg.Normalize.MaxLength < 0 {
+			return nil, fmt.Errorf("invalid normalize max_length: %d", cfg.Normalize.MaxLength)
+		}
+		toRet.Normalize = *cfg.Normalize
+	}
+	switch toRet.Validate {
+	case "":
+		toRet.Validate = ValidateYAML
+	case ValidateNone, ValidateYAML, ValidateBuild:
+	default:
+		return nil, fmt.Errorf("invalid validate mode: %s", toRet.Validate)
 	}
 	if cfg.CommitMessage == "" {
 		cfg.CommitMessage = "[{{ .name }}] Version bumped to {{ .tag }} by {{ .user }}"
@@ -44,87 +262,295 @@ func NewDeployment(cfg DeploymentConfig) (*Deployment, error) {
 		return nil, fmt.Errorf("failed to parse message template: %w", err)
 	}
 	toRet.CommitMessage = tpl
+	if cfg.Changelog != nil {
+		if toRet.Changelog, err = NewChangelog(*cfg.Changelog); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Trailers != nil {
+		if toRet.Trailers, err = newTrailers(*cfg.Trailers); err != nil {
+			return nil, err
+		}
+	}
 
 	return toRet, nil
 }
 
-func (d Deployment) Apply(worktree *git.Worktree, newTag string, user string) (string, error) {
-	// Start by reading the kustomization file
-	inFile, err := worktree.Filesystem.Open(d.KustomizePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open kustomization file: %w", err)
+// ValidateExtra checks a payload's extra fields against those declared by the deployment
+func (d Deployment) ValidateExtra(extra map[string]string) error {
+	for key := range extra {
+		if !d.ExtraFields.Contains(key) && !d.RequiredExtraFields.Contains(key) {
+			return fmt.Errorf("%w: %s", unknownFieldError, key)
+		}
 	}
-	defer inFile.Close()
-	kustomizationBytes, err := io.ReadAll(inFile)
-	if err != nil {
-		return "", fmt.Errorf("failed to read kustomization file: %w", err)
+	for _, key := range d.RequiredExtraFields.ToSlice() {
+		if extra[key] == "" {
+			return fmt.Errorf("%w: %s", missingFieldError, key)
+		}
 	}
 
-	// Then unmarshal it so that we have a source of truth to work from
-	var kustomization types.Kustomization
-	err = yaml.Unmarshal(kustomizationBytes, &kustomization)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode kustomization file: %w", err)
+	return nil
+}
+
+// ValidateImages checks that a payload's independently tagged images belong to the deployment
+func (d Deployment) ValidateImages(images map[string]string) error {
+	for image := range images {
+		if !matchImage(d.Images, image) {
+			return fmt.Errorf("%w: images.%s", invalidFieldError, image)
+		}
+	}
+
+	return nil
+}
+
+// AllowTags checks a payload's normalized tags against the deployment's pin and ignore_tags
+func (d Deployment) AllowTags(payload UpdateRequest) error {
+	if d.Pinned {
+		return errDeploymentPinned
+	}
+	tags := []string{payload.TagName}
+	if len(payload.Images) > 0 {
+		tags = tags[:0]
+		for _, tag := range payload.Images {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+	}
+	for _, tag := range tags {
+		if matchImage(d.IgnoreTags, tag) {
+			return fmt.Errorf("%w: %s", errTagIgnored, tag)
+		}
 	}
-	// Also convert the bytes to a string
-	kustomizationString := string(kustomizationBytes[:])
 
+	return nil
+}
+
+// NormalizeTag applies the deployment's normalization rules to an incoming tag, so that
+// differently shaped tags from each CI system end up the same
+func (d Deployment) NormalizeTag(tag string) (string, error) {
+	for _, prefix := range d.Normalize.StripPrefixes {
+		tag = strings.TrimPrefix(tag, prefix)
+	}
+	if d.Normalize.StripV && len(tag) > 1 && (tag[0] == 'v' || tag[0] == 'V') && tag[1] >= '0' && tag[1] <= '9' {
+		tag = tag[1:]
+	}
+	if d.Normalize.Lowercase {
+		tag = strings.ToLower(tag)
+	}
+	if tag == "" {
+		return "", fmt.Errorf("%w: tag_name", missingFieldError)
+	}
+	if d.Normalize.MaxLength > 0 && len(tag) > d.Normalize.MaxLength {
+		return "", fmt.Errorf("%w: tag_name", invalidFieldError)
+	}
+
+	return tag, nil
+}
+
+// Paths lists the files within the repository that the deployment modifies
+func (d Deployment) Paths() []string {
+	var toRet []string
+	for _, target := range d.Targets {
+		toRet = append(toRet, target.Paths()...)
+	}
+	if d.StateFile != "" {
+		toRet = append(toRet, d.StateFile)
+	}
+	if d.Changelog != nil {
+		toRet = append(toRet, d.Changelog.Path)
+	}
+
+	return toRet
+}
+
+// ApplyResult describes the commit made by applying a deployment
+type ApplyResult struct {
+	Revision     string
+	PreviousTag  string
+	PreviousTags map[string]string
+	// Images maps every image found in the deployment's files to its tag after the update
+	Images map[string]string
+}
+
+// imageTags maps the images found in a deployment's files to the tags they had before updating
+type imageTags map[string]string
+
+func (t imageTags) merge(other imageTags) {
+	for name, tag := range other {
+		if _, ok := t[name]; !ok {
+			t[name] = tag
+		}
+	}
+}
+
+// known drops images which were added, and so had no previous tag
+func (t imageTags) known() map[string]string {
+	toRet := make(map[string]string, len(t))
+	for name, tag := range t {
+		if tag != "" {
+			toRet[name] = tag
+		}
+	}
+
+	return toRet
+}
+
+// previousTag picks a single representative tag, preferring the first image in name order
+func (t imageTags) previousTag() string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if t[name] != "" {
+			return t[name]
+		}
+	}
+
+	return ""
+}
+
+func (d Deployment) Apply(worktree *git.Worktree, payload UpdateRequest) (ApplyResult, error) {
+	newTag := payload.tagSelector()
 	// Keep track of what images should be found, and whether we've made changes at all
-	changeMade := false
 	wantedImages := mapset.NewThreadUnsafeSet[string]()
-	for _, im := range d.Images {
-		if !strings.ContainsRune(im, '*') {
+	if len(payload.Images) > 0 {
+		for im := range payload.Images {
 			wantedImages.Add(im)
 		}
-	}
-	// Loop over the deployment's images, replacing their tags
-	for _, im := range kustomization.Images {
-		if !matchImage(d.Images, im.Name) {
-			continue
+	} else {
+		for _, im := range d.Images {
+			if !strings.ContainsRune(im, '*') {
+				wantedImages.Add(im)
+			}
 		}
-		wantedImages.Remove(im.Name)
-		if newKustomizationString, err := changeTag(kustomizationString, im.Name, newTag); err != nil {
-			return "", fmt.Errorf("failed to replace image %s: %w", im.Name, err)
-		} else {
-			changeMade = newKustomizationString != kustomizationString
-			kustomizationString = newKustomizationString
+	}
+
+	foundImages := make(imageTags)
+	changeMade := false
+	for _, target := range d.Targets {
+		targetImages, targetChanged, err := target.Apply(worktree, newTag, wantedImages)
+		if err != nil {
+			return ApplyResult{}, err
 		}
+		foundImages.merge(targetImages)
+		changeMade = changeMade || targetChanged
+	}
+
+	for name := range foundImages {
+		wantedImages.Remove(name)
 	}
 	if !wantedImages.IsEmpty() {
-		return "", fmt.Errorf("kustomization file does not contain image(s): %s", strings.Join(wantedImages.ToSlice(), ", "))
+		return ApplyResult{}, fmt.Errorf("deployment files do not contain image(s): %s", strings.Join(wantedImages.ToSlice(), ", "))
 	}
 	if !changeMade {
-		return "", errorNoModification
+		return ApplyResult{}, errorNoModification
 	}
 
-	// Write it back and stage the file for commit
-	outFile, err := worktree.Filesystem.Create(d.KustomizePath)
-	_, err = outFile.Write([]byte(kustomizationString))
+	// Refuse to commit anything which would break whatever consumes the repository
+	if err := d.validate(worktree); err != nil {
+		return ApplyResult{}, fmt.Errorf("validation failed: %w", err)
+	}
+
+	// Record the update alongside it, if requested
+	if d.StateFile != "" {
+		if err := d.updateStateFile(worktree, payload); err != nil {
+			return ApplyResult{}, fmt.Errorf("failed to update state file: %w", err)
+		}
+	}
+
+	// Commit the change, whose message can refer to the tags being replaced
+	toRet := ApplyResult{PreviousTags: foundImages.known(), Images: make(map[string]string, len(foundImages))}
+	for name, tag := range foundImages {
+		if updated, ok := newTag(name); ok {
+			tag = updated
+		}
+		toRet.Images[name] = tag
+	}
+	// Images with independent tags can't be rolled back to a single previous tag
+	if len(payload.Images) == 0 {
+		toRet.PreviousTag = foundImages.previousTag()
+	}
+	templateData := d.templateData(payload)
+	templateData["previous_tag"] = toRet.PreviousTag
+	templateData["previous_tags"] = toRet.PreviousTags
+	templateData["date"] = time.Now().UTC().Format(time.DateOnly)
+	if d.Changelog != nil {
+		if err := d.Changelog.update(worktree, templateData); err != nil {
+			return ApplyResult{}, fmt.Errorf("failed to update changelog: %w", err)
+		}
+	}
+	commitMsg := bytes.Buffer{}
+	if err := d.CommitMessage.Execute(&commitMsg, templateData); err != nil {
+		return ApplyResult{}, fmt.Errorf("failed to execute message template: %w", err)
+	}
+	message, err := appendTrailers(commitMsg.String(), d.Trailers, templateData)
 	if err != nil {
-		_ = outFile.Close()
-		return "", fmt.Errorf("failed to write kustomization file: %w", err)
+		return ApplyResult{}, err
 	}
-	_ = outFile.Close()
-	_, err = worktree.Add(d.KustomizePath)
+	commitHash, err := worktree.Commit(message, &git.CommitOptions{})
 	if err != nil {
-		return "", fmt.Errorf("failed to stage kustomization file: %w", err)
+		return ApplyResult{}, fmt.Errorf("failed to commit changes: %w", err)
 	}
 
-	// Commit the change
-	commitMsg := bytes.Buffer{}
-	if err := d.CommitMessage.Execute(&commitMsg, map[string]string{
-		"name": d.Name,
-		"tag":  newTag,
-		"user": user,
-	}); err != nil {
-		return "", fmt.Errorf("failed to execute message template: %w", err)
-	}
-	commitHash, err := worktree.Commit(commitMsg.String(), &git.CommitOptions{})
+	toRet.Revision = commitHash.String()
+
+	return toRet, nil
+}
+
+// templateData returns the values available to a deployment's templates
+func (d Deployment) templateData(payload UpdateRequest) map[string]interface{} {
+	extra := payload.Extra
+	if extra == nil {
+		extra = map[string]string{}
+	}
+
+	return map[string]interface{}{
+		"name":   d.Name,
+		"tag":    payload.Tags(),
+		"images": payload.Images,
+		"user":   payload.AuthorizedBy,
+		"extra":  extra,
+	}
+}
+
+// NB: Files stored in Git LFS are only checked out as pointers, which can't be updated
+func readWorktreeFile(worktree *git.Worktree, path string) ([]byte, error) {
+	inFile, err := worktree.Filesystem.Open(path)
 	if err != nil {
-		return "", fmt.Errorf("failed to commit kustomization file: %w", err)
+		return nil, err
 	}
+	defer inFile.Close()
 
-	return commitHash.String(), nil
+	contents, err := io.ReadAll(inFile)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(contents, lfsPointerPrefix) {
+		return nil, errLFSPointer
+	}
+
+	return contents, nil
+}
+
+// writeWorktreeFile replaces the contents of a file and stages it for commit
+func writeWorktreeFile(worktree *git.Worktree, path string, contents []byte) error {
+	outFile, err := worktree.Filesystem.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = outFile.Write(contents)
+	if err != nil {
+		_ = outFile.Close()
+		return err
+	}
+	_ = outFile.Close()
+	if _, err = worktree.Add(path); err != nil {
+		return fmt.Errorf("failed to stage file: %w", err)
+	}
+
+	return nil
 }
 
 func fnmatch(pattern string, input string) bool {
@@ -155,7 +581,59 @@ func matchImage(images []string, search string) bool {
 	return false
 }
 
-func changeTag(kustomizeBody string, imageName string, newTag string) (string, error) {
+// addImageEntry appends an image to the kustomization's images list, creating the list if needed
+func addImageEntry(kustomizeBody string, imageName string, newTag string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(kustomizeBody), &doc); err != nil {
+		return "", fmt.Errorf("failed to decode kustomization file: %w", err)
+	}
+	if strings.ContainsAny(newTag, "\"\\\n") || strings.ContainsAny(imageName, "\"\\\n") {
+		return "", fmt.Errorf("cannot write %s:%s into a YAML string", imageName, newTag)
+	}
+	if !strings.HasSuffix(kustomizeBody, "\n") && kustomizeBody != "" {
+		kustomizeBody += "\n"
+	}
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	images := mappingNode(root, "images")
+	if images == nil {
+		return kustomizeBody + fmt.Sprintf("images:\n- name: %s\n  newTag: %q\n", imageName, newTag), nil
+	}
+	if images.Kind != yaml.SequenceNode || images.Style&yaml.FlowStyle != 0 || len(images.Content) == 0 {
+		return "", fmt.Errorf("images must be a non-empty block list to be added to")
+	}
+
+	// Match the indentation of the existing entries
+	dashIndent := strings.Repeat(" ", images.Column-1)
+	keyIndent := strings.Repeat(" ", images.Content[0].Column-1)
+	entry := fmt.Sprintf("%s- name: %s\n%snewTag: %q\n", dashIndent, imageName, keyIndent, newTag)
+
+	// The new entry goes just before whatever follows the images list
+	offset := len(kustomizeBody)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i+1] == images && i+2 < len(root.Content) {
+			next := root.Content[i+2]
+			offset = lineColumnOffset(kustomizeBody, next.Line, 1)
+			// NB: Comments directly above the next key belong to it
+			for _, line := range strings.Split(next.HeadComment, "\n") {
+				if line != "" {
+					offset = strings.LastIndex(kustomizeBody[:offset-1], "\n") + 1
+				}
+			}
+			break
+		}
+	}
+	// Keep any blank lines between the list and what follows it
+	for offset > 1 && kustomizeBody[offset-2] == '\n' {
+		offset--
+	}
+
+	return kustomizeBody[:offset] + entry + kustomizeBody[offset:], nil
+}
+
+func changeTag(kustomizeBody string, imageName string, newTag string, policy string) (string, error) {
 	// To use the image name in the regex, we first have to quote it
 	quotedName := regexp.QuoteMeta(imageName)
 	// Substitute the name in and compile the regex
@@ -164,17 +642,29 @@ func changeTag(kustomizeBody string, imageName string, newTag string) (string, e
 	if err != nil {
 		return "", fmt.Errorf("failed to compile regex: %w", err)
 	}
-	// We only want 1 match, but search for 2 so we can detect duplicates
-	matches := re.FindAllStringSubmatchIndex(kustomizeBody, 2)
+	// Unless we're updating every definition, search for 2 so we can detect duplicates
+	limit := 2
+	if policy == DuplicatesUpdateAll {
+		limit = -1
+	}
+	matches := re.FindAllStringSubmatchIndex(kustomizeBody, limit)
 	if len(matches) == 0 {
 		return "", fmt.Errorf("could not find image definition for %s", imageName)
 	}
 	if len(matches) > 1 {
-		return "", fmt.Errorf("found more than one image definition for %s", imageName)
+		switch policy {
+		case DuplicatesUpdateFirst:
+			matches = matches[:1]
+		case DuplicatesUpdateAll:
+		default:
+			return "", fmt.Errorf("found more than one image definition for %s", imageName)
+		}
+	}
+	// Finally, use the indexes from the matches to construct the new body, working backwards
+	for i := len(matches) - 1; i >= 0; i-- {
+		tagStart := matches[i][2]
+		tagEnd := matches[i][3]
+		kustomizeBody = kustomizeBody[0:tagStart] + newTag + kustomizeBody[tagEnd:]
 	}
-	// Finally, use the indexes from the match to construct the name body
-	match := matches[0]
-	tagStart := match[2]
-	tagEnd := match[3]
-	return kustomizeBody[0:tagStart] + newTag + kustomizeBody[tagEnd:], nil
+	return kustomizeBody, nil
 }
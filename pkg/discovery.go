@@ -0,0 +1,109 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/api/types"
+	"strings"
+)
+
+// discoverFiles expands a pattern, where "**" matches any number of directories, into the files which
+// reference at least one of the deployment's images
+// NB: Discovery runs against each fresh checkout, so new services are picked up without config changes
+func (t *FileTarget) discoverFiles(worktree *git.Worktree, pattern string) ([]string, error) {
+	matches, err := globRecursive(worktree.Filesystem, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var toRet []string
+	for _, match := range matches {
+		if ok, err := kustomizationReferences(worktree, match, t.images); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", match, err)
+		} else if ok {
+			toRet = append(toRet, match)
+		}
+	}
+
+	return toRet, nil
+}
+
+// globRecursive matches a pattern against every file under its fixed prefix, walking subdirectories
+// so that "**" can match any number of them
+func globRecursive(fs billy.Filesystem, pattern string) ([]string, error) {
+	root := globBase(pattern)
+	if root == "" {
+		root = "."
+	}
+	patternParts := strings.Split(path.Clean(pattern), "/")
+	var toRet []string
+	err := util.Walk(fs, root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The prefix doesn't exist, so nothing can match
+			if os.IsNotExist(err) && filePath == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchParts(patternParts, strings.Split(path.Clean(filePath), "/")) {
+			toRet = append(toRet, path.Clean(filePath))
+		}
+		return nil
+	})
+
+	return toRet, err
+}
+
+// matchParts matches a path against a pattern one element at a time, where "**" matches zero or more elements
+func matchParts(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+
+	return matchParts(pattern[1:], parts[1:])
+}
+
+// kustomizationReferences reports whether a kustomization file lists any of the images
+func kustomizationReferences(worktree *git.Worktree, filePath string, images []string) (bool, error) {
+	contents, err := readWorktreeFile(worktree, filePath)
+	if err != nil {
+		return false, err
+	}
+	var kustomization types.Kustomization
+	// Files which happen to match the pattern but aren't kustomizations are skipped rather than fatal
+	if err := yaml.Unmarshal(contents, &kustomization); err != nil {
+		return false, nil
+	}
+	for _, im := range kustomization.Images {
+		if matchImage(images, im.Name) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
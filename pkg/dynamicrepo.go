@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const dynamicRepositoryRetention = 3600
+
+// RepositoryTemplate allows payloads to name their own repository, as long as it matches an allowlist
+//
+// Deployments which use a template as their repository must be sent a repository_url, and may be
+// sent a repository_branch. Both are matched against the template's patterns with * wildcards.
+type RepositoryTemplate struct {
+	Name           string
+	urlPatterns    []string
+	branchPatterns []string
+	config         RepositoryConfig
+
+	mutex        sync.Mutex
+	repositories map[string]*dynamicRepository
+}
+
+// dynamicRepository is a repository created on demand from a template
+type dynamicRepository struct {
+	repository *Repository
+	lastUsed   time.Time
+}
+
+func NewRepositoryTemplate(cfg RepositoryTemplateConfig) (*RepositoryTemplate, error) {
+	if len(cfg.UrlPatterns) == 0 {
+		return nil, fmt.Errorf("repository template %s has no url_patterns", cfg.Name)
+	}
+	if _, err := parseTimeouts(cfg.Timeouts); err != nil {
+		return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+	}
+	if err := validateCloneOptions(cfg.CloneDepth, cfg.Submodules); err != nil {
+		return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+	}
+	if err := validateStorage(cfg.Storage, cfg.MaxSize); err != nil {
+		return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+	}
+	if credentials, err := newCredentialCommand(cfg.CredentialCommand, cfg.Username, cfg.Password, cfg.Token, cfg.TokenScheme, cfg.Headers); err != nil {
+		return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+	} else if credentials == nil {
+		if _, err := newRepositoryAuth(cfg.Username, cfg.Password, cfg.Token, cfg.TokenScheme, cfg.Headers); err != nil {
+			return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+		}
+	}
+	if _, err := newTransportOptions(cfg.ProxyUrl, cfg.CACert, cfg.CAFile, cfg.InsecureSkipVerify); err != nil {
+		return nil, fmt.Errorf("repository template %s: %w", cfg.Name, err)
+	}
+	branchPatterns := cfg.BranchPatterns
+	if len(branchPatterns) == 0 {
+		branchPatterns = []string{"*"}
+	}
+
+	return &RepositoryTemplate{
+		Name:           cfg.Name,
+		urlPatterns:    cfg.UrlPatterns,
+		branchPatterns: branchPatterns,
+		config: RepositoryConfig{
+			Username:           cfg.Username,
+			Password:           cfg.Password,
+			Token:              cfg.Token,
+			TokenScheme:        cfg.TokenScheme,
+			Headers:            cfg.Headers,
+			CredentialCommand:  cfg.CredentialCommand,
+			CloneDepth:         cfg.CloneDepth,
+			Submodules:         cfg.Submodules,
+			Storage:            cfg.Storage,
+			MaxSize:            cfg.MaxSize,
+			ProxyUrl:           cfg.ProxyUrl,
+			CACert:             cfg.CACert,
+			CAFile:             cfg.CAFile,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			CommitterName:      cfg.CommitterName,
+			CommitterEmail:     cfg.CommitterEmail,
+			Timeouts:           cfg.Timeouts,
+		},
+		repositories: make(map[string]*dynamicRepository),
+	}, nil
+}
+
+// Repository returns the repository for a URL and branch, creating it if this is the first use
+func (t *RepositoryTemplate) Repository(repoUrl string, branch string) (*Repository, error) {
+	if repoUrl == "" {
+		return nil, fmt.Errorf("%w: repository_url", missingFieldError)
+	}
+	if parsedUrl, err := url.Parse(repoUrl); err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+		return nil, fmt.Errorf("%w: repository_url", invalidFieldError)
+	}
+	if !matchImage(t.urlPatterns, repoUrl) {
+		return nil, fmt.Errorf("%w: repository_url", invalidFieldError)
+	}
+	// An empty branch means the remote's default, which is always allowed
+	if branch != "" && !matchImage(t.branchPatterns, branch) {
+		return nil, fmt.Errorf("%w: repository_branch", invalidFieldError)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	key := repoUrl + "#" + branch
+	// Take the opportunity to forget repositories that haven't been used for a while
+	for oldKey, oldRepo := range t.repositories {
+		if oldKey != key && now.Sub(oldRepo.lastUsed) > dynamicRepositoryRetention*time.Second {
+			delete(t.repositories, oldKey)
+		}
+	}
+	if existing, ok := t.repositories[key]; ok {
+		existing.lastUsed = now
+		return existing.repository, nil
+	}
+	cfg := t.config
+	cfg.Name = key
+	cfg.Url = repoUrl
+	cfg.Branch = branch
+	repository, err := NewRepository(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.repositories[key] = &dynamicRepository{repository: repository, lastUsed: now}
+
+	return repository, nil
+}
+
+// repositoryFor finds the repository that an update should be applied to, which may come from the payload
+func (s *WebhookServer) repositoryFor(deployment *Deployment, payload UpdateRequest) (*Repository, error) {
+	if template, ok := s.repositoryTemplates[deployment.RepositoryName]; ok {
+		return template.Repository(payload.RepositoryUrl, payload.RepositoryBranch)
+	}
+	// Only deployments using a template may choose their repository
+	if payload.RepositoryUrl != "" {
+		return nil, fmt.Errorf("%w: repository_url", unknownFieldError)
+	}
+	if payload.RepositoryBranch != "" {
+		return nil, fmt.Errorf("%w: repository_branch", unknownFieldError)
+	}
+	repo, ok := s.lookupRepository(deployment.RepositoryName)
+	if !ok {
+		return nil, errRepositoryNotFound
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultSMTPPort = "587"
+
+func validateEmail(serverUrl string, from string, to []string) error {
+	parsed, err := url.Parse(serverUrl)
+	if err != nil || parsed.Scheme != "smtp" || parsed.Hostname() == "" {
+		return fmt.Errorf("url must be an smtp:// URL")
+	}
+	if from == "" || len(to) == 0 {
+		return fmt.Errorf("from and to are required")
+	}
+
+	return nil
+}
+
+// sendEmail sends a plain text email through an SMTP server, upgrading to TLS if the server supports it
+// NB: Credentials are only sent once the connection is encrypted, or to localhost
+func sendEmail(serverUrl string, from string, to []string, subject string, body string) error {
+	server, err := url.Parse(serverUrl)
+	if err != nil {
+		return err
+	}
+	host := server.Hostname()
+	port := server.Port()
+	if port == "" {
+		port = defaultSMTPPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), notifyTimeout*time.Second)
+	if err != nil {
+		return fmt.Errorf("could not connect to %s: %w", host, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(notifyTimeout * time.Second))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("could not start TLS: %w", err)
+		}
+	}
+	if server.User != nil {
+		password, _ := server.User.Password()
+		if err := client.Auth(smtp.PlainAuth("", server.User.Username(), password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, strings.Join(to, ", "), subject, body)
+	if _, err := writer.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"strings"
+	"time"
+)
+
+const fluxDefaultNamespace = "flux-system"
+const fluxReconcileAnnotation = "reconcile.fluxcd.io/requestedAt"
+const fluxPollInterval = 2
+
+var errFluxFailed = errors.New("kustomization failed to apply")
+
+var (
+	fluxKustomizationResource = schema.GroupVersionResource{Group: "kustomize.toolkit.fluxcd.io", Version: "v1", Resource: "kustomizations"}
+	// fluxSourceResources maps the kinds that a Kustomization can reference to their resources
+	fluxSourceResources = map[string]schema.GroupVersionResource{
+		"GitRepository": {Group: "source.toolkit.fluxcd.io", Version: "v1", Resource: "gitrepositories"},
+		"OCIRepository": {Group: "source.toolkit.fluxcd.io", Version: "v1beta2", Resource: "ocirepositories"},
+		"Bucket":        {Group: "source.toolkit.fluxcd.io", Version: "v1beta2", Resource: "buckets"},
+	}
+)
+
+var fluxReconcileResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "flux",
+	Name:      "reconciles_total",
+	Help:      "The number of Flux reconciliations, by kustomization and result",
+}, []string{"kustomization", "result"})
+
+// fluxReconcile asks Flux to reconcile a deployment's Kustomization, in the same way as `flux reconcile`
+func (s *WebhookServer) fluxReconcile(job *Job, deployment *Deployment, payload UpdateRequest, revision string) {
+	kustomization := deployment.Flux.Namespace + "/" + deployment.Flux.Kustomization
+	job.SetStatus(StatusSyncing, revision, "")
+	ctx, cancel := context.WithTimeout(context.Background(), deployment.FluxTimeout)
+	defer cancel()
+	startTime := time.Now()
+
+	result, err := s.doFluxReconcile(ctx, deployment, revision)
+	logFields := requestLogFields(payload)
+	logFields["job_id"] = job.ID
+	logFields["kustomization"] = kustomization
+	logFields["revision"] = revision
+	logFields["sync_ms"] = time.Since(startTime).Milliseconds()
+	note := notification{
+		Payload: payload,
+		Fields:  map[string]string{"revision": revision, "kustomization": kustomization},
+	}
+	if err != nil {
+		result = StatusSyncFailed
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.WithFields(logFields).Warn("Timed out waiting for Flux reconciliation")
+			fluxReconcileResults.WithLabelValues(kustomization, "timeout").Inc()
+		} else {
+			log.WithError(err).WithFields(logFields).Warn("Flux reconciliation failed")
+			fluxReconcileResults.WithLabelValues(kustomization, StatusSyncFailed).Inc()
+		}
+		note.Event = EventSyncFailed
+		note.Message = fmt.Sprintf("Flux reconciliation of %s failed: %v", kustomization, err)
+		s.notify(deployment, note)
+		s.resolveJob(job, deployment, payload, result, revision, err.Error())
+		return
+	}
+	log.WithFields(logFields).Info("Flux reconciliation requested")
+	fluxReconcileResults.WithLabelValues(kustomization, result).Inc()
+	note.Event = EventSyncSucceeded
+	note.Message = fmt.Sprintf("Flux reconciliation of %s requested for %s", kustomization, payload.Tags())
+	if result == StatusHealthy {
+		note.Message = fmt.Sprintf("Flux kustomization %s is ready at %s", kustomization, payload.Tags())
+	}
+	s.notify(deployment, note)
+	s.resolveJob(job, deployment, payload, result, revision, "")
+}
+
+func (s *WebhookServer) doFluxReconcile(ctx context.Context, deployment *Deployment, revision string) (string, error) {
+	restConfig, err := kubernetesRestConfig(s.kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("could not load Kubernetes configuration: %w", err)
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return "", fmt.Errorf("could not create Kubernetes client: %w", err)
+	}
+	kustomizations := client.Resource(fluxKustomizationResource).Namespace(deployment.Flux.Namespace)
+	kustomization, err := kustomizations.Get(ctx, deployment.Flux.Kustomization, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not fetch kustomization: %w", err)
+	}
+
+	// The source has to pick up our commit before the kustomization can apply it
+	requestedAt := time.Now().Format(time.RFC3339Nano)
+	if deployment.Flux.WithSource {
+		kind, _, _ := unstructured.NestedString(kustomization.Object, "spec", "sourceRef", "kind")
+		name, _, _ := unstructured.NestedString(kustomization.Object, "spec", "sourceRef", "name")
+		namespace, _, _ := unstructured.NestedString(kustomization.Object, "spec", "sourceRef", "namespace")
+		if namespace == "" {
+			namespace = deployment.Flux.Namespace
+		}
+		sourceResource, ok := fluxSourceResources[kind]
+		if !ok {
+			return "", fmt.Errorf("unsupported source kind %q", kind)
+		}
+		if err := annotateForReconcile(ctx, client.Resource(sourceResource).Namespace(namespace), name, requestedAt); err != nil {
+			return "", fmt.Errorf("could not annotate source: %w", err)
+		}
+	}
+	if err := annotateForReconcile(ctx, kustomizations, deployment.Flux.Kustomization, requestedAt); err != nil {
+		return "", fmt.Errorf("could not annotate kustomization: %w", err)
+	}
+	if !deployment.Flux.Wait {
+		return StatusSynced, nil
+	}
+
+	// Poll until the kustomization has applied our revision, one way or the other
+	ticker := time.NewTicker(fluxPollInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			kustomization, err := kustomizations.Get(ctx, deployment.Flux.Kustomization, metav1.GetOptions{})
+			if err != nil {
+				log.WithError(err).WithField("kustomization", deployment.Flux.Kustomization).Debug("Could not fetch kustomization")
+				continue
+			}
+			if ready, err := fluxKustomizationReady(kustomization, revision); err != nil {
+				return "", err
+			} else if ready {
+				return StatusHealthy, nil
+			}
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// annotateForReconcile sets the annotation which Flux controllers watch for on-demand reconciliation
+func annotateForReconcile(ctx context.Context, client dynamic.ResourceInterface, name string, requestedAt string) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, fluxReconcileAnnotation, requestedAt)
+	_, err := client.Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+
+	return err
+}
+
+// fluxKustomizationReady reports whether a kustomization has successfully applied the revision,
+// or an error if it tried and failed
+// NB: Flux reports revisions as "branch@sha1:hash", or just the hash in older versions
+func fluxKustomizationReady(kustomization *unstructured.Unstructured, revision string) (bool, error) {
+	applied, _, _ := unstructured.NestedString(kustomization.Object, "status", "lastAppliedRevision")
+	attempted, _, _ := unstructured.NestedString(kustomization.Object, "status", "lastAttemptedRevision")
+	conditions, _, _ := unstructured.NestedSlice(kustomization.Object, "status", "conditions")
+	readyStatus, readyMessage := "", ""
+	for _, condition := range conditions {
+		conditionMap, ok := condition.(map[string]interface{})
+		if !ok || conditionMap["type"] != "Ready" {
+			continue
+		}
+		readyStatus, _ = conditionMap["status"].(string)
+		readyMessage, _ = conditionMap["message"].(string)
+	}
+
+	if strings.HasSuffix(applied, revision) && readyStatus == string(metav1.ConditionTrue) {
+		return true, nil
+	}
+	if strings.HasSuffix(attempted, revision) && readyStatus == string(metav1.ConditionFalse) {
+		return false, fmt.Errorf("%w: %s", errFluxFailed, readyMessage)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Actions for updates which arrive during a freeze
+const (
+	FreezeActionReject = "reject"
+	FreezeActionQueue  = "queue"
+)
+
+// FreezeWindow is a period during which a deployment must not change, either recurring on a
+// cron schedule or between two fixed times
+type FreezeWindow struct {
+	Name     string
+	schedule cron.Schedule
+	duration time.Duration
+	start    time.Time
+	end      time.Time
+}
+
+func NewFreezeWindow(cfg FreezeConfig) (*FreezeWindow, error) {
+	toRet := &FreezeWindow{Name: cfg.Name}
+	switch {
+	case cfg.Schedule != "" && (cfg.Start != "" || cfg.End != ""):
+		return nil, fmt.Errorf("freeze %s cannot have both a schedule and a start or end", cfg.Name)
+	case cfg.Schedule != "":
+		schedule, err := cron.ParseStandard(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze %s schedule: %w", cfg.Name, err)
+		}
+		duration, err := time.ParseDuration(cfg.Duration)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid freeze %s duration: %q", cfg.Name, cfg.Duration)
+		}
+		toRet.schedule = schedule
+		toRet.duration = duration
+	case cfg.Start != "" && cfg.End != "":
+		var err error
+		if toRet.start, err = time.Parse(time.RFC3339, cfg.Start); err != nil {
+			return nil, fmt.Errorf("invalid freeze %s start: %w", cfg.Name, err)
+		}
+		if toRet.end, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+			return nil, fmt.Errorf("invalid freeze %s end: %w", cfg.Name, err)
+		}
+		if !toRet.end.After(toRet.start) {
+			return nil, fmt.Errorf("freeze %s must end after it starts", cfg.Name)
+		}
+	default:
+		return nil, fmt.Errorf("freeze %s needs either a schedule and duration, or a start and end", cfg.Name)
+	}
+
+	return toRet, nil
+}
+
+// activeUntil reports whether the window covers the given time, and if so, when it ends
+func (f *FreezeWindow) activeUntil(t time.Time) (time.Time, bool) {
+	if f.schedule == nil {
+		return f.end, !t.Before(f.start) && t.Before(f.end)
+	}
+	// NB: Any occurrence which began within the last duration is still in effect
+	began := f.schedule.Next(t.Add(-f.duration))
+	if began.After(t) {
+		return time.Time{}, false
+	}
+
+	return began.Add(f.duration), true
+}
+
+// frozenUntil reports whether the deployment is frozen at the given time, and if so, when every
+// overlapping window will have ended
+func (d Deployment) frozenUntil(t time.Time) (time.Time, bool) {
+	frozen := false
+	until := t
+	for changed := true; changed; {
+		changed = false
+		for _, window := range d.Freezes {
+			if end, ok := window.activeUntil(until); ok && end.After(until) {
+				until, frozen, changed = end, true, true
+			}
+		}
+	}
+
+	return until, frozen
+}
+
+// frozenUpdate is an update waiting for its deployment's freeze to end
+type frozenUpdate struct {
+	job     *Job
+	payload UpdateRequest
+	timer   *time.Timer
+}
+
+// FreezeQueue holds the latest update for each frozen deployment until its freeze ends
+type FreezeQueue struct {
+	server  *WebhookServer
+	mutex   sync.Mutex
+	pending map[string]frozenUpdate
+}
+
+func NewFreezeQueue(server *WebhookServer) *FreezeQueue {
+	return &FreezeQueue{server: server, pending: make(map[string]frozenUpdate)}
+}
+
+// Enqueue schedules an update for when the freeze ends, superseding any already waiting
+func (q *FreezeQueue) Enqueue(job *Job, deployment *Deployment, payload UpdateRequest, until time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if superseded, ok := q.pending[deployment.Name]; ok {
+		superseded.timer.Stop()
+		q.server.resolveJob(superseded.job, deployment, superseded.payload, StatusUnchanged, "", fmt.Sprintf("Superseded by %s", payload.Tags()))
+	}
+	timer := time.AfterFunc(time.Until(until), func() {
+		q.release(job, deployment.Name)
+	})
+	q.pending[deployment.Name] = frozenUpdate{job: job, payload: payload, timer: timer}
+	job.SetStatus(StatusQueued, "", fmt.Sprintf("Frozen until %s", until.Format(time.RFC3339)))
+}
+
+// release runs a queued update once its freeze has ended
+func (q *FreezeQueue) release(job *Job, name string) {
+	q.mutex.Lock()
+	update, ok := q.pending[name]
+	if !ok || update.job != job {
+		q.mutex.Unlock()
+		return
+	}
+	delete(q.pending, name)
+	q.mutex.Unlock()
+
+	deployment, ok := q.server.lookupDeployment(name)
+	if !ok {
+		job.SetStatus(StatusFailed, "", "Deployment no longer exists")
+		return
+	}
+	logData := requestLogFields(update.payload)
+	logData["tag"], logData["job_id"] = update.payload.Tags(), job.ID
+	log.WithFields(logData).Info("Freeze ended, applying queued update")
+	ctx, cancel := context.WithTimeout(context.Background(), q.server.timeoutsFor(deployment, update.payload).Update)
+	defer cancel()
+	q.server.runApprovedUpdate(ctx, job, deployment, update.payload, logData)
+}
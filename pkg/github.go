@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const githubDefaultApiUrl = "https://api.github.com"
+const githubTimeout = 30
+
+// githubClient is a minimal client for the parts of the GitHub REST API that we use
+type githubClient struct {
+	apiUrl string
+	token  string
+}
+
+type githubPullRequest struct {
+	Number  int    `json:"number"`
+	HtmlUrl string `json:"html_url"`
+}
+
+func newGithubClient(apiUrl string, token string) *githubClient {
+	if apiUrl == "" {
+		apiUrl = githubDefaultApiUrl
+	}
+
+	return &githubClient{apiUrl: strings.TrimRight(apiUrl, "/"), token: token}
+}
+
+// githubRepository extracts the owner and name of a repository from its clone URL
+func githubRepository(repoUrl string) (string, string, error) {
+	parsedUrl, err := url.Parse(repoUrl)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository url: %w", err)
+	}
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(parsedUrl.Path, ".git"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("repository url %s does not name a GitHub repository", repoUrl)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// findOpenPullRequest returns the open pull request from the branch, or nil if there isn't one
+func (c *githubClient) findOpenPullRequest(ctx context.Context, owner string, repo string, branch string) (*githubPullRequest, error) {
+	query := url.Values{"state": {"open"}, "head": {owner + ":" + branch}}
+	var pulls []githubPullRequest
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/%s/pulls?%s", owner, repo, query.Encode()), nil, &pulls); err != nil {
+		return nil, err
+	}
+	if len(pulls) == 0 {
+		return nil, nil
+	}
+
+	return &pulls[0], nil
+}
+
+func (c *githubClient) createPullRequest(ctx context.Context, owner string, repo string, title string, head string, base string, body string) (*githubPullRequest, error) {
+	request := map[string]string{"title": title, "head": head, "base": base, "body": body}
+	var pull githubPullRequest
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/%s/pulls", owner, repo), request, &pull); err != nil {
+		return nil, err
+	}
+
+	return &pull, nil
+}
+
+func (c *githubClient) updatePullRequest(ctx context.Context, owner string, repo string, number int, body string) error {
+	request := map[string]string{"body": body}
+
+	return c.do(ctx, http.MethodPatch, fmt.Sprintf("/repos/%s/%s/pulls/%d", owner, repo, number), request, nil)
+}
+
+func (c *githubClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, githubTimeout*time.Second)
+	defer cancel()
+
+	return scmRequest(ctx, method, c.apiUrl+path, "Bearer "+c.token, body, out)
+}
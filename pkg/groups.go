@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// groupResponse lists the outcome of each deployment that a group or wildcard update fanned out to
+type groupResponse struct {
+	Message string                 `json:"message"`
+	Results map[string]groupResult `json:"results"`
+}
+
+// groupResult is a single deployment's response, along with the status it would have been sent with
+type groupResult struct {
+	Status int `json:"status"`
+	UpdateResponse
+}
+
+// GroupHandler updates every deployment in the group named by the URL path, as /groups/{name}
+type GroupHandler struct {
+	server *WebhookServer
+}
+
+func (h GroupHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	group := strings.Trim(strings.TrimPrefix(req.URL.Path, "/groups/"), "/")
+	if group == "" {
+		writeResponse(resp, newResponse(http.StatusNotFound, "Group not found"))
+		return
+	}
+	payloadBytes, rejection := readPayload(req, h.server.maxJSONDepth)
+	if rejection != nil {
+		writeResponse(resp, *rejection)
+		return
+	}
+	var payload UpdateRequest
+	if err := decodePayload(payloadBytes, &payload); err != nil {
+		log.WithError(err).WithField("request_id", RequestIDFromContext(req.Context())).Warn("Failed to decode payload")
+		writeResponse(resp, newResponse(http.StatusBadRequest, "Failed to decode payload"))
+		return
+	}
+	if payload.Group != "" && payload.Group != group {
+		writeResponse(resp, newResponse(http.StatusBadRequest, fmt.Sprintf("%v: group", invalidFieldError)))
+		return
+	}
+	payload.Group = group
+	payload.RequestID = RequestIDFromContext(req.Context())
+	h.server.fanOut(resp, payload)
+}
+
+// isFanOut reports whether a payload targets several deployments, by group or with a wildcard
+func (p UpdateRequest) isFanOut() bool {
+	return p.Group != "" || strings.Contains(p.Deployment, "*")
+}
+
+// fanOutTargets returns the names of the deployments in the payload's group whose names match its
+// deployment pattern, where either may be empty to match everything
+func (s *WebhookServer) fanOutTargets(payload UpdateRequest) []string {
+	var toRet []string
+	for _, deployment := range s.allDeployments() {
+		if payload.Group != "" && deployment.Group != payload.Group {
+			continue
+		}
+		if payload.Deployment != "" && !fnmatch(payload.Deployment, deployment.Name) {
+			continue
+		}
+		toRet = append(toRet, deployment.Name)
+	}
+	sort.Strings(toRet)
+
+	return toRet
+}
+
+// fanOut submits a copy of the payload for each deployment it targets, and responds with each of their
+// outcomes once they're all known or the webhook times out
+// NB: Fanned out updates aren't idempotent, as each deployment's update is tracked separately
+func (s *WebhookServer) fanOut(resp http.ResponseWriter, payload UpdateRequest) {
+	logData := requestLogFields(payload)
+	logData["group"] = payload.Group
+	targets := s.fanOutTargets(payload)
+	if len(targets) == 0 {
+		writeResponse(resp, newResponse(http.StatusNotFound, "No deployments matched"))
+		return
+	}
+	_ = http.NewResponseController(resp).SetWriteDeadline(time.Now().Add(s.timeouts.Webhook + time.Second))
+	timer := time.NewTimer(s.timeouts.Webhook)
+	defer timer.Stop()
+
+	jobs := make(map[string]*Job, len(targets))
+	pending := make(map[string]<-chan UpdateResponse, len(targets))
+	for _, name := range targets {
+		request := payload
+		request.Deployment = name
+		jobs[name], pending[name] = s.Submit("webhook", request)
+	}
+	results := make(map[string]groupResult, len(targets))
+	timedOut := false
+	for _, name := range targets {
+		var result UpdateResponse
+		if timedOut {
+			select {
+			case result = <-pending[name]:
+			default:
+			}
+		} else {
+			select {
+			case result = <-pending[name]:
+			case <-timer.C:
+				timedOut = true
+			}
+		}
+		// Anything still running carries on in the background, like a single update would
+		if result.Code == 0 {
+			result = newResponse(http.StatusAccepted, "Update is still in progress")
+			result.JobId = jobs[name].ID
+		}
+		results[name] = groupResult{Status: result.Code, UpdateResponse: result}
+	}
+
+	// Every deployment sharing an outcome gets that status, otherwise it's up to the caller to check each
+	status := results[targets[0]].Status
+	succeeded := 0
+	for _, result := range results {
+		if result.Status != status {
+			status = http.StatusMultiStatus
+		}
+		if result.Status < 300 {
+			succeeded++
+		}
+	}
+	log.WithFields(logData).Infof("Update fanned out to %d deployment(s), of which %d succeeded", len(targets), succeeded)
+	writeJSON(resp, status, groupResponse{
+		Message: fmt.Sprintf("Updated %d of %d deployment(s)", succeeded, len(targets)),
+		Results: results,
+	})
+}
@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/predakanga/image-updater/pkg/api"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"net/http"
+)
+
+// GRPCServer exposes the same operations as the webhook over gRPC
+type GRPCServer struct {
+	api.UnimplementedImageUpdaterServer
+	server *WebhookServer
+}
+
+// newGRPCServer creates a gRPC server protected by the same secret key and allowed IPs as the webhook
+func newGRPCServer(server *WebhookServer, secretKey string, allowed []*net.IPNet) *grpc.Server {
+	toRet := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if len(allowed) > 0 {
+			remote, ok := peer.FromContext(ctx)
+			if !ok {
+				return nil, status.Error(codes.PermissionDenied, "Forbidden")
+			}
+			host, _, err := net.SplitHostPort(remote.Addr.String())
+			if err != nil || !ipAllowed(net.ParseIP(host), allowed) {
+				return nil, status.Error(codes.PermissionDenied, "Forbidden")
+			}
+		}
+		if secretKey != "" {
+			md, _ := metadata.FromIncomingContext(ctx)
+			keys := md.Get("x-key")
+			if len(keys) != 1 || subtle.ConstantTimeCompare([]byte(keys[0]), []byte(secretKey)) != 1 {
+				return nil, status.Error(codes.PermissionDenied, "Forbidden")
+			}
+		}
+
+		return handler(ctx, req)
+	}))
+	api.RegisterImageUpdaterServer(toRet, &GRPCServer{server: server})
+
+	return toRet
+}
+
+func ipAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grpcRejection converts a rejected payload into the equivalent gRPC status
+func grpcRejection(resp UpdateResponse) error {
+	code := codes.Internal
+	switch resp.Code {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		code = codes.Unavailable
+	case http.StatusGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+
+	return status.Error(code, resp.Message)
+}
+
+func updateResponse(resp UpdateResponse) *api.UpdateResponse {
+	return &api.UpdateResponse{
+		Code:     int32(resp.Code),
+		Message:  resp.Message,
+		JobId:    resp.JobId,
+		Revision: resp.Revision,
+	}
+}
+
+func (g *GRPCServer) Update(ctx context.Context, req *api.UpdateRequest) (*api.UpdateResponse, error) {
+	payload := UpdateRequest{
+		Deployment:       req.Deployment,
+		TagName:          req.TagName,
+		AuthorizedBy:     req.AuthorizedBy,
+		CallbackUrl:      req.CallbackUrl,
+		RepositoryUrl:    req.RepositoryUrl,
+		RepositoryBranch: req.RepositoryBranch,
+	}
+	if len(req.Extra) > 0 {
+		payload.Extra = req.Extra
+	}
+	if len(req.Images) > 0 {
+		payload.Images = req.Images
+	}
+	job, done := g.server.Submit("grpc", payload)
+	if job == nil {
+		return nil, grpcRejection(<-done)
+	}
+	result, err := awaitResponse(ctx, job, done)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+
+	return updateResponse(result), nil
+}
+
+func (g *GRPCServer) Rollback(ctx context.Context, req *api.RollbackRequest) (*api.UpdateResponse, error) {
+	if req.Deployment == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing field: deployment")
+	}
+	if req.AuthorizedBy == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing field: authorized_by")
+	}
+	deployment, ok := g.server.lookupDeployment(req.Deployment)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Deployment not found")
+	}
+	logData := log.Fields{"deployment": req.Deployment, "authorized_by": req.AuthorizedBy, "api": "grpc"}
+	resp := g.server.rollbackLatest(ctx, deployment, req.AuthorizedBy, logData)
+	if resp.Code == http.StatusConflict {
+		return nil, grpcRejection(resp)
+	}
+
+	return updateResponse(resp), nil
+}
+
+func (g *GRPCServer) GetJob(_ context.Context, req *api.GetJobRequest) (*api.Job, error) {
+	job, ok := g.server.jobs.Get(req.Id)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "Job not found")
+	}
+	state := job.State()
+
+	return &api.Job{
+		Id:           state.ID,
+		Deployment:   state.Deployment,
+		TagName:      state.TagName,
+		AuthorizedBy: state.AuthorizedBy,
+		Status:       state.Status,
+		Revision:     state.Revision,
+		Message:      state.Message,
+		CreatedAt:    timestamppb.New(state.CreatedAt),
+		UpdatedAt:    timestamppb.New(state.UpdatedAt),
+	}, nil
+}
+
+func (g *GRPCServer) ListDeployments(_ context.Context, _ *api.ListDeploymentsRequest) (*api.ListDeploymentsResponse, error) {
+	toRet := &api.ListDeploymentsResponse{}
+	for _, deployment := range g.server.allDeployments() {
+		toRet.Deployments = append(toRet.Deployments, &api.Deployment{
+			Name:       deployment.Name,
+			Repository: deployment.RepositoryName,
+			Images:     deployment.Images,
+			ArgocdApp:  deployment.ApplicationName,
+		})
+	}
+
+	return toRet, nil
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// healthDetails describes the configuration a replica is running, so that drift between replicas can be spotted
+type healthDetails struct {
+	Status               string    `json:"status"`
+	Version              string    `json:"version"`
+	Commit               string    `json:"commit"`
+	ConfigChecksum       string    `json:"config_checksum"`
+	RepositoriesChecksum string    `json:"repositories_checksum"`
+	DeploymentsChecksum  string    `json:"deployments_checksum"`
+	LoadedAt             time.Time `json:"loaded_at"`
+	Repositories         int       `json:"repositories"`
+	Deployments          int       `json:"deployments"`
+	ResourceRepositories int       `json:"resource_repositories"`
+	ResourceDeployments  int       `json:"resource_deployments"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// configChecksum hashes a config section's canonical JSON form
+func configChecksum(section interface{}) string {
+	encoded, err := json.Marshal(section)
+	if err != nil {
+		return ""
+	}
+
+	return checksum(encoded)
+}
+
+// HealthDetailsHandler reports the checksums of the loaded configuration, along with how much of it is in use
+type HealthDetailsHandler struct {
+	server  *WebhookServer
+	details healthDetails
+}
+
+func NewHealthDetailsHandler(cfg Config, server *WebhookServer) HealthDetailsHandler {
+	return HealthDetailsHandler{
+		server: server,
+		details: healthDetails{
+			Status:               "OK",
+			Version:              Version,
+			Commit:               Commit,
+			ConfigChecksum:       cfg.Checksum,
+			RepositoriesChecksum: configChecksum(cfg.Repositories),
+			DeploymentsChecksum:  configChecksum(cfg.Deployments),
+			LoadedAt:             cfg.LoadedAt,
+		},
+	}
+}
+
+func (h HealthDetailsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	details := h.details
+	details.Repositories = len(h.server.repositories)
+	details.Deployments = len(h.server.deployments)
+	h.server.resourceMutex.RLock()
+	details.ResourceRepositories = len(h.server.resourceRepositories)
+	details.ResourceDeployments = len(h.server.resourceDeployments)
+	h.server.resourceMutex.RUnlock()
+
+	writeJSON(resp, http.StatusOK, details)
+}
@@ -0,0 +1,377 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/go-git/go-git/v5"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Fields of Chart.yaml which a chart can bump
+var chartFields = []string{"version", "appVersion"}
+
+// HelmChart bumps a chart's own version fields, and optionally the versions of its dependencies
+// in both Chart.yaml and Chart.lock, for teams which release by incrementing chart versions
+type HelmChart struct {
+	Path         string
+	Image        string
+	fields       []string
+	dependencies []string
+}
+
+// chartDependency mirrors Helm's chart.Dependency, so that Chart.lock digests can be recomputed
+// NB: Field order and tags must match Helm's, as the digest is taken over the JSON encoding
+type chartDependency struct {
+	Name         string        `json:"name" yaml:"name"`
+	Version      string        `json:"version,omitempty" yaml:"version,omitempty"`
+	Repository   string        `json:"repository" yaml:"repository"`
+	Condition    string        `json:"condition,omitempty" yaml:"condition,omitempty"`
+	Tags         []string      `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Enabled      bool          `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	ImportValues []interface{} `json:"import-values,omitempty" yaml:"import-values,omitempty"`
+	Alias        string        `json:"alias,omitempty" yaml:"alias,omitempty"`
+}
+
+func NewHelmChart(cfg HelmChartConfig, defaultImage string) (*HelmChart, error) {
+	toRet := &HelmChart{
+		Path:         cfg.Path,
+		Image:        cfg.Image,
+		fields:       cfg.Fields,
+		dependencies: cfg.Dependencies,
+	}
+	if toRet.Image == "" {
+		toRet.Image = defaultImage
+	}
+	if toRet.Image == "" || strings.ContainsRune(toRet.Image, '*') {
+		return nil, fmt.Errorf("helm_chart %s must name a single image", cfg.Path)
+	}
+	if len(toRet.fields) == 0 && len(toRet.dependencies) == 0 {
+		toRet.fields = []string{"version"}
+	}
+	for _, field := range toRet.fields {
+		if !contains(chartFields, field) {
+			return nil, fmt.Errorf("invalid helm_chart %s field: %s", cfg.Path, field)
+		}
+	}
+
+	return toRet, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Paths lists the files within the repository that the chart bump modifies
+func (c *HelmChart) Paths() []string {
+	return []string{path.Join(c.Path, "Chart.yaml"), path.Join(c.Path, "Chart.lock")}
+}
+
+func (c *HelmChart) Apply(worktree *git.Worktree, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	foundVersions, changed, err := c.apply(worktree, newTag)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to bump chart %s: %w", c.Path, err)
+	}
+
+	return foundVersions, changed, nil
+}
+
+func (c *HelmChart) Validate(worktree *git.Worktree, _ string) error {
+	for _, chartPath := range c.Paths() {
+		// NB: Charts don't necessarily have a lock file
+		if err := validateYAML(worktree, chartPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s is invalid: %w", chartPath, err)
+		}
+	}
+
+	return nil
+}
+
+// apply bumps the chart, returning the version it had and whether any file changed
+func (c *HelmChart) apply(worktree *git.Worktree, newTag tagSelector) (imageTags, bool, error) {
+	chartPath := path.Join(c.Path, "Chart.yaml")
+	chartBytes, err := readWorktreeFile(worktree, chartPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read Chart.yaml: %w", err)
+	}
+	var chart yaml.Node
+	if err := yaml.Unmarshal(chartBytes, &chart); err != nil {
+		return nil, false, fmt.Errorf("failed to decode Chart.yaml: %w", err)
+	}
+	if len(chart.Content) == 0 {
+		return nil, false, fmt.Errorf("Chart.yaml is empty")
+	}
+	root := chart.Content[0]
+
+	tag, ok := newTag(c.Image)
+	// Only one previous version can be reported, so prefer the chart's own
+	oldVersion := ""
+	var replacements []imageReplacement
+	for _, field := range c.fields {
+		value := mappingValue(root, field)
+		if value == nil {
+			return nil, false, fmt.Errorf("Chart.yaml has no %s", field)
+		}
+		if oldVersion == "" {
+			oldVersion = value.Value
+		}
+		replacements = append(replacements, imageReplacement{line: value.Line, column: value.Column, old: value.Value, new: tag})
+	}
+	depReplacements, depVersion, err := c.dependencyReplacements(mappingNode(root, "dependencies"), tag)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update Chart.yaml: %w", err)
+	}
+	if oldVersion == "" {
+		oldVersion = depVersion
+	}
+	foundImages := imageTags{c.Image: oldVersion}
+	if !ok {
+		return foundImages, false, nil
+	}
+
+	chartString, chartChanged, err := applyReplacements(string(chartBytes), append(replacements, depReplacements...))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update Chart.yaml: %w", err)
+	}
+	if !chartChanged {
+		return foundImages, false, nil
+	}
+	if err := writeWorktreeFile(worktree, chartPath, []byte(chartString)); err != nil {
+		return nil, false, fmt.Errorf("failed to write Chart.yaml: %w", err)
+	}
+	if len(depReplacements) > 0 {
+		if err := c.updateLock(worktree, []byte(chartString), tag); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return foundImages, true, nil
+}
+
+// dependencyReplacements finds the version of each bumped dependency in a dependencies list
+func (c *HelmChart) dependencyReplacements(dependencies *yaml.Node, tag string) ([]imageReplacement, string, error) {
+	var toRet []imageReplacement
+	oldVersion := ""
+	for _, name := range c.dependencies {
+		found := false
+		if dependencies != nil && dependencies.Kind == yaml.SequenceNode {
+			for _, dependency := range dependencies.Content {
+				depName := mappingValue(dependency, "name")
+				version := mappingValue(dependency, "version")
+				if depName == nil || depName.Value != name || version == nil {
+					continue
+				}
+				found = true
+				if oldVersion == "" {
+					oldVersion = version.Value
+				}
+				toRet = append(toRet, imageReplacement{line: version.Line, column: version.Column, old: version.Value, new: tag})
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("dependency %s not found", name)
+		}
+	}
+
+	return toRet, oldVersion, nil
+}
+
+// updateLock bumps the dependencies in Chart.lock, if there is one, and recomputes its digest as
+// Helm does, so that `helm dependency build` still accepts it
+// NB: Helm resolves repository aliases before hashing, so charts using @alias repositories will
+// still need `helm dependency update`
+func (c *HelmChart) updateLock(worktree *git.Worktree, chartBytes []byte, tag string) error {
+	lockPath := path.Join(c.Path, "Chart.lock")
+	lockBytes, err := readWorktreeFile(worktree, lockPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read Chart.lock: %w", err)
+	}
+	var lock yaml.Node
+	if err := yaml.Unmarshal(lockBytes, &lock); err != nil {
+		return fmt.Errorf("failed to decode Chart.lock: %w", err)
+	}
+	if len(lock.Content) == 0 {
+		return fmt.Errorf("Chart.lock is empty")
+	}
+	replacements, _, err := c.dependencyReplacements(mappingNode(lock.Content[0], "dependencies"), tag)
+	if err != nil {
+		return fmt.Errorf("failed to update Chart.lock: %w", err)
+	}
+	lockString, _, err := applyReplacements(string(lockBytes), replacements)
+	if err != nil {
+		return fmt.Errorf("failed to update Chart.lock: %w", err)
+	}
+
+	// Now that both files have their new versions, the digest covers them together
+	var chartDeps, lockDeps struct {
+		Dependencies []*chartDependency `yaml:"dependencies"`
+	}
+	if err := yaml.Unmarshal(chartBytes, &chartDeps); err != nil {
+		return fmt.Errorf("failed to decode Chart.yaml: %w", err)
+	}
+	if err := yaml.Unmarshal([]byte(lockString), &lockDeps); err != nil {
+		return fmt.Errorf("failed to decode Chart.lock: %w", err)
+	}
+	digest, err := chartLockDigest(chartDeps.Dependencies, lockDeps.Dependencies)
+	if err != nil {
+		return err
+	}
+	var newLock yaml.Node
+	if err := yaml.Unmarshal([]byte(lockString), &newLock); err != nil {
+		return fmt.Errorf("failed to decode Chart.lock: %w", err)
+	}
+	root := newLock.Content[0]
+	replacements = nil
+	if value := mappingValue(root, "digest"); value != nil {
+		replacements = append(replacements, imageReplacement{line: value.Line, column: value.Column, old: value.Value, new: digest})
+	}
+	if value := mappingValue(root, "generated"); value != nil {
+		replacements = append(replacements, imageReplacement{line: value.Line, column: value.Column, old: value.Value, new: time.Now().Format(time.RFC3339Nano)})
+	}
+	if lockString, _, err = applyReplacements(lockString, replacements); err != nil {
+		return fmt.Errorf("failed to update Chart.lock: %w", err)
+	}
+
+	if err := writeWorktreeFile(worktree, lockPath, []byte(lockString)); err != nil {
+		return fmt.Errorf("failed to write Chart.lock: %w", err)
+	}
+
+	return nil
+}
+
+// chartLockDigest hashes requested and locked dependencies the same way as Helm's resolver.HashReq
+func chartLockDigest(requested []*chartDependency, locked []*chartDependency) (string, error) {
+	data, err := json.Marshal([2][]*chartDependency{requested, locked})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode dependencies: %w", err)
+	}
+	sum := sha256.Sum256(data)
+
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// helmValuesFormat replaces the tags in Helm values files, within the image blocks that charts
+// conventionally use:
+//
+//	image:
+//	  registry: docker.io
+//	  repository: org/app
+//	  tag: "1.2.3"
+type helmValuesFormat struct {
+	images []string
+}
+
+func (f helmValuesFormat) update(worktree *git.Worktree, valuesPath string, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	valuesBytes, err := readWorktreeFile(worktree, valuesPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read values file: %w", err)
+	}
+	var values yaml.Node
+	if err := yaml.Unmarshal(valuesBytes, &values); err != nil {
+		return nil, false, fmt.Errorf("failed to decode values file: %w", err)
+	}
+
+	// Image blocks can be nested anywhere, such as under each subchart's values
+	foundImages := make(imageTags)
+	var replacements []imageReplacement
+	var walk func(node *yaml.Node) error
+	walk = func(node *yaml.Node) error {
+		if node.Kind == yaml.MappingNode {
+			replacement, err := f.imageReplacement(node, foundImages, newTag)
+			if err != nil {
+				return err
+			}
+			if replacement != nil {
+				replacements = append(replacements, *replacement)
+			}
+		}
+		for _, child := range node.Content {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(&values); err != nil {
+		return nil, false, err
+	}
+
+	valuesString, changeMade, err := applyReplacements(string(valuesBytes), replacements)
+	if err != nil {
+		return nil, false, err
+	}
+	if !changeMade {
+		return foundImages, false, nil
+	}
+	if err := writeWorktreeFile(worktree, valuesPath, []byte(valuesString)); err != nil {
+		return nil, false, fmt.Errorf("failed to write values file: %w", err)
+	}
+
+	return foundImages, true, nil
+}
+
+// imageReplacement returns the replacement for a mapping's tag, if it's an image block for one of our images
+func (f helmValuesFormat) imageReplacement(node *yaml.Node, foundImages imageTags, newTag tagSelector) (*imageReplacement, error) {
+	repository := mappingValue(node, "repository")
+	tagNode := mappingValue(node, "tag")
+	if repository == nil || tagNode == nil {
+		return nil, nil
+	}
+	// The registry may or may not be part of the configured image name
+	name := repository.Value
+	if registry := mappingValue(node, "registry"); registry != nil && registry.Value != "" && !matchImage(f.images, name) {
+		name = registry.Value + "/" + name
+	}
+	if !matchImage(f.images, name) {
+		return nil, nil
+	}
+	foundImages.merge(imageTags{name: tagNode.Value})
+	tag, ok := newTag(name)
+	if !ok {
+		return nil, nil
+	}
+
+	toRet := &imageReplacement{line: tagNode.Line, column: tagNode.Column, old: tagNode.Value, new: tag}
+	quoted := tagNode.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0
+	switch {
+	case quoted:
+		// Skip the opening quote, so that empty tags are replaced inside the quotes
+		toRet.column++
+	case tagNode.Value == "":
+		return nil, fmt.Errorf("image %s has no tag to replace", name)
+	case !isYAMLString(tag):
+		// Tags such as 1.10 would otherwise be read back as numbers
+		toRet.new = fmt.Sprintf("%q", tag)
+	}
+
+	return toRet, nil
+}
+
+// isYAMLString checks whether a plain scalar would be decoded as a string
+func isYAMLString(value string) bool {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &node); err != nil || len(node.Content) == 0 {
+		return false
+	}
+
+	return node.Content[0].Kind == yaml.ScalarNode && node.Content[0].Tag == "!!str"
+}
+
+func (f helmValuesFormat) validate(worktree *git.Worktree, files []string, _ string) error {
+	return validateYAMLFiles(worktree, files)
+}
@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyWindow is how long a delivery is remembered, unless configured otherwise
+const defaultIdempotencyWindow = 3600
+
+// Deliveries are identified by an explicit key, or by the ID that GitHub gives each of its webhook deliveries
+var idempotencyHeaders = []string{"Idempotency-Key", "X-GitHub-Delivery"}
+
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// idempotencyStore remembers recent deliveries, so that retried webhooks return the original
+// result rather than making a second commit
+type idempotencyStore struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	entries map[string]*idempotentDelivery
+	// persist is told each delivery's outcome, if the state is saved to a backend
+	persist func(key string, delivery persistedDelivery)
+}
+
+// idempotentDelivery is the outcome of the first delivery with a key
+// NB: The job ID can be read once started is closed, and the response once done is closed
+type idempotentDelivery struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	started     chan struct{}
+	jobID       string
+	done        chan struct{}
+	response    UpdateResponse
+
+	key   string
+	store *idempotencyStore
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{window: window, entries: make(map[string]*idempotentDelivery)}
+}
+
+// idempotencyKey returns the key identifying a delivery, if the caller sent one
+func idempotencyKey(req *http.Request) string {
+	for _, header := range idempotencyHeaders {
+		if key := req.Header.Get(header); key != "" {
+			return header + ":" + key
+		}
+	}
+
+	return ""
+}
+
+// claim records the first delivery with a key, or returns the existing delivery if this is a repeat
+// NB: The first delivery must be submitted and tracked straight afterwards
+func (s *idempotencyStore) claim(key string, body []byte) (*idempotentDelivery, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	// Take the opportunity to forget deliveries that have aged out
+	for oldKey, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, oldKey)
+		}
+	}
+	if existing, ok := s.entries[key]; ok {
+		return existing, true
+	}
+	toRet := &idempotentDelivery{
+		fingerprint: sha256.Sum256(body),
+		expires:     now.Add(s.window),
+		started:     make(chan struct{}),
+		done:        make(chan struct{}),
+		key:         key,
+		store:       s,
+	}
+	s.entries[key] = toRet
+
+	return toRet, false
+}
+
+// track records the outcome of the delivery's update, passing it through to the returned channel
+func (d *idempotentDelivery) track(job *Job, done <-chan UpdateResponse) <-chan UpdateResponse {
+	d.jobID = job.ID
+	close(d.started)
+	toRet := make(chan UpdateResponse, 1)
+	go func() {
+		result := <-done
+		d.response = result
+		close(d.done)
+		// Failures which may succeed later are forgotten, so that the sender's retry is processed again
+		if result.Retryable || result.Code >= http.StatusInternalServerError {
+			d.store.forget(d.key, d)
+		} else if d.store.persist != nil {
+			d.store.persist(d.key, persistedDelivery{
+				Fingerprint: hex.EncodeToString(d.fingerprint[:]),
+				Expires:     d.expires,
+				JobID:       d.jobID,
+				Code:        result.Code,
+				Response:    result,
+			})
+		}
+		toRet <- result
+	}()
+
+	return toRet
+}
+
+// forget drops a delivery, unless its key has already been claimed again
+func (s *idempotencyStore) forget(key string, delivery *idempotentDelivery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.entries[key] == delivery {
+		delete(s.entries, key)
+	}
+}
+
+// restore adds deliveries saved before a restart or by another replica, unless they're already known
+// NB: Only finished deliveries are saved, so they can be replayed straight away
+func (s *idempotencyStore) restore(deliveries map[string]persistedDelivery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for key, saved := range deliveries {
+		if _, ok := s.entries[key]; ok || now.After(saved.Expires) {
+			continue
+		}
+		if saved.Response.Retryable || saved.Code >= http.StatusInternalServerError {
+			continue
+		}
+		delivery := &idempotentDelivery{
+			expires:  saved.Expires,
+			started:  make(chan struct{}),
+			jobID:    saved.JobID,
+			done:     make(chan struct{}),
+			response: saved.Response,
+			key:      key,
+		}
+		if _, err := hex.Decode(delivery.fingerprint[:], []byte(saved.Fingerprint)); err != nil {
+			continue
+		}
+		delivery.response.Code = saved.Code
+		close(delivery.started)
+		close(delivery.done)
+		s.entries[key] = delivery
+	}
+}
+
+// matches reports whether a repeated delivery carried the same body as the first
+func (d *idempotentDelivery) matches(body []byte) bool {
+	return d.fingerprint == sha256.Sum256(body)
+}
@@ -0,0 +1,30 @@
+package pkg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deploymentInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "image_updater",
+	Subsystem: "deployment",
+	Name:      "info",
+	Help:      "The tag each deployment's images are set to, as of the last update or reconcile check",
+}, []string{"deployment", "repository", "image", "tag"})
+
+// publishDeployedTags replaces a deployment's info series with its current tags
+// NB: Deployments which haven't been updated or checked since the server started have no series
+func publishDeployedTags(deployment *Deployment, images map[string]string) {
+	if len(images) == 0 {
+		return
+	}
+	forgetDeployedTags(deployment.Name)
+	for image, tag := range images {
+		deploymentInfo.WithLabelValues(deployment.Name, deployment.RepositoryName, image, tag).Set(1)
+	}
+}
+
+// forgetDeployedTags removes a deployment's info series, such as when it is removed
+func forgetDeployedTags(name string) {
+	deploymentInfo.DeletePartialMatch(prometheus.Labels{"deployment": name})
+}
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobRetention = 3600
+
+// Statuses that a job moves through, which are also reported to callbacks
+const (
+	StatusRunning    = "running"
+	StatusQueued     = "queued"
+	StatusPending    = "pending_approval"
+	StatusRejected   = "rejected"
+	StatusExpired    = "expired"
+	StatusUpdated    = "updated"
+	StatusUnchanged  = "unchanged"
+	StatusFailed     = "failed"
+	StatusSyncing    = "syncing"
+	StatusSynced     = "synced"
+	StatusSyncFailed = "sync_failed"
+	StatusHealthy    = "healthy"
+	StatusDegraded   = "degraded"
+)
+
+// activeStatus reports whether a job with the status is still waiting or working towards an outcome
+func activeStatus(status string) bool {
+	switch status {
+	case StatusRunning, StatusQueued, StatusPending, StatusSyncing:
+		return true
+	}
+
+	return false
+}
+
+// JobState is the externally visible state of a job
+type JobState struct {
+	ID           string            `json:"id"`
+	Deployment   string            `json:"deployment"`
+	TagName      string            `json:"tag_name"`
+	AuthorizedBy string            `json:"authorized_by"`
+	Images       map[string]string `json:"images,omitempty"`
+	RequestID    string            `json:"request_id,omitempty"`
+	Status       string            `json:"status"`
+	Revision     string            `json:"revision,omitempty"`
+	Message      string            `json:"message,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// Job tracks the progress of a single update, including any background ArgoCD sync
+type Job struct {
+	ID    string
+	mutex sync.Mutex
+	state JobState
+}
+
+// SetStatus records the job's latest status
+func (j *Job) SetStatus(status string, revision string, message string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.state.Status = status
+	if revision != "" {
+		j.state.Revision = revision
+	}
+	j.state.Message = message
+	j.state.UpdatedAt = time.Now()
+}
+
+// State returns a copy of the job's current state
+func (j *Job) State() JobState {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.state
+}
+
+// JobStore keeps recent jobs in memory so that their status can be queried
+type JobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+func NewJobStore() *JobStore {
+	return &JobStore{jobs: make(map[string]*Job)}
+}
+
+// Create registers a new running job for the payload
+func (js *JobStore) Create(payload UpdateRequest) *Job {
+	idBytes := make([]byte, 16)
+	_, _ = rand.Read(idBytes)
+	now := time.Now()
+	id := hex.EncodeToString(idBytes)
+	job := &Job{
+		ID: id,
+		state: JobState{
+			ID:           id,
+			Deployment:   payload.Deployment,
+			TagName:      payload.Tags(),
+			AuthorizedBy: payload.AuthorizedBy,
+			Images:       payload.Images,
+			RequestID:    payload.RequestID,
+			Status:       StatusRunning,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		},
+	}
+
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	// Take the opportunity to clear out old jobs, but only once they've finished
+	for id, oldJob := range js.jobs {
+		oldState := oldJob.State()
+		if !activeStatus(oldState.Status) && now.Sub(oldState.UpdatedAt) > jobRetention*time.Second {
+			delete(js.jobs, id)
+		}
+	}
+	js.jobs[job.ID] = job
+
+	return job
+}
+
+// Restore registers a job which was started before a restart or by another replica, keeping its ID
+func (js *JobStore) Restore(id string, payload UpdateRequest, status string, message string, createdAt time.Time) *Job {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	if existing, ok := js.jobs[id]; ok {
+		return existing
+	}
+	job := &Job{
+		ID: id,
+		state: JobState{
+			ID:           id,
+			Deployment:   payload.Deployment,
+			TagName:      payload.Tags(),
+			AuthorizedBy: payload.AuthorizedBy,
+			Images:       payload.Images,
+			RequestID:    payload.RequestID,
+			Status:       status,
+			Message:      message,
+			CreatedAt:    createdAt,
+			UpdatedAt:    time.Now(),
+		},
+	}
+	js.jobs[id] = job
+
+	return job
+}
+
+func (js *JobStore) Get(id string) (*Job, bool) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	job, ok := js.jobs[id]
+
+	return job, ok
+}
+
+// Latest returns the most recently created job which matches the filter
+func (js *JobStore) Latest(filter func(JobState) bool) (*Job, bool) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	var toRet *Job
+	var toRetState JobState
+	for _, job := range js.jobs {
+		state := job.State()
+		if filter(state) && (toRet == nil || state.CreatedAt.After(toRetState.CreatedAt)) {
+			toRet, toRetState = job, state
+		}
+	}
+
+	return toRet, toRet != nil
+}
+
+// ServeHTTP reports the status of the job named in the URL path
+func (js *JobStore) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	job, ok := js.Get(strings.TrimPrefix(req.URL.Path, "/jobs/"))
+	if !ok {
+		writeResponse(resp, newResponse(http.StatusNotFound, "Job not found"))
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, job.State())
+}
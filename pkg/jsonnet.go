@@ -0,0 +1,232 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+func NewJsonnetReplacement(cfg JsonnetConfig, defaultImage string) (*Replacement, error) {
+	toRet, err := newReplacement(cfg.Path, cfg.Image, defaultImage)
+	if err != nil {
+		return nil, err
+	}
+	keyPath := strings.Split(cfg.KeyPath, ".")
+	for _, key := range keyPath {
+		if key == "" {
+			return nil, fmt.Errorf("invalid jsonnet %s key_path: %q", cfg.Path, cfg.KeyPath)
+		}
+	}
+	toRet.locate = func(contents []byte) (int, int, error) {
+		return findJsonnetString(contents, keyPath)
+	}
+	toRet.quoted = true
+
+	return toRet, nil
+}
+
+// jsonnetToken is a single lexical token, of which we only care about punctuation, names and strings
+type jsonnetToken struct {
+	kind  byte // One of 'i' (identifier), 's' (string), or the punctuation character itself
+	value string
+	start int
+	end   int
+}
+
+// jsonnetFrame is an open bracket, and for objects, the field whose value we're currently in
+type jsonnetFrame struct {
+	object  bool
+	path    []string
+	key     string
+	inValue bool
+}
+
+// findJsonnetString returns the byte range of the contents of the string literal at the key path
+//
+// NB: This is not a full Jsonnet parser; it tracks object fields (including hidden and +: fields)
+// through nested object literals, which covers the parameter files Tanka environments use.
+// Fields whose value isn't a lone string literal are rejected rather than guessed at.
+func findJsonnetString(contents []byte, keyPath []string) (int, int, error) {
+	notFound := fmt.Errorf("jsonnet key %s not found", strings.Join(keyPath, "."))
+	lexer := jsonnetLexer{contents: contents}
+	var stack []*jsonnetFrame
+	var prev, prevPrev jsonnetToken
+	for {
+		token, err := lexer.next()
+		if err != nil {
+			return 0, 0, err
+		}
+		if token.kind == 0 {
+			return 0, 0, notFound
+		}
+		var top *jsonnetFrame
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		switch token.kind {
+		case '{':
+			frame := &jsonnetFrame{object: true}
+			if top == nil {
+				frame.path = []string{}
+			} else if top.object && top.inValue && top.path != nil {
+				frame.path = append(append([]string(nil), top.path...), top.key)
+			}
+			stack = append(stack, frame)
+		case '[', '(':
+			stack = append(stack, &jsonnetFrame{})
+		case '}', ']', ')':
+			if len(stack) == 0 {
+				return 0, 0, fmt.Errorf("unbalanced %q at offset %d", token.kind, token.start)
+			}
+			stack = stack[:len(stack)-1]
+		case ',', ';':
+			if top != nil && top.object {
+				top.inValue = false
+			}
+		case ':':
+			if top == nil || !top.object || top.inValue {
+				break
+			}
+			// Fields may be written as name:, name::, name:::, or name+: etc.
+			keyToken := prev
+			if prev.kind == ':' {
+				break
+			}
+			if prev.kind == '+' {
+				keyToken = prevPrev
+			}
+			top.inValue = true
+			top.key = ""
+			if keyToken.kind == 'i' || keyToken.kind == 's' {
+				top.key = keyToken.value
+			}
+			// Check whether this is the field we're after, in which case its value must be a string
+			if top.path == nil || !pathEquals(append(append([]string(nil), top.path...), top.key), keyPath) {
+				break
+			}
+			value, err := lexer.nextSkippingColons()
+			if err != nil {
+				return 0, 0, err
+			}
+			if value.kind != 's' {
+				return 0, 0, fmt.Errorf("jsonnet key %s is not a string literal", strings.Join(keyPath, "."))
+			}
+			following, err := lexer.next()
+			if err != nil {
+				return 0, 0, err
+			}
+			if following.kind != ',' && following.kind != '}' {
+				return 0, 0, fmt.Errorf("jsonnet key %s is not a lone string literal", strings.Join(keyPath, "."))
+			}
+			if string(contents[value.start:value.end]) != value.value {
+				return 0, 0, fmt.Errorf("jsonnet key %s contains escaped characters", strings.Join(keyPath, "."))
+			}
+			return value.start, value.end, nil
+		}
+		prevPrev, prev = prev, token
+	}
+}
+
+func pathEquals(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jsonnetLexer splits a Jsonnet document into tokens, skipping whitespace and comments
+type jsonnetLexer struct {
+	contents []byte
+	pos      int
+}
+
+// nextSkippingColons returns the first token after any remaining colons of a field separator
+func (l *jsonnetLexer) nextSkippingColons() (jsonnetToken, error) {
+	for {
+		token, err := l.next()
+		if err != nil || token.kind != ':' {
+			return token, err
+		}
+	}
+}
+
+// next returns the next token, or one with a zero kind at the end of the document
+// NB: A string token's start and end cover its contents, excluding the quotes
+func (l *jsonnetLexer) next() (jsonnetToken, error) {
+	c := l.contents
+	for l.pos < len(c) {
+		switch ch := c[l.pos]; {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			l.pos++
+		case ch == '#' || bytes.HasPrefix(c[l.pos:], []byte("//")):
+			if end := bytes.IndexByte(c[l.pos:], '\n'); end >= 0 {
+				l.pos += end + 1
+			} else {
+				l.pos = len(c)
+			}
+		case bytes.HasPrefix(c[l.pos:], []byte("/*")):
+			end := bytes.Index(c[l.pos+2:], []byte("*/"))
+			if end < 0 {
+				return jsonnetToken{}, fmt.Errorf("unterminated comment at offset %d", l.pos)
+			}
+			l.pos += end + 4
+		case bytes.HasPrefix(c[l.pos:], []byte("|||")):
+			end := bytes.Index(c[l.pos+3:], []byte("|||"))
+			if end < 0 {
+				return jsonnetToken{}, fmt.Errorf("unterminated text block at offset %d", l.pos)
+			}
+			start := l.pos + 3
+			l.pos = start + end + 3
+			return jsonnetToken{kind: 'b', start: start, end: start + end}, nil
+		case ch == '"' || ch == '\'':
+			return l.string(ch, false)
+		case ch == '@' && l.pos+1 < len(c) && (c[l.pos+1] == '"' || c[l.pos+1] == '\''):
+			l.pos++
+			return l.string(c[l.pos], true)
+		case ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z'):
+			start := l.pos
+			for l.pos < len(c) && (c[l.pos] == '_' || (c[l.pos] >= 'a' && c[l.pos] <= 'z') || (c[l.pos] >= 'A' && c[l.pos] <= 'Z') || (c[l.pos] >= '0' && c[l.pos] <= '9')) {
+				l.pos++
+			}
+			return jsonnetToken{kind: 'i', value: string(c[start:l.pos]), start: start, end: l.pos}, nil
+		default:
+			l.pos++
+			return jsonnetToken{kind: ch, start: l.pos - 1, end: l.pos}, nil
+		}
+	}
+
+	return jsonnetToken{}, nil
+}
+
+// string reads a quoted string, whose opening quote is at the current position
+func (l *jsonnetLexer) string(quote byte, verbatim bool) (jsonnetToken, error) {
+	c := l.contents
+	start := l.pos + 1
+	value := strings.Builder{}
+	for i := start; i < len(c); i++ {
+		switch {
+		case c[i] == quote && verbatim && i+1 < len(c) && c[i+1] == quote:
+			value.WriteByte(quote)
+			i++
+		case c[i] == quote:
+			l.pos = i + 1
+			return jsonnetToken{kind: 's', value: value.String(), start: start, end: i}, nil
+		case c[i] == '\\' && !verbatim && i+1 < len(c):
+			// Escapes only matter to us in that they can't end the string
+			value.WriteByte(c[i])
+			value.WriteByte(c[i+1])
+			i++
+		default:
+			value.WriteByte(c[i])
+		}
+	}
+
+	return jsonnetToken{}, fmt.Errorf("unterminated string at offset %d", l.pos)
+}
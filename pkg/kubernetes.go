@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"time"
+)
+
+const crdGroup = "image-updater.predakanga.github.io"
+const crdVersion = "v1alpha1"
+const crdResyncPeriod = 600
+
+var (
+	repositoryResource = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "imageupdaterepositories"}
+	deploymentResource = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "imageupdatedeployments"}
+	secretResource     = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+)
+
+// kubernetesRestConfig loads the named kubeconfig, falling back to the default rules and in-cluster config
+func kubernetesRestConfig(kubeconfig string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+
+	return clientConfig.ClientConfig()
+}
+
+// ResourceWatcher keeps the server's deployments and repositories in sync with custom resources
+type ResourceWatcher struct {
+	namespace  string
+	kubeconfig string
+	server     *WebhookServer
+}
+
+func NewResourceWatcher(cfg KubernetesConfig, server *WebhookServer) *ResourceWatcher {
+	return &ResourceWatcher{
+		namespace:  cfg.Namespace,
+		kubeconfig: cfg.Kubeconfig,
+		server:     server,
+	}
+}
+
+// Run watches the custom resources until the context is cancelled
+func (w *ResourceWatcher) Run(ctx context.Context) {
+	restConfig, err := kubernetesRestConfig(w.kubeconfig)
+	if err != nil {
+		log.WithError(err).Error("Could not load Kubernetes configuration")
+		return
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		log.WithError(err).Error("Could not create Kubernetes client")
+		return
+	}
+
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, crdResyncPeriod*time.Second, w.namespace, nil)
+	factory.ForResource(repositoryResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.updateRepository(ctx, client, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			w.updateRepository(ctx, client, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if namespace, name, ok := resourceName(obj); ok {
+				w.server.removeRepository(namespace, name)
+			}
+		},
+	})
+	factory.ForResource(deploymentResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.updateDeployment,
+		UpdateFunc: func(_, obj interface{}) { w.updateDeployment(obj) },
+		DeleteFunc: func(obj interface{}) {
+			if namespace, name, ok := resourceName(obj); ok {
+				w.server.removeDeployment(namespace, name)
+			}
+		},
+	})
+
+	log.WithField("namespace", w.namespace).Info("Watching Kubernetes resources for configuration")
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	<-ctx.Done()
+}
+
+func (w *ResourceWatcher) updateRepository(ctx context.Context, client dynamic.Interface, obj interface{}) {
+	resource, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	logFields := log.Fields{"namespace": resource.GetNamespace(), "repository": resource.GetName()}
+
+	var spec struct {
+		RepositoryConfig
+		CredentialsSecret string `hcl:"credentials_secret"`
+	}
+	if err := decodeResourceSpec(resource, &spec); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Invalid repository resource")
+		return
+	}
+	cfg := spec.RepositoryConfig
+	cfg.Name = resource.GetName()
+	// Credentials can optionally be sourced from a secret alongside the resource
+	if spec.CredentialsSecret != "" {
+		secret, err := client.Resource(secretResource).Namespace(resource.GetNamespace()).Get(ctx, spec.CredentialsSecret, metav1.GetOptions{})
+		if err != nil {
+			log.WithError(err).WithFields(logFields).Warn("Could not fetch repository credentials")
+			return
+		}
+		// Secrets hold either a token, or a username and password
+		if token, err := secretValue(secret, "token"); err == nil {
+			cfg.Token = token
+		} else {
+			if cfg.Username, err = secretValue(secret, "username"); err != nil {
+				log.WithError(err).WithFields(logFields).Warn("Invalid repository credentials")
+				return
+			}
+			if cfg.Password, err = secretValue(secret, "password"); err != nil {
+				log.WithError(err).WithFields(logFields).Warn("Invalid repository credentials")
+				return
+			}
+		}
+	}
+
+	if err := w.server.addRepository(resource.GetNamespace(), cfg); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Invalid repository resource")
+	}
+}
+
+func (w *ResourceWatcher) updateDeployment(obj interface{}) {
+	resource, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	logFields := log.Fields{"namespace": resource.GetNamespace(), "deployment": resource.GetName()}
+
+	var cfg DeploymentConfig
+	if err := decodeResourceSpec(resource, &cfg); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Invalid deployment resource")
+		return
+	}
+	cfg.Name = resource.GetName()
+	if err := w.server.addDeployment(resource.GetNamespace(), cfg); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Invalid deployment resource")
+	}
+}
+
+// decodeResourceSpec decodes a resource's spec using the same field names as the config file
+func decodeResourceSpec(resource *unstructured.Unstructured, out interface{}) error {
+	spec, ok := resource.Object["spec"]
+	if !ok {
+		return fmt.Errorf("resource has no spec")
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:     "hcl",
+		Squash:      true,
+		ErrorUnused: true,
+		Result:      out,
+	})
+	if err != nil {
+		return err
+	}
+
+	return decoder.Decode(spec)
+}
+
+func secretValue(secret *unstructured.Unstructured, key string) (string, error) {
+	encoded, found, err := unstructured.NestedString(secret.Object, "data", key)
+	if err != nil || !found {
+		return "", fmt.Errorf("secret %s has no key %s", secret.GetName(), key)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("secret %s has invalid key %s: %w", secret.GetName(), key, err)
+	}
+
+	return string(decoded), nil
+}
+
+// resourceName returns a resource's namespace and name, including for resources which were deleted unseen
+func resourceName(obj interface{}) (string, string, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if resource, ok := obj.(*unstructured.Unstructured); ok {
+		return resource.GetNamespace(), resource.GetName(), true
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Supported values of log_format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Log file rotation, unless configured otherwise
+const defaultLogMaxSize = 100
+const defaultLogMaxBackups = 5
+
+// validRequestID limits the request IDs we'll accept from callers to ones that are safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// ConfigureLogging sets the log format and destination
+func ConfigureLogging(cfg Config) error {
+	switch cfg.LogFormat {
+	case "", LogFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case LogFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log_format: %s", cfg.LogFormat)
+	}
+	if cfg.LogFile != nil {
+		file, err := newRotatingFile(*cfg.LogFile)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		log.SetOutput(file)
+	}
+
+	return nil
+}
+
+// RequestIDHandler gives every request a correlation ID, which is returned in a response header
+// NB: Callers may supply their own ID, so that it can be traced through their systems too
+func RequestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext returns the correlation ID of the request being handled, if any
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+func newRequestID() string {
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+
+	return hex.EncodeToString(idBytes)
+}
+
+// requestLogFields returns the fields which identify a request in every log line about it
+func requestLogFields(payload UpdateRequest) log.Fields {
+	toRet := log.Fields{"deployment": payload.Deployment, "authorized_by": payload.AuthorizedBy}
+	if payload.RequestID != "" {
+		toRet["request_id"] = payload.RequestID
+	}
+
+	return toRet
+}
+
+// rotatingFile is a log file which is rotated once it reaches its maximum size, keeping a limited
+// number of old files alongside it as path.1, path.2 and so on
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFile(cfg LogFileConfig) (*rotatingFile, error) {
+	toRet := &rotatingFile{
+		path:       cfg.Path,
+		maxSize:    defaultLogMaxSize << 20,
+		maxBackups: defaultLogMaxBackups,
+	}
+	if cfg.MaxSize > 0 {
+		toRet.maxSize = int64(cfg.MaxSize) << 20
+	}
+	if cfg.MaxBackups > 0 {
+		toRet.maxBackups = cfg.MaxBackups
+	}
+	if err := toRet.open(); err != nil {
+		return nil, err
+	}
+
+	return toRet, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+// rotate shifts each old file along by one, dropping the oldest, and starts a new file
+func (f *rotatingFile) rotate() error {
+	_ = f.file.Close()
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return f.open()
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Where checkouts keep their objects and files
+const (
+	StorageMemory = "memory"
+	StorageDisk   = "disk"
+	// StorageAuto starts in memory, but starts over on disk if the checkout outgrows its limits
+	StorageAuto = "auto"
+)
+
+var errCheckoutTooLarge = errors.New("repository is too large to clone in memory")
+
+var (
+	checkoutMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "image_updater",
+		Subsystem: "checkouts",
+		Name:      "memory_bytes",
+		Help:      "The size of the objects held by in-memory checkouts",
+	})
+	checkoutMemoryBudget = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "image_updater",
+		Subsystem: "checkouts",
+		Name:      "memory_budget_bytes",
+		Help:      "The most that in-memory checkouts may hold between them, or zero if unlimited",
+	})
+	oversizedCheckouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "image_updater",
+		Subsystem: "checkouts",
+		Name:      "oversized_total",
+		Help:      "The number of clones which outgrew their memory limits, by whether they were rejected or moved to disk",
+	}, []string{"action"})
+)
+
+// memoryBudget is shared by every in-memory checkout, so that concurrent clones of large
+// repositories can't exhaust the server's memory between them
+var memoryBudget = &checkoutBudget{}
+
+type checkoutBudget struct {
+	mutex sync.Mutex
+	limit int64
+	used  int64
+}
+
+// SetMemoryBudget limits the total size of in-memory checkouts, where zero means unlimited
+func SetMemoryBudget(limit int64) {
+	memoryBudget.mutex.Lock()
+	defer memoryBudget.mutex.Unlock()
+	memoryBudget.limit = limit
+	checkoutMemoryBudget.Set(float64(limit))
+}
+
+func (b *checkoutBudget) reserve(size int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.limit > 0 && b.used+size > b.limit {
+		return fmt.Errorf("%w: memory budget exhausted", errCheckoutTooLarge)
+	}
+	b.used += size
+	checkoutMemory.Set(float64(b.used))
+
+	return nil
+}
+
+func (b *checkoutBudget) release(size int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= size
+	checkoutMemory.Set(float64(b.used))
+}
+
+func validateStorage(storageType string, maxSize int) error {
+	switch storageType {
+	case "", StorageMemory, StorageDisk, StorageAuto:
+	default:
+		return fmt.Errorf("invalid storage: %s", storageType)
+	}
+	if maxSize < 0 {
+		return fmt.Errorf("max_size_mb cannot be negative")
+	}
+
+	return nil
+}
+
+// checkoutStorage holds a checkout's objects and worktree, which must be released once it's finished with
+type checkoutStorage struct {
+	storer     storage.Storer
+	filesystem billy.Filesystem
+	release    func()
+}
+
+// budgetedStorage counts the objects stored in memory against the repository's limit and the budget
+// NB: Cloning into memory stores each object individually, so this sees everything as it arrives
+type budgetedStorage struct {
+	*memory.Storage
+	limit int64
+	mutex sync.Mutex
+	used  int64
+}
+
+func (s *budgetedStorage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	size := obj.Size()
+	s.mutex.Lock()
+	if s.limit > 0 && s.used+size > s.limit {
+		s.mutex.Unlock()
+		return plumbing.ZeroHash, fmt.Errorf("%w: larger than max_size_mb", errCheckoutTooLarge)
+	}
+	if err := memoryBudget.reserve(size); err != nil {
+		s.mutex.Unlock()
+		return plumbing.ZeroHash, err
+	}
+	s.used += size
+	s.mutex.Unlock()
+
+	return s.Storage.SetEncodedObject(obj)
+}
+
+func (s *budgetedStorage) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	memoryBudget.release(s.used)
+	s.used = 0
+}
+
+func newMemoryStorage(limit int64) *checkoutStorage {
+	storer := &budgetedStorage{Storage: memory.NewStorage(), limit: limit}
+
+	return &checkoutStorage{storer: storer, filesystem: memfs.New(), release: storer.release}
+}
+
+// newDiskStorage clones into a temporary directory, which is removed once the checkout is released
+func newDiskStorage() (*checkoutStorage, error) {
+	dir, err := os.MkdirTemp("", "image-updater-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create checkout directory: %w", err)
+	}
+	storer := filesystem.NewStorage(osfs.New(filepath.Join(dir, ".git")), cache.NewObjectLRUDefault())
+
+	return &checkoutStorage{
+		storer:     storer,
+		filesystem: osfs.New(dir),
+		release: func() {
+			_ = storer.Close()
+			_ = os.RemoveAll(dir)
+		},
+	}, nil
+}
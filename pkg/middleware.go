@@ -1,16 +1,21 @@
 package pkg
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
-func ParseCIDRs(inputs []string) []*net.IPNet {
+func ParseCIDRs(inputs []string) ([]*net.IPNet, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
 	toRet := make([]*net.IPNet, 0, len(inputs))
 	for i, input := range inputs {
 		// Convert any bare IPs to CIDR
@@ -23,20 +28,20 @@ func ParseCIDRs(inputs []string) []*net.IPNet {
 			}
 		}
 		if _, cidr, err := net.ParseCIDR(input); err != nil {
-			log.WithError(err).WithField("ip", inputs[i]).Fatal("Invalid IP address")
+			return nil, fmt.Errorf("invalid IP address %s: %w", inputs[i], err)
 		} else {
 			toRet = append(toRet, cidr)
 		}
 	}
 
-	return toRet
+	return toRet, nil
 }
 
 func IPAllowlistHandler(handler http.Handler, allowed []*net.IPNet) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if ipStr, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
 			log.WithError(err).WithField("address", r.RemoteAddr).Warn("Could not decode remote address")
-			w.WriteHeader(http.StatusForbidden)
+			writeResponse(w, newResponse(http.StatusForbidden, "Forbidden"))
 			return
 		} else {
 			ip := net.ParseIP(ipStr)
@@ -48,7 +53,7 @@ func IPAllowlistHandler(handler http.Handler, allowed []*net.IPNet) http.Handler
 				}
 			}
 			if !matched {
-				w.WriteHeader(http.StatusForbidden)
+				writeResponse(w, newResponse(http.StatusForbidden, "Forbidden"))
 				return
 			}
 		}
@@ -58,8 +63,12 @@ func IPAllowlistHandler(handler http.Handler, allowed []*net.IPNet) http.Handler
 
 func SecretKeyHandler(handler http.Handler, name string, key string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get(name) != key {
-			w.WriteHeader(http.StatusForbidden)
+		// Callers which didn't send a key at all are told so apart from those which sent the wrong one
+		if provided := r.Header.Get(name); provided == "" {
+			writeResponse(w, newResponse(http.StatusUnauthorized, fmt.Sprintf("Missing %s header", name)))
+			return
+		} else if provided != key {
+			writeResponse(w, newResponse(http.StatusForbidden, "Invalid key"))
 			return
 		}
 
@@ -98,3 +107,61 @@ func InstrumentHandler(handler http.Handler) http.Handler {
 
 	return handler
 }
+
+// BodyLimitHandler rejects request bodies over the limit, without reading any more of them than that
+func BodyLimitHandler(handler http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			writeResponse(w, newResponse(http.StatusRequestEntityTooLarge, "Payload too large"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// HeadersHandler adds fixed headers to every response
+func HeadersHandler(handler http.Handler, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CORSHandler allows browsers on the configured origins to call the API, answering preflight requests itself
+// NB: Preflight requests never carry credentials, so they must be answered before authentication
+func CORSHandler(handler http.Handler, cfg CORSConfig) http.Handler {
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost}
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = []string{"Content-Type", "X-Key"}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !matchImage(cfg.AllowedOrigins, origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		if cfg.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const notifyTimeout = 10
+
+// Events which can trigger notifications
+const (
+	EventUpdated           = "updated"
+	EventPushFailed        = "push_failed"
+	EventSyncSucceeded     = "sync_succeeded"
+	EventSyncFailed        = "sync_failed"
+	EventRolledBack        = "rolled_back"
+	EventApprovalRequested = "approval_requested"
+	EventCredentialFailed  = "credential_failed"
+	EventDriftDetected     = "drift_detected"
+	EventRepeatedFailures  = "repeated_failures"
+	EventRecovered         = "recovered"
+)
+
+var allEvents = []string{EventUpdated, EventPushFailed, EventSyncSucceeded, EventSyncFailed, EventRolledBack, EventApprovalRequested, EventCredentialFailed, EventDriftDetected, EventRepeatedFailures, EventRecovered}
+
+// alertEvents are the default for notifiers which page someone, rather than posting to a channel
+var alertEvents = []string{EventRepeatedFailures, EventRecovered}
+
+// Services with a fixed endpoint
+const (
+	pushoverUrl  = "https://api.pushover.net/1/messages.json"
+	pagerDutyUrl = "https://events.pagerduty.com/v2/enqueue"
+)
+
+const defaultNotifyMessage = "[{{ .name }}] {{ .message }}"
+
+// notification describes something that happened to a deployment
+type notification struct {
+	Event   string
+	Message string
+	Payload UpdateRequest
+	Fields  map[string]string
+}
+
+// Notifier posts messages about update outcomes to a chat webhook, or alerts someone directly
+type Notifier struct {
+	Name    string
+	url     string
+	format  string
+	events  mapset.Set[string]
+	message *template.Template
+	token   string
+	user    string
+	from    string
+	to      []string
+}
+
+func NewNotifier(cfg NotifierConfig) (*Notifier, error) {
+	toRet := &Notifier{
+		Name:   cfg.Name,
+		url:    cfg.Url,
+		format: cfg.Format,
+		events: mapset.NewThreadUnsafeSet[string](cfg.Events...),
+		token:  cfg.Token,
+		user:   cfg.User,
+		from:   cfg.From,
+		to:     cfg.To,
+	}
+	defaultEvents := allEvents
+	switch toRet.format {
+	case "":
+		toRet.format = "slack"
+		fallthrough
+	case "slack", "teams", "discord":
+		if toRet.url == "" {
+			return nil, fmt.Errorf("notifier %s needs a url", cfg.Name)
+		}
+	case "pushover":
+		if toRet.token == "" || toRet.user == "" {
+			return nil, fmt.Errorf("pushover notifier %s needs a token and user", cfg.Name)
+		}
+		if toRet.url == "" {
+			toRet.url = pushoverUrl
+		}
+	case "pagerduty":
+		if toRet.token == "" {
+			return nil, fmt.Errorf("pagerduty notifier %s needs a token", cfg.Name)
+		}
+		if toRet.url == "" {
+			toRet.url = pagerDutyUrl
+		}
+		defaultEvents = alertEvents
+	case "email":
+		if err := validateEmail(toRet.url, toRet.from, toRet.to); err != nil {
+			return nil, fmt.Errorf("email notifier %s: %w", cfg.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid notifier format: %s", toRet.format)
+	}
+	if toRet.events.IsEmpty() {
+		toRet.events.Append(defaultEvents...)
+	}
+	for _, event := range toRet.events.ToSlice() {
+		if !mapset.NewThreadUnsafeSet[string](allEvents...).Contains(event) {
+			return nil, fmt.Errorf("invalid notifier event: %s", event)
+		}
+	}
+	if cfg.Message == "" {
+		cfg.Message = defaultNotifyMessage
+	}
+	tpl := template.New("")
+	if _, err := tpl.Parse(cfg.Message); err != nil {
+		return nil, fmt.Errorf("failed to parse notifier template: %w", err)
+	}
+	toRet.message = tpl
+
+	return toRet, nil
+}
+
+// Notify sends the notification if the notifier is subscribed to its event
+// NB: Deployment is nil for events which aren't specific to a deployment
+func (n *Notifier) Notify(deployment *Deployment, note notification) {
+	if !n.events.Contains(note.Event) {
+		return
+	}
+	logFields := log.Fields{"notifier": n.Name, "event": note.Event}
+
+	data := map[string]interface{}{"name": "image-updater"}
+	if deployment != nil {
+		logFields["deployment"] = deployment.Name
+		data = deployment.templateData(note.Payload)
+	}
+	data["event"] = note.Event
+	data["message"] = note.Message
+	for k, v := range note.Fields {
+		data[k] = v
+	}
+	text := bytes.Buffer{}
+	if err := n.message.Execute(&text, data); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Failed to execute notifier template")
+		return
+	}
+
+	if err := n.send(deployment, note, text.String()); err != nil {
+		log.WithError(err).WithFields(logFields).Warn("Failed to send notification")
+	}
+}
+
+// send delivers a message, as each service has a slightly different idea of what one looks like
+func (n *Notifier) send(deployment *Deployment, note notification, text string) error {
+	subject := "image-updater: " + note.Event
+	if deployment != nil {
+		subject += " for " + deployment.Name
+	}
+	switch n.format {
+	case "discord":
+		return postJSON(n.url, map[string]string{"content": text})
+	case "pushover":
+		body := map[string]interface{}{"token": n.token, "user": n.user, "title": subject, "message": text}
+		if note.Event == EventRepeatedFailures {
+			body["priority"] = 1
+		}
+		return postJSON(n.url, body)
+	case "pagerduty":
+		// Alerts are keyed by deployment, so that recovering resolves the matching incident
+		action, dedupKey := "trigger", "image-updater"
+		if note.Event == EventRecovered {
+			action = "resolve"
+		}
+		if deployment != nil {
+			dedupKey += "/" + deployment.Name
+		}
+		return postJSON(n.url, map[string]interface{}{
+			"routing_key":  n.token,
+			"event_action": action,
+			"dedup_key":    dedupKey,
+			"payload": map[string]interface{}{
+				"summary":        text,
+				"source":         "image-updater",
+				"severity":       "error",
+				"custom_details": note.Fields,
+			},
+		})
+	case "email":
+		return sendEmail(n.url, n.from, n.to, subject, text)
+	default:
+		return postJSON(n.url, map[string]string{"text": text})
+	}
+}
+
+// notify sends a notification to the global notifiers and the deployment's own, in the background
+func (s *WebhookServer) notify(deployment *Deployment, note notification) {
+	for _, notifier := range s.notifiers {
+		go notifier.Notify(deployment, note)
+	}
+	if deployment == nil {
+		return
+	}
+	for _, notifier := range deployment.Notifiers {
+		go notifier.Notify(deployment, note)
+	}
+}
+
+func postJSON(url string, body interface{}) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("could not encode body: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,381 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsScope        = "https://www.googleapis.com/auth/devstorage.read_write"
+	azureAPIVersion = "2021-12-02"
+)
+
+func init() {
+	RegisterStateBackend("s3", newS3StateBackend)
+	RegisterStateBackend("gcs", newGCSStateBackend)
+	RegisterStateBackend("azure", newAzureStateBackend)
+}
+
+// objectRequest makes a request to an object store, returning the response body unless the object
+// doesn't exist or is empty, and treating a failed precondition as a conflict
+func objectRequest(client *http.Client, req *http.Request) ([]byte, http.Header, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read response: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && req.Method == http.MethodGet:
+		return nil, resp.Header, nil
+	case resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict:
+		return nil, nil, errStateConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, nil, fmt.Errorf("unexpected status %d from %s %s", resp.StatusCode, req.Method, req.URL.Path)
+	case len(body) == 0:
+		return nil, resp.Header, nil
+	}
+
+	return body, resp.Header, nil
+}
+
+// escapeObjectPath escapes everything but unreserved characters in each segment of an object's path
+func escapeObjectPath(path string) string {
+	var toRet strings.Builder
+	for _, c := range []byte(path) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			toRet.WriteByte(c)
+		} else {
+			fmt.Fprintf(&toRet, "%%%02X", c)
+		}
+	}
+
+	return toRet.String()
+}
+
+// s3StateBackend keeps the state in an S3 (or S3-compatible) bucket, using ETags for locking
+type s3StateBackend struct {
+	url          string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3StateBackend(cfg StateConfig) (StateBackend, error) {
+	toRet := &s3StateBackend{
+		region:       cfg.Region,
+		accessKey:    cfg.AccessKeyId,
+		secretKey:    cfg.SecretAccessKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if toRet.region == "" {
+		toRet.region = os.Getenv("AWS_REGION")
+	}
+	if toRet.region == "" {
+		toRet.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	// NB: A session token only goes with credentials from the environment
+	if toRet.accessKey == "" {
+		toRet.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		toRet.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	} else {
+		toRet.sessionToken = ""
+	}
+	if cfg.Bucket == "" || toRet.region == "" {
+		return nil, fmt.Errorf("s3 state requires a bucket and region")
+	}
+	if toRet.accessKey == "" || toRet.secretKey == "" {
+		return nil, fmt.Errorf("s3 state requires credentials")
+	}
+	key := escapeObjectPath(strings.TrimPrefix(cfg.Path, "/"))
+	// Custom endpoints are usually S3-compatible stores, which don't all support virtual-hosted buckets
+	if cfg.Endpoint != "" {
+		toRet.url = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + escapeObjectPath(cfg.Bucket) + "/" + key
+	} else {
+		toRet.url = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.Bucket, toRet.region, key)
+	}
+
+	return toRet, nil
+}
+
+func (b *s3StateBackend) Load(ctx context.Context) ([]byte, string, error) {
+	req, err := b.request(ctx, http.MethodGet, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	// NB: An empty object still has a version, which must be matched to replace it
+	data, header, err := objectRequest(http.DefaultClient, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, header.Get("ETag"), nil
+}
+
+func (b *s3StateBackend) Save(ctx context.Context, data []byte, version string) (string, error) {
+	req, err := b.request(ctx, http.MethodPut, data, func(req *http.Request) {
+		req.Header.Set("Content-Type", "application/json")
+		if version == "" {
+			req.Header.Set("If-None-Match", "*")
+		} else {
+			req.Header.Set("If-Match", version)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	_, header, err := objectRequest(http.DefaultClient, req)
+	if err != nil {
+		return "", err
+	}
+
+	return header.Get("ETag"), nil
+}
+
+// request creates a request for the object, signed once any extra headers are set
+func (b *s3StateBackend) request(ctx context.Context, method string, body []byte, headers ...func(req *http.Request)) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	for _, header := range headers {
+		header(req)
+	}
+	b.sign(req, body, time.Now())
+
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 to the request
+func (b *s3StateBackend) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + b.region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	// Every header we set is signed, along with the host
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		signed[strings.ToLower(name)] = strings.TrimSpace(values[0])
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + b.secretKey)
+	for _, part := range []string{amzDate[:8], b.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// gcsStateBackend keeps the state in a Google Cloud Storage bucket, using generations for locking
+type gcsStateBackend struct {
+	endpoint        string
+	bucket          string
+	object          string
+	credentialsFile string
+
+	mutex  sync.Mutex
+	client *http.Client
+}
+
+func newGCSStateBackend(cfg StateConfig) (StateBackend, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("gcs state requires a bucket")
+	}
+	toRet := &gcsStateBackend{
+		endpoint:        "https://storage.googleapis.com",
+		bucket:          cfg.Bucket,
+		object:          strings.TrimPrefix(cfg.Path, "/"),
+		credentialsFile: cfg.CredentialsFile,
+	}
+	if cfg.Endpoint != "" {
+		toRet.endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	}
+
+	return toRet, nil
+}
+
+// connect loads the credentials the first time they're needed
+func (b *gcsStateBackend) connect(ctx context.Context) (*http.Client, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.client != nil {
+		return b.client, nil
+	}
+	var creds *google.Credentials
+	var err error
+	if b.credentialsFile != "" {
+		var credBytes []byte
+		if credBytes, err = os.ReadFile(b.credentialsFile); err != nil {
+			return nil, fmt.Errorf("could not read credentials file: %w", err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, credBytes, gcsScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, gcsScope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load credentials: %w", err)
+	}
+	// NB: The client outlives the context it was first needed for
+	b.client = oauth2.NewClient(context.Background(), creds.TokenSource)
+
+	return b.client, nil
+}
+
+func (b *gcsStateBackend) Load(ctx context.Context) ([]byte, string, error) {
+	client, err := b.connect(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	objectUrl := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", b.endpoint, url.PathEscape(b.bucket), url.PathEscape(b.object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectUrl, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create request: %w", err)
+	}
+	// NB: An empty object still has a version, which must be matched to replace it
+	data, header, err := objectRequest(client, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, header.Get("X-Goog-Generation"), nil
+}
+
+func (b *gcsStateBackend) Save(ctx context.Context, data []byte, version string) (string, error) {
+	client, err := b.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	// A generation of 0 only matches if the object doesn't exist yet
+	if version == "" {
+		version = "0"
+	}
+	query := url.Values{"uploadType": {"media"}, "name": {b.object}, "ifGenerationMatch": {version}}
+	uploadUrl := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(b.bucket), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadUrl, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, _, err := objectRequest(client, req)
+	if err != nil {
+		return "", err
+	}
+	var object struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return "", fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return object.Generation, nil
+}
+
+// azureStateBackend keeps the state in an Azure Blob Storage container, using ETags for locking
+type azureStateBackend struct {
+	url string
+}
+
+func newAzureStateBackend(cfg StateConfig) (StateBackend, error) {
+	sasToken := cfg.SASToken
+	if sasToken == "" {
+		sasToken = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	if endpoint == "" && cfg.Account != "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.Account)
+	}
+	if endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("azure state requires an account and a container as its bucket")
+	}
+	if sasToken == "" {
+		return nil, fmt.Errorf("azure state requires a sas_token")
+	}
+
+	return &azureStateBackend{
+		url: endpoint + "/" + escapeObjectPath(cfg.Bucket) + "/" + escapeObjectPath(strings.TrimPrefix(cfg.Path, "/")) +
+			"?" + strings.TrimPrefix(sasToken, "?"),
+	}, nil
+}
+
+func (b *azureStateBackend) Load(ctx context.Context) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	// NB: An empty object still has a version, which must be matched to replace it
+	data, header, err := objectRequest(http.DefaultClient, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, header.Get("ETag"), nil
+}
+
+func (b *azureStateBackend) Save(ctx context.Context, data []byte, version string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.url, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	req.Header.Set("Content-Type", "application/json")
+	if version == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", version)
+	}
+	_, header, err := objectRequest(http.DefaultClient, req)
+	if err != nil {
+		return "", err
+	}
+
+	return header.Get("ETag"), nil
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/go-git/go-git/v5"
+	"gopkg.in/yaml.v3"
+	"io"
+	"sort"
+	"strings"
+)
+
+// podSpecPaths lists where each workload kind keeps its pod spec
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// Patch updates container images in a patch file which embeds a full pod spec
+//
+// Resources are chosen with a selector of the form "Kind/name[/container]", where each
+// part may contain * wildcards. When the container is omitted, every container (and init
+// container) whose image matches the deployment is updated.
+type Patch struct {
+	Path      string
+	kind      string
+	name      string
+	container string
+	images    []string
+}
+
+// imageReplacement records the location of a scalar to be replaced within a YAML file
+type imageReplacement struct {
+	line   int
+	column int
+	old    string
+	new    string
+}
+
+func NewPatch(cfg PatchConfig, images []string) (*Patch, error) {
+	parts := strings.Split(cfg.Selector, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid patch selector %q, expected Kind/name[/container]", cfg.Selector)
+	}
+	toRet := &Patch{
+		Path:   cfg.Path,
+		kind:   parts[0],
+		name:   parts[1],
+		images: images,
+	}
+	if len(parts) == 3 {
+		toRet.container = parts[2]
+	}
+
+	return toRet, nil
+}
+
+func (p *Patch) Paths() []string {
+	return []string{p.Path}
+}
+
+func (p *Patch) Apply(worktree *git.Worktree, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	foundImages, changed, err := p.apply(worktree, newTag)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update patch %s: %w", p.Path, err)
+	}
+
+	return foundImages, changed, nil
+}
+
+func (p *Patch) Validate(worktree *git.Worktree, _ string) error {
+	return validateYAMLFiles(worktree, p.Paths())
+}
+
+// apply replaces the tags of any matching images, returning the images found and whether the file changed
+func (p *Patch) apply(worktree *git.Worktree, newTag tagSelector) (imageTags, bool, error) {
+	foundImages := make(imageTags)
+
+	patchBytes, err := readWorktreeFile(worktree, p.Path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read patch file: %w", err)
+	}
+
+	// Walk every document in the file, looking for matching containers
+	var replacements []imageReplacement
+	decoder := yaml.NewDecoder(strings.NewReader(string(patchBytes)))
+	matchedResource := false
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, false, fmt.Errorf("failed to decode patch file: %w", err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		root := doc.Content[0]
+		kind := mappingValue(root, "kind")
+		name := mappingValue(mappingNode(root, "metadata"), "name")
+		if kind == nil || name == nil || !fnmatch(p.kind, kind.Value) || !fnmatch(p.name, name.Value) {
+			continue
+		}
+		specPath, ok := podSpecPaths[kind.Value]
+		if !ok {
+			// Wildcard selectors also match resources which have no pods, such as services
+			if strings.ContainsRune(p.kind, '*') {
+				continue
+			}
+			return nil, false, fmt.Errorf("unsupported resource kind %s", kind.Value)
+		}
+		matchedResource = true
+
+		podSpec := root
+		for _, key := range specPath {
+			podSpec = mappingNode(podSpec, key)
+		}
+		for _, listKey := range []string{"initContainers", "containers"} {
+			containers := mappingNode(podSpec, listKey)
+			if containers == nil || containers.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, container := range containers.Content {
+				containerName := mappingValue(container, "name")
+				image := mappingValue(container, "image")
+				if image == nil || (p.container != "" && (containerName == nil || !fnmatch(p.container, containerName.Value))) {
+					continue
+				}
+				imageName := image.Value
+				if idx := strings.IndexRune(imageName, '@'); idx != -1 {
+					imageName = imageName[:idx]
+				}
+				oldTag := ""
+				if name, tag, ok := splitImageTag(imageName); ok {
+					imageName, oldTag = name, tag
+				}
+				if !matchImage(p.images, imageName) {
+					continue
+				}
+				foundImages.merge(imageTags{imageName: oldTag})
+				tag, ok := newTag(imageName)
+				if !ok {
+					continue
+				}
+				replacements = append(replacements, imageReplacement{
+					line:   image.Line,
+					column: image.Column,
+					old:    image.Value,
+					new:    imageName + ":" + tag,
+				})
+			}
+		}
+	}
+	if !matchedResource {
+		return nil, false, fmt.Errorf("no resource matches selector %s/%s", p.kind, p.name)
+	}
+
+	patchString, changeMade, err := applyReplacements(string(patchBytes), replacements)
+	if err != nil {
+		return nil, false, err
+	}
+	if !changeMade {
+		return foundImages, false, nil
+	}
+
+	if err := writeWorktreeFile(worktree, p.Path, []byte(patchString)); err != nil {
+		return nil, false, fmt.Errorf("failed to write patch file: %w", err)
+	}
+
+	return foundImages, true, nil
+}
+
+// applyReplacements makes the replacements from the end of the body, so that earlier positions stay valid
+func applyReplacements(body string, replacements []imageReplacement) (string, bool, error) {
+	sort.Slice(replacements, func(i, j int) bool {
+		if replacements[i].line == replacements[j].line {
+			return replacements[i].column > replacements[j].column
+		}
+		return replacements[i].line > replacements[j].line
+	})
+	changeMade := false
+	for _, replacement := range replacements {
+		if replacement.old == replacement.new {
+			continue
+		}
+		offset := lineColumnOffset(body, replacement.line, replacement.column)
+		if offset == -1 {
+			return "", false, fmt.Errorf("could not locate %s", replacement.old)
+		}
+		idx := strings.Index(body[offset:], replacement.old)
+		if idx == -1 {
+			return "", false, fmt.Errorf("could not locate %s", replacement.old)
+		}
+		offset += idx
+		body = body[:offset] + replacement.new + body[offset+len(replacement.old):]
+		changeMade = true
+	}
+
+	return body, changeMade, nil
+}
+
+// mappingNode returns the value stored under key in a YAML mapping, or nil
+func mappingNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// mappingValue returns the scalar stored under key in a YAML mapping, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	value := mappingNode(node, key)
+	if value == nil || value.Kind != yaml.ScalarNode {
+		return nil
+	}
+
+	return value
+}
+
+// lineColumnOffset converts a 1-indexed line and column into a byte offset, or -1
+func lineColumnOffset(body string, line int, column int) int {
+	offset := 0
+	for i := 1; i < line; i++ {
+		idx := strings.IndexRune(body[offset:], '\n')
+		if idx == -1 {
+			return -1
+		}
+		offset += idx + 1
+	}
+	offset += column - 1
+	if offset > len(body) {
+		return -1
+	}
+
+	return offset
+}
@@ -3,13 +3,42 @@ package pkg
 import (
 	"errors"
 	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"sigs.k8s.io/json"
+	"sort"
 	"strings"
 )
 
-type webhookPayload struct {
+// UpdateRequest is a normalized request to update a deployment, from the webhook or any other source
+type UpdateRequest struct {
+	// Deployment may contain * wildcards to update every matching deployment, optionally within a group
 	Deployment   string `json:"deployment"`
+	Group        string `json:"group"`
 	TagName      string `json:"tag_name"`
 	AuthorizedBy string `json:"authorized_by"`
+	CallbackUrl  string `json:"callback_url"`
+
+	// Images sets independent tags for each named image, instead of TagName
+	Images map[string]string `json:"images"`
+
+	// Repositories can only be chosen by the payload for deployments using a repository template
+	RepositoryUrl    string `json:"repository_url"`
+	RepositoryBranch string `json:"repository_branch"`
+
+	// Extra holds any additional fields, which are checked against the deployment's extra_fields
+	Extra map[string]string `json:"-"`
+
+	// DryRun applies the update without pushing it, to check that it would succeed
+	DryRun bool `json:"dry_run"`
+
+	// RequestID correlates every log line about the request, including those from background syncs
+	RequestID string `json:"-"`
+
+	// Digests pins images, or wildcard image patterns, to the digests that their signatures were verified against
+	Digests map[string]string `json:"-"`
 }
 
 //goland:noinspection GoErrorStringFormat
@@ -18,19 +47,167 @@ var missingFieldError = errors.New("Nissing field")
 //goland:noinspection GoErrorStringFormat
 var invalidFieldError = errors.New("Invalid field")
 
-func (p webhookPayload) Validate() error {
+//goland:noinspection GoErrorStringFormat
+var unknownFieldError = errors.New("Unknown field")
+
+var errPayloadTooDeep = errors.New("payload is nested too deeply")
+
+func (p UpdateRequest) Validate() error {
 	if p.Deployment == "" {
 		return fmt.Errorf("%w: deployment", missingFieldError)
 	}
-	if p.TagName == "" {
+	if p.TagName == "" && len(p.Images) == 0 {
 		return fmt.Errorf("%w: tag_name", missingFieldError)
 	}
+	if p.TagName != "" && len(p.Images) > 0 {
+		return fmt.Errorf("%w: tag_name and images are mutually exclusive", invalidFieldError)
+	}
 	if p.AuthorizedBy == "" {
 		return fmt.Errorf("%w: authorized_by", missingFieldError)
 	}
 	if strings.Contains(p.TagName, " ") {
 		return fmt.Errorf("%w: tag_name", invalidFieldError)
 	}
+	for image, tag := range p.Images {
+		if image == "" || tag == "" || strings.Contains(tag, " ") {
+			return fmt.Errorf("%w: images", invalidFieldError)
+		}
+	}
+	if p.CallbackUrl != "" {
+		if callbackUrl, err := url.Parse(p.CallbackUrl); err != nil || (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") {
+			return fmt.Errorf("%w: callback_url", invalidFieldError)
+		}
+	}
+
+	return nil
+}
+
+// Tags describes the payload's new tag(s), for messages
+func (p UpdateRequest) Tags() string {
+	if len(p.Images) == 0 {
+		return p.TagName
+	}
+	images := make([]string, 0, len(p.Images))
+	for image := range p.Images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	parts := make([]string, 0, len(images))
+	for _, image := range images {
+		parts = append(parts, image+":"+p.Images[image])
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// tagSelector returns the new tag for an image, or false if it shouldn't be changed
+type tagSelector func(image string) (string, bool)
+
+func (p UpdateRequest) tagSelector() tagSelector {
+	if len(p.Images) == 0 {
+		return func(image string) (string, bool) {
+			return p.pinTag(image, p.TagName), true
+		}
+	}
+
+	return func(image string) (string, bool) {
+		tag, ok := p.Images[image]
+		return p.pinTag(image, tag), ok
+	}
+}
+
+// pinTag appends the image's verified digest to its tag, if it has one
+func (p UpdateRequest) pinTag(image string, tag string) string {
+	digest, ok := p.Digests[image]
+	if !ok {
+		for pattern, patternDigest := range p.Digests {
+			if fnmatch(pattern, image) {
+				digest, ok = patternDigest, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return tag
+	}
+
+	return tag + "@" + digest
+}
+
+// readPayload reads a request body, rejecting those which are too large or too deeply nested to decode safely
+func readPayload(req *http.Request, maxDepth int) ([]byte, *UpdateResponse) {
+	reject := func(code int, message string) ([]byte, *UpdateResponse) {
+		resp := newResponse(code, message)
+		return nil, &resp
+	}
+	payloadBytes, err := io.ReadAll(req.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return reject(http.StatusRequestEntityTooLarge, "Payload too large")
+	} else if err != nil {
+		log.WithError(err).Warn("Failed to read payload")
+		return reject(http.StatusInternalServerError, "Failed to read payload")
+	}
+	if err := checkJSONDepth(payloadBytes, maxDepth); err != nil {
+		return reject(http.StatusRequestEntityTooLarge, "Payload too deeply nested")
+	}
+
+	return payloadBytes, nil
+}
+
+// checkJSONDepth rejects documents nested more deeply than the limit, before they reach a decoder
+func checkJSONDepth(data []byte, maxDepth int) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '{' || b == '[':
+			if depth++; depth > maxDepth {
+				return errPayloadTooDeep
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+
+	return nil
+}
+
+// decodePayload strictly decodes the known fields of a payload, collecting any others as extras
+func decodePayload(payloadBytes []byte, payload *UpdateRequest) error {
+	strictErr, err := json.UnmarshalStrict(payloadBytes, payload, json.DisallowDuplicateFields)
+	if err != nil {
+		return err
+	}
+	if len(strictErr) > 0 {
+		return strictErr[0]
+	}
+
+	var allFields map[string]interface{}
+	if err := json.UnmarshalCaseSensitivePreserveInts(payloadBytes, &allFields); err != nil {
+		return err
+	}
+	for _, known := range []string{"deployment", "group", "tag_name", "authorized_by", "callback_url", "images", "repository_url", "repository_branch", "dry_run"} {
+		delete(allFields, known)
+	}
+	if len(allFields) == 0 {
+		return nil
+	}
+	payload.Extra = make(map[string]string, len(allFields))
+	for key, value := range allFields {
+		if strValue, ok := value.(string); ok {
+			payload.Extra[key] = strValue
+		} else {
+			return fmt.Errorf("%w: %s", invalidFieldError, key)
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,286 @@
+package pkgtest
+
+import (
+	"context"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/session"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	"github.com/argoproj/gitops-engine/pkg/sync/common"
+	"github.com/go-git/go-git/v5/plumbing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/watch"
+	"net"
+	"sync"
+	"testing"
+)
+
+// ArgoServer is a plaintext gRPC stand-in for ArgoCD's API, which syncs applications instantly
+type ArgoServer struct {
+	// Token is required of every request when set
+	Token string
+
+	listener     net.Listener
+	server       *grpc.Server
+	mutex        sync.Mutex
+	applications map[string]*argoApplication
+}
+
+type argoApplication struct {
+	app      *v1alpha1.Application
+	health   health.HealthStatusCode
+	failSync bool
+	canSync  bool
+	syncs    []*application.ApplicationSyncRequest
+	watchers []chan *v1alpha1.Application
+}
+
+// NewArgoServer starts an ArgoCD server, which is stopped when the test finishes
+func NewArgoServer(t testing.TB) *ArgoServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen for argocd: %v", err)
+	}
+	toRet := &ArgoServer{
+		listener:     listener,
+		server:       grpc.NewServer(),
+		applications: make(map[string]*argoApplication),
+	}
+	application.RegisterApplicationServiceServer(toRet.server, &argoApplications{server: toRet})
+	session.RegisterSessionServiceServer(toRet.server, &argoSessions{server: toRet})
+	go func() {
+		_ = toRet.server.Serve(listener)
+	}()
+	t.Cleanup(toRet.server.Stop)
+
+	return toRet
+}
+
+// Address returns the host and port to use as an argocd block's url, along with plaintext = true
+func (a *ArgoServer) Address() string {
+	return a.listener.Addr().String()
+}
+
+// AddApplication creates an application, which becomes healthy whenever it's synced
+func (a *ArgoServer) AddApplication(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	app := &v1alpha1.Application{}
+	app.Name = name
+	app.Status.Sync.Status = v1alpha1.SyncStatusCodeSynced
+	app.Status.Health.Status = health.HealthStatusHealthy
+	a.applications[name] = &argoApplication{app: app, health: health.HealthStatusHealthy, canSync: true}
+}
+
+// Follow makes an application notice each push to a branch, as ArgoCD would when polling the repository
+func (a *ArgoServer) Follow(git *GitServer, repository string, branch string, name string) {
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	git.OnPush(func(pushedTo string, ref plumbing.ReferenceName, hash plumbing.Hash) {
+		if pushedTo == repository && ref == branchRef {
+			a.SetRevision(name, hash.String())
+		}
+	})
+}
+
+// SetRevision marks an application as out of sync with a new revision
+func (a *ArgoServer) SetRevision(name string, revision string) {
+	a.update(name, func(app *argoApplication) {
+		app.app.Status.Sync.Revision = revision
+		app.app.Status.Sync.Status = v1alpha1.SyncStatusCodeOutOfSync
+	})
+}
+
+// SetHealth chooses the health which an application reaches after its next sync
+func (a *ArgoServer) SetHealth(name string, status health.HealthStatusCode) {
+	a.update(name, func(app *argoApplication) {
+		app.health = status
+	})
+}
+
+// SetSyncFailure chooses whether an application's next syncs are accepted but then fail
+func (a *ArgoServer) SetSyncFailure(name string, fail bool) {
+	a.update(name, func(app *argoApplication) {
+		app.failSync = fail
+	})
+}
+
+// SetSyncWindow chooses whether an application's sync windows allow syncing
+func (a *ArgoServer) SetSyncWindow(name string, open bool) {
+	a.update(name, func(app *argoApplication) {
+		app.canSync = open
+	})
+}
+
+// Application returns a copy of an application's current state
+func (a *ArgoServer) Application(name string) *v1alpha1.Application {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if app, ok := a.applications[name]; ok {
+		return app.app.DeepCopy()
+	}
+
+	return nil
+}
+
+// Syncs returns every sync requested for an application, oldest first
+func (a *ArgoServer) Syncs(name string) []*application.ApplicationSyncRequest {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if app, ok := a.applications[name]; ok {
+		return append([]*application.ApplicationSyncRequest(nil), app.syncs...)
+	}
+
+	return nil
+}
+
+// update changes an application, then tells anybody watching it
+func (a *ArgoServer) update(name string, change func(app *argoApplication)) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	app, ok := a.applications[name]
+	if !ok {
+		return false
+	}
+	change(app)
+	for _, watcher := range app.watchers {
+		select {
+		case watcher <- app.app.DeepCopy():
+		default:
+			// Watchers only need the latest state, so drop the stale one they haven't read yet
+			select {
+			case <-watcher:
+			default:
+			}
+			watcher <- app.app.DeepCopy()
+		}
+	}
+
+	return true
+}
+
+func (a *ArgoServer) authenticate(ctx context.Context) error {
+	if a.Token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if tokens := md.Get(apiclient.MetaDataTokenKey); len(tokens) == 0 || tokens[0] != a.Token {
+		return status.Error(codes.Unauthenticated, "invalid session")
+	}
+
+	return nil
+}
+
+// argoApplications implements the parts of the application service which the updater uses
+type argoApplications struct {
+	application.UnimplementedApplicationServiceServer
+	server *ArgoServer
+}
+
+func (s *argoApplications) Get(ctx context.Context, query *application.ApplicationQuery) (*v1alpha1.Application, error) {
+	if err := s.server.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	if app := s.server.Application(query.GetName()); app != nil {
+		return app, nil
+	}
+
+	return nil, status.Errorf(codes.NotFound, "application %s not found", query.GetName())
+}
+
+func (s *argoApplications) Watch(query *application.ApplicationQuery, stream application.ApplicationService_WatchServer) error {
+	if err := s.server.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	// Start with the current state, then follow each change
+	watcher := make(chan *v1alpha1.Application, 1)
+	s.server.mutex.Lock()
+	app, ok := s.server.applications[query.GetName()]
+	if ok {
+		app.watchers = append(app.watchers, watcher)
+		watcher <- app.app.DeepCopy()
+	}
+	s.server.mutex.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "application %s not found", query.GetName())
+	}
+	defer func() {
+		s.server.mutex.Lock()
+		defer s.server.mutex.Unlock()
+		for i, other := range app.watchers {
+			if other == watcher {
+				app.watchers = append(app.watchers[:i], app.watchers[i+1:]...)
+				break
+			}
+		}
+	}()
+	for {
+		select {
+		case state := <-watcher:
+			if err := stream.Send(&v1alpha1.ApplicationWatchEvent{Type: watch.Modified, Application: *state}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *argoApplications) GetApplicationSyncWindows(ctx context.Context, query *application.ApplicationSyncWindowsQuery) (*application.ApplicationSyncWindowsResponse, error) {
+	if err := s.server.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	s.server.mutex.Lock()
+	defer s.server.mutex.Unlock()
+	app, ok := s.server.applications[query.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "application %s not found", query.GetName())
+	}
+	canSync := app.canSync
+
+	return &application.ApplicationSyncWindowsResponse{CanSync: &canSync}, nil
+}
+
+// Sync completes immediately, leaving the application at the revision it last saw
+func (s *argoApplications) Sync(ctx context.Context, request *application.ApplicationSyncRequest) (*v1alpha1.Application, error) {
+	if err := s.server.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	ok := s.server.update(request.GetName(), func(app *argoApplication) {
+		app.syncs = append(app.syncs, request)
+		opState := &v1alpha1.OperationState{
+			Phase:      common.OperationSucceeded,
+			SyncResult: &v1alpha1.SyncOperationResult{Revision: app.app.Status.Sync.Revision},
+		}
+		if app.failSync {
+			opState.Phase, opState.Message = common.OperationFailed, "sync failed"
+		} else {
+			app.app.Status.Sync.Status = v1alpha1.SyncStatusCodeSynced
+			app.app.Status.Health.Status = app.health
+		}
+		app.app.Status.OperationState = opState
+	})
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "application %s not found", request.GetName())
+	}
+
+	return s.server.Application(request.GetName()), nil
+}
+
+// argoSessions lets the credential checker confirm that the token is accepted
+type argoSessions struct {
+	session.UnimplementedSessionServiceServer
+	server *ArgoServer
+}
+
+func (s *argoSessions) GetUserInfo(ctx context.Context, _ *session.GetUserInfoRequest) (*session.GetUserInfoResponse, error) {
+	if err := s.server.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	return &session.GetUserInfoResponse{LoggedIn: true, Username: "pkgtest"}, nil
+}
@@ -0,0 +1,378 @@
+package pkgtest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultBranch is the branch which new repositories are created on
+const DefaultBranch = "master"
+
+// PushHook is called after every reference which a push updates
+type PushHook func(repository string, ref plumbing.ReferenceName, hash plumbing.Hash)
+
+// GitServer serves in-memory repositories over git's smart HTTP protocol, so that fetches and pushes go
+// through the same transport as they would in production
+// NB: Shallow clones aren't supported, so repositories must not set clone_depth
+type GitServer struct {
+	// Username and Password are required of every request when set
+	Username string
+	Password string
+
+	server       *httptest.Server
+	git          transport.Transport
+	mutex        sync.Mutex
+	repositories map[string]*memory.Storage
+	hooks        []PushHook
+}
+
+// NewGitServer starts a git server, which is closed when the test finishes
+func NewGitServer(t testing.TB) *GitServer {
+	t.Helper()
+	toRet := &GitServer{repositories: make(map[string]*memory.Storage)}
+	toRet.git = server.NewServer(toRet)
+	toRet.server = httptest.NewServer(toRet)
+	t.Cleanup(toRet.server.Close)
+
+	return toRet
+}
+
+// URL returns the URL to clone a repository from
+func (g *GitServer) URL(name string) string {
+	return fmt.Sprintf("%s/%s.git", g.server.URL, name)
+}
+
+// OnPush registers a hook to be called whenever a push updates a reference
+func (g *GitServer) OnPush(hook PushHook) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.hooks = append(g.hooks, hook)
+}
+
+// CreateRepository creates a repository whose default branch holds the given files, returning its URL
+func (g *GitServer) CreateRepository(t testing.TB, name string, files map[string]string) string {
+	t.Helper()
+	storage := memory.NewStorage()
+	if _, err := git.Init(storage, memfs.New()); err != nil {
+		t.Fatalf("could not create repository %s: %v", name, err)
+	}
+	g.mutex.Lock()
+	g.repositories[name] = storage
+	g.mutex.Unlock()
+	g.Commit(t, name, DefaultBranch, "Initial commit", files)
+
+	return g.URL(name)
+}
+
+// Commit adds a commit to a branch, as if somebody else had pushed it, where empty contents delete a file
+func (g *GitServer) Commit(t testing.TB, name string, branch string, message string, files map[string]string) plumbing.Hash {
+	t.Helper()
+	storage := g.storage(t, name)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	// Check the branch out into a fresh worktree, as pushes will have moved it since the last commit
+	repo, err := git.Open(storage, memfs.New())
+	if err != nil {
+		t.Fatalf("could not open repository %s: %v", name, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("could not open worktree of %s: %v", name, err)
+	}
+	// Checking out moves HEAD, which clients see as the default branch, so put it back afterwards
+	head, err := storage.Reference(plumbing.HEAD)
+	if err != nil {
+		t.Fatalf("could not read HEAD of %s: %v", name, err)
+	}
+	defer func() {
+		_ = storage.SetReference(head)
+	}()
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	checkout := &git.CheckoutOptions{Branch: branchRef, Force: true}
+	if _, err := storage.Reference(branchRef); err != nil {
+		// New branches start from the default branch, unless there's nothing to start from
+		base, err := storer.ResolveReference(storage, plumbing.HEAD)
+		if err != nil {
+			checkout = nil
+		} else {
+			checkout.Hash, checkout.Create = base.Hash(), true
+		}
+	}
+	if checkout == nil {
+		err = storage.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRef))
+	} else {
+		err = wt.Checkout(checkout)
+	}
+	if err != nil {
+		t.Fatalf("could not check out %s in %s: %v", branch, name, err)
+	}
+	for path, contents := range files {
+		if contents == "" {
+			_ = wt.Filesystem.Remove(path)
+		} else if err := writeFile(wt, path, contents); err != nil {
+			t.Fatalf("could not write %s to %s: %v", path, name, err)
+		}
+	}
+	if err := wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		t.Fatalf("could not stage files in %s: %v", name, err)
+	}
+	signature := &object.Signature{Name: "pkgtest", Email: "pkgtest@localhost", When: time.Now()}
+	toRet, err := wt.Commit(message, &git.CommitOptions{Author: signature, AllowEmptyCommits: true})
+	if err != nil {
+		t.Fatalf("could not commit to %s: %v", name, err)
+	}
+
+	return toRet
+}
+
+func writeFile(wt *git.Worktree, path string, contents string) error {
+	file, err := wt.Filesystem.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(contents)); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Head returns the commit at the tip of a reference, such as refs/heads/master
+func (g *GitServer) Head(t testing.TB, name string, ref plumbing.ReferenceName) *object.Commit {
+	t.Helper()
+	storage := g.storage(t, name)
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	resolved, err := storer.ResolveReference(storage, ref)
+	if err != nil {
+		t.Fatalf("could not resolve %s in %s: %v", ref, name, err)
+	}
+	toRet, err := object.GetCommit(storage, resolved.Hash())
+	if err != nil {
+		t.Fatalf("could not read commit %s in %s: %v", resolved.Hash(), name, err)
+	}
+
+	return toRet
+}
+
+// ReadFile returns a file's contents at the tip of a branch
+func (g *GitServer) ReadFile(t testing.TB, name string, branch string, path string) string {
+	t.Helper()
+	commit := g.Head(t, name, plumbing.NewBranchReferenceName(branch))
+	file, err := commit.File(path)
+	if err != nil {
+		t.Fatalf("could not find %s at %s in %s: %v", path, branch, name, err)
+	}
+	toRet, err := file.Contents()
+	if err != nil {
+		t.Fatalf("could not read %s at %s in %s: %v", path, branch, name, err)
+	}
+
+	return toRet
+}
+
+func (g *GitServer) storage(t testing.TB, name string) *memory.Storage {
+	t.Helper()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	toRet, ok := g.repositories[name]
+	if !ok {
+		t.Fatalf("unknown repository: %s", name)
+	}
+
+	return toRet
+}
+
+// Load implements server.Loader, finding repositories by the path they're served from
+func (g *GitServer) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	toRet, ok := g.repositories[repositoryName(ep.Path)]
+	if !ok {
+		return nil, transport.ErrRepositoryNotFound
+	}
+
+	return toRet, nil
+}
+
+func repositoryName(path string) string {
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
+// ServeHTTP implements the smart HTTP protocol's reference discovery, upload-pack and receive-pack
+func (g *GitServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if g.Username != "" || g.Password != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != g.Username || password != g.Password {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="pkgtest"`)
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var err error
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/info/refs"):
+		err = g.advertiseReferences(resp, req)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/"+transport.UploadPackServiceName):
+		err = g.uploadPack(resp, req)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/"+transport.ReceivePackServiceName):
+		err = g.receivePack(resp, req)
+	default:
+		http.NotFound(resp, req)
+		return
+	}
+	if errors.Is(err, transport.ErrRepositoryNotFound) {
+		http.NotFound(resp, req)
+	} else if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func endpoint(req *http.Request, service string) *transport.Endpoint {
+	path := strings.TrimSuffix(req.URL.Path, "/info/refs")
+	path = strings.TrimSuffix(path, "/"+service)
+
+	return &transport.Endpoint{Protocol: "http", Host: req.Host, Path: path}
+}
+
+func (g *GitServer) advertiseReferences(resp http.ResponseWriter, req *http.Request) error {
+	service := req.URL.Query().Get("service")
+	var session interface {
+		AdvertisedReferences() (*packp.AdvRefs, error)
+	}
+	var err error
+	switch service {
+	case transport.UploadPackServiceName:
+		session, err = g.git.NewUploadPackSession(endpoint(req, service), nil)
+	case transport.ReceivePackServiceName:
+		session, err = g.git.NewReceivePackSession(endpoint(req, service), nil)
+	default:
+		http.Error(resp, "Only the smart protocol is supported", http.StatusForbidden)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	refs, err := session.AdvertisedReferences()
+	g.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	refs.Prefix = [][]byte{[]byte("# service=" + service), pktline.Flush}
+	resp.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	resp.Header().Set("Cache-Control", "no-cache")
+
+	return refs.Encode(resp)
+}
+
+func (g *GitServer) uploadPack(resp http.ResponseWriter, req *http.Request) error {
+	session, err := g.git.NewUploadPackSession(endpoint(req, transport.UploadPackServiceName), nil)
+	if err != nil {
+		return err
+	}
+	request := packp.NewUploadPackRequest()
+	if err := request.UploadRequest.Decode(req.Body); err != nil {
+		return fmt.Errorf("invalid upload-pack request: %w", err)
+	}
+	// NB: The haves follow the wants, and are terminated by done
+	scanner := pktline.NewScanner(req.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(string(scanner.Bytes()))
+		if line == "done" {
+			break
+		}
+		if strings.HasPrefix(line, "have ") {
+			request.Haves = append(request.Haves, plumbing.NewHash(strings.TrimPrefix(line, "have ")))
+		}
+	}
+	g.mutex.Lock()
+	result, err := session.UploadPack(req.Context(), request)
+	g.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	resp.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+
+	return result.Encode(resp)
+}
+
+func (g *GitServer) receivePack(resp http.ResponseWriter, req *http.Request) error {
+	ep := endpoint(req, transport.ReceivePackServiceName)
+	session, err := g.git.NewReceivePackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	request := packp.NewReferenceUpdateRequest()
+	if err := request.Decode(req.Body); err != nil {
+		return fmt.Errorf("invalid receive-pack request: %w", err)
+	}
+	name := repositoryName(ep.Path)
+	resp.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+
+	// Hold the lock throughout, so that updates are compare-and-swap like a real server's
+	g.mutex.Lock()
+	if report := g.rejectStale(name, request); report != nil {
+		g.mutex.Unlock()
+		_, _ = io.Copy(io.Discard, req.Body)
+		return report.Encode(resp)
+	}
+	report, err := session.ReceivePack(req.Context(), request)
+	hooks := g.hooks
+	g.mutex.Unlock()
+	if report == nil {
+		return err
+	}
+	if err == nil {
+		for _, command := range request.Commands {
+			for _, hook := range hooks {
+				hook(name, command.Name, command.New)
+			}
+		}
+	}
+
+	return report.Encode(resp)
+}
+
+// rejectStale reports a failure if any reference has moved since the pusher last saw it
+// NB: Must be called with the mutex held
+func (g *GitServer) rejectStale(name string, request *packp.ReferenceUpdateRequest) *packp.ReportStatus {
+	storage := g.repositories[name]
+	toRet := packp.NewReportStatus()
+	toRet.UnpackStatus = "ok"
+	stale := false
+	for _, command := range request.Commands {
+		status := "ok"
+		current, err := storage.Reference(command.Name)
+		if err == nil && current.Hash() != command.Old {
+			status, stale = "fetch first", true
+		} else if errors.Is(err, plumbing.ErrReferenceNotFound) && !command.Old.IsZero() {
+			status, stale = "fetch first", true
+		}
+		toRet.CommandStatuses = append(toRet.CommandStatuses, &packp.CommandStatus{ReferenceName: command.Name, Status: status})
+	}
+	if !stale {
+		return nil
+	}
+
+	return toRet
+}
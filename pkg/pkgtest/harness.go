@@ -0,0 +1,138 @@
+// Package pkgtest runs the updater against an in-process git server and ArgoCD, so that configs and
+// programs embedding the updater can be tested end-to-end:
+//
+//	git := pkgtest.NewGitServer(t)
+//	repoUrl := git.CreateRepository(t, "config", map[string]string{"app/kustomization.yaml": kustomization})
+//	argo := pkgtest.NewArgoServer(t)
+//	argo.AddApplication("app")
+//	argo.Follow(git, "config", pkgtest.DefaultBranch, "app")
+//	harness := pkgtest.NewHarness(t, config) // Which points at repoUrl and argo.Address()
+//	resp := harness.Update(t, pkg.UpdateRequest{Deployment: "app", TagName: "v2", AuthorizedBy: "ci"})
+//	job := harness.WaitForJob(t, resp.JobId, 10*time.Second)
+package pkgtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/predakanga/image-updater/pkg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// inProgress lists the job statuses which will change without anybody's intervention
+var inProgress = map[string]bool{
+	pkg.StatusQueued:  true,
+	pkg.StatusRunning: true,
+	pkg.StatusSyncing: true,
+}
+
+// Harness serves the webhook from a config, with every background consumer running
+type Harness struct {
+	Config pkg.Config
+	Server *pkg.WebhookServer
+
+	http *httptest.Server
+}
+
+// NewHarness starts the updater with the given HCL config, stopping it when the test finishes
+// NB: Listen addresses are ignored, as the webhook is served on a random port instead
+func NewHarness(t testing.TB, config string) *Harness {
+	t.Helper()
+	cfg, err := pkg.ParseConfig([]byte(config), "pkgtest.hcl")
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	server, err := pkg.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("could not create server: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.RunConsumers(ctx)
+	toRet := &Harness{Config: cfg, Server: server, http: httptest.NewServer(server.Handler())}
+	t.Cleanup(func() {
+		toRet.http.Close()
+		cancel()
+	})
+
+	return toRet
+}
+
+// URL returns the webhook's base URL
+func (h *Harness) URL() string {
+	return h.http.URL
+}
+
+// Update posts an update request to the webhook, as CI would
+func (h *Harness) Update(t testing.TB, payload pkg.UpdateRequest) pkg.UpdateResponse {
+	t.Helper()
+	// NB: Extra fields sit alongside the rest, rather than being nested
+	var body map[string]interface{}
+	payloadBytes, _ := json.Marshal(payload)
+	_ = json.Unmarshal(payloadBytes, &body)
+	for key, value := range payload.Extra {
+		body[key] = value
+	}
+	payloadBytes, _ = json.Marshal(body)
+
+	req, err := http.NewRequest(http.MethodPost, h.http.URL+"/", bytes.NewReader(payloadBytes))
+	if err != nil {
+		t.Fatalf("could not create update request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var toRet pkg.UpdateResponse
+	toRet.Code = h.do(t, req, &toRet)
+
+	return toRet
+}
+
+// Job returns the current state of a job
+func (h *Harness) Job(t testing.TB, id string) pkg.JobState {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.http.URL+"/jobs/"+id, nil)
+	if err != nil {
+		t.Fatalf("could not create job request: %v", err)
+	}
+	var toRet pkg.JobState
+	if code := h.do(t, req, &toRet); code != http.StatusOK {
+		t.Fatalf("could not fetch job %s: status %d", id, code)
+	}
+
+	return toRet
+}
+
+// WaitForJob polls a job until it's finished, failing the test if it takes longer than the timeout
+func (h *Harness) WaitForJob(t testing.TB, id string, timeout time.Duration) pkg.JobState {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		job := h.Job(t, id)
+		if !inProgress[job.Status] {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s was still %s after %s", id, job.Status, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// do sends a request with the webhook's key, decoding the JSON response and returning its status code
+func (h *Harness) do(t testing.TB, req *http.Request, out interface{}) int {
+	t.Helper()
+	if h.Config.SecretKey != "" {
+		req.Header.Set("X-Key", h.Config.SecretKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("could not decode response from %s: %v", req.URL.Path, err)
+	}
+
+	return resp.StatusCode
+}
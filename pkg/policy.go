@@ -0,0 +1,177 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	"sort"
+	"strings"
+)
+
+const policyTimeout = 60
+
+// expressionFunctions are available to expressions which are evaluated against payloads
+var expressionFunctions = map[string]function.Function{
+	"can":      tryfunc.CanFunc,
+	"try":      tryfunc.TryFunc,
+	"contains": stdlib.ContainsFunc,
+	"lookup":   stdlib.LookupFunc,
+	"lower":    stdlib.LowerFunc,
+	"regex":    stdlib.RegexFunc,
+	"upper":    stdlib.UpperFunc,
+}
+
+// Policy decides whether an update may be applied, by evaluating an expression over the payload
+// and/or by verifying the cosign signatures of the images being deployed
+type Policy struct {
+	expression hcl.Expression
+	cosignKey  crypto.PublicKey
+	references map[string]string
+	registry   *registryClient
+}
+
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	toRet := &Policy{references: cfg.ImageReferences}
+	if cfg.Expression != nil {
+		if value, diags := cfg.Expression.Value(nil); diags.HasErrors() || !value.IsNull() {
+			toRet.expression = cfg.Expression
+		}
+	}
+	if cfg.CosignPublicKey != "" {
+		key, err := parsePublicKey(cfg.CosignPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy cosign_public_key: %w", err)
+		}
+		toRet.cosignKey = key
+		toRet.registry = newRegistryClient(cfg.RegistryUsername, cfg.RegistryPassword)
+	}
+	if toRet.expression == nil && toRet.cosignKey == nil {
+		return nil, fmt.Errorf("policy needs an expression, a cosign_public_key, or both")
+	}
+
+	return toRet, nil
+}
+
+// payloadVariables exposes a payload to expressions
+func payloadVariables(payload UpdateRequest) map[string]cty.Value {
+	return map[string]cty.Value{
+		"deployment":    cty.StringVal(payload.Deployment),
+		"tag_name":      cty.StringVal(payload.TagName),
+		"images":        stringMapVal(payload.Images),
+		"authorized_by": cty.StringVal(payload.AuthorizedBy),
+		"extra":         stringMapVal(payload.Extra),
+	}
+}
+
+func stringMapVal(values map[string]string) cty.Value {
+	// NB: Empty maps have to be typed explicitly
+	if len(values) == 0 {
+		return cty.MapValEmpty(cty.String)
+	}
+	toRet := make(map[string]cty.Value, len(values))
+	for key, value := range values {
+		toRet[key] = cty.StringVal(value)
+	}
+
+	return cty.MapVal(toRet)
+}
+
+// evaluateBool evaluates an expression over the given variables, which must produce a boolean
+func evaluateBool(expression hcl.Expression, variables map[string]cty.Value) (bool, error) {
+	evalCtx := hcl.EvalContext{Variables: variables, Functions: expressionFunctions}
+	value, diags := expression.Value(&evalCtx)
+	if diags.HasErrors() {
+		return false, diags
+	}
+	if value.IsNull() || !value.IsKnown() || value.Type() != cty.Bool {
+		return false, fmt.Errorf("expression must evaluate to true or false")
+	}
+
+	return value.True(), nil
+}
+
+// evaluateString evaluates an expression over the given variables, which must produce a string
+func evaluateString(expression hcl.Expression, variables map[string]cty.Value) (string, error) {
+	evalCtx := hcl.EvalContext{Variables: variables, Functions: expressionFunctions}
+	value, diags := expression.Value(&evalCtx)
+	if diags.HasErrors() {
+		return "", diags
+	}
+	if value.IsNull() || !value.IsKnown() || value.Type() != cty.String {
+		return "", fmt.Errorf("expression must evaluate to a string")
+	}
+
+	return value.AsString(), nil
+}
+
+// Verify returns an error describing why the update may not be applied, if it may not
+// Otherwise, it returns the digest that each image's signature was verified against, keyed by image name
+func (p *Policy) Verify(ctx context.Context, deployment *Deployment, payload UpdateRequest) (map[string]string, error) {
+	if p.expression != nil {
+		allowed, err := evaluateBool(p.expression, payloadVariables(payload))
+		if err != nil {
+			return nil, fmt.Errorf("policy expression failed: %w", err)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("update is not allowed by policy")
+		}
+	}
+	if p.cosignKey == nil {
+		return nil, nil
+	}
+
+	// Verify every image which will actually be changed
+	newTag := payload.tagSelector()
+	images := p.verifiedImages(deployment, payload)
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images to verify, set image_references for wildcard images")
+	}
+	digests := make(map[string]string, len(images))
+	for _, name := range images {
+		tag, ok := newTag(name)
+		if !ok {
+			continue
+		}
+		reference := name
+		if override, ok := p.references[name]; ok {
+			reference = override
+		}
+		digest, err := verifyCosign(ctx, p.registry, p.cosignKey, reference, tag)
+		if err != nil {
+			return nil, fmt.Errorf("signature verification failed for %s:%s: %w", reference, tag, err)
+		}
+		digests[name] = digest
+	}
+
+	return digests, nil
+}
+
+// verifiedImages lists the names of the images whose signatures must be checked
+func (p *Policy) verifiedImages(deployment *Deployment, payload UpdateRequest) []string {
+	var toRet []string
+	if len(payload.Images) > 0 {
+		for name := range payload.Images {
+			toRet = append(toRet, name)
+		}
+	} else {
+		for _, name := range deployment.Images {
+			if !strings.ContainsRune(name, '*') {
+				toRet = append(toRet, name)
+			}
+		}
+		// Wildcard images can only be verified through an explicit reference
+		for name := range p.references {
+			if !contains(toRet, name) {
+				toRet = append(toRet, name)
+			}
+		}
+	}
+	sort.Strings(toRet)
+
+	return toRet
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"maps"
+)
+
+var prechecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "precheck",
+	Name:      "total",
+	Help:      "The number of updates checked against the last update before cloning, by result",
+}, []string{"result"})
+
+// alreadyApplied reports whether an update would set the same tags as the deployment's last update,
+// and nothing else has been pushed to the repository since, in which case there's no need to clone it
+// NB: Repeated webhook deliveries are common, and each clone is far more expensive than listing the remote
+func (s *WebhookServer) alreadyApplied(ctx context.Context, repo *Repository, deployment *Deployment, payload UpdateRequest) bool {
+	last, ok := s.state.LastUpdate(deployment.Name)
+	if !ok || !last.sameTags(payload) {
+		return false
+	}
+	head, err := repo.Head(ctx)
+	if err != nil {
+		prechecks.WithLabelValues("error").Inc()
+		log.WithError(err).WithField("deployment", deployment.Name).Debug("Could not list repository before cloning")
+		return false
+	}
+	if head != last.Revision {
+		prechecks.WithLabelValues("moved").Inc()
+		return false
+	}
+	prechecks.WithLabelValues("unchanged").Inc()
+
+	return true
+}
+
+// sameTags reports whether the update would set each image to the tag it was given by this entry
+// NB: Tags which now point to a different verified digest are a change, as the digest is written too
+func (e HistoryEntry) sameTags(payload UpdateRequest) bool {
+	if !maps.Equal(e.Digests, payload.Digests) {
+		return false
+	}
+	if len(payload.Images) == 0 {
+		return len(e.Images) == 0 && e.TagName == payload.TagName
+	}
+	for image, tag := range payload.Images {
+		expected := e.TagName
+		if len(e.Images) > 0 {
+			var ok bool
+			if expected, ok = e.Images[image]; !ok {
+				return false
+			}
+		}
+		if tag != expected {
+			return false
+		}
+	}
+
+	return true
+}
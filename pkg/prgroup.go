@@ -0,0 +1,273 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const prGroupFlushTimeout = 300
+
+// PRGroup collects updates to deployments with matching labels, and periodically proposes them
+// together as a single pull request rather than pushing them directly
+type PRGroup struct {
+	Name     string
+	labels   map[string]string
+	schedule cron.Schedule
+	branch   string
+	title    string
+	github   *githubClient
+	server   *WebhookServer
+
+	mutex   sync.Mutex
+	pending map[string]groupedUpdate
+	// included tracks what the open pull requests contain, by repository URL, for their descriptions
+	// NB: This is only kept in memory, so descriptions only cover updates since startup
+	included map[string]map[string]groupedUpdate
+}
+
+// groupedUpdate is an update waiting for, or included in, a group's pull request
+type groupedUpdate struct {
+	job        *Job
+	deployment *Deployment
+	payload    UpdateRequest
+}
+
+func NewPRGroup(cfg PRGroupConfig, server *WebhookServer) (*PRGroup, error) {
+	if len(cfg.MatchLabels) == 0 {
+		return nil, fmt.Errorf("pr_group %s has no match_labels", cfg.Name)
+	}
+	schedule, err := cron.ParseStandard(cfg.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pr_group schedule: %w", err)
+	}
+	toRet := &PRGroup{
+		Name:     cfg.Name,
+		labels:   cfg.MatchLabels,
+		schedule: schedule,
+		branch:   cfg.Branch,
+		title:    cfg.Title,
+		github:   newGithubClient(cfg.GithubApiUrl, cfg.GithubToken),
+		server:   server,
+		pending:  make(map[string]groupedUpdate),
+		included: make(map[string]map[string]groupedUpdate),
+	}
+	if toRet.branch == "" {
+		toRet.branch = "image-updater/" + cfg.Name
+	}
+	if toRet.title == "" {
+		toRet.title = fmt.Sprintf("Update images for %s", cfg.Name)
+	}
+
+	return toRet, nil
+}
+
+// Matches reports whether the deployment's labels include all of the group's
+func (g *PRGroup) Matches(deployment *Deployment) bool {
+	for key, value := range g.labels {
+		if deployment.Labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Enqueue holds an update until the group's next scheduled run
+// NB: Only the latest update for each deployment is kept
+func (g *PRGroup) Enqueue(job *Job, deployment *Deployment, payload UpdateRequest) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if superseded, ok := g.pending[deployment.Name]; ok {
+		g.server.resolveJob(superseded.job, superseded.deployment, superseded.payload, StatusUnchanged, "", fmt.Sprintf("Superseded by %s", payload.Tags()))
+	}
+	g.pending[deployment.Name] = groupedUpdate{job: job, deployment: deployment, payload: payload}
+	job.SetStatus(StatusQueued, "", fmt.Sprintf("Waiting for pull request group %s", g.Name))
+}
+
+// Run flushes the group on its schedule until the context is cancelled
+func (g *PRGroup) Run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(time.Until(g.schedule.Next(time.Now())))
+		select {
+		case <-timer.C:
+			g.flush(ctx)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (g *PRGroup) flush(ctx context.Context) {
+	g.mutex.Lock()
+	pending := g.pending
+	g.pending = make(map[string]groupedUpdate)
+	g.mutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	// Each repository needs its own pull request
+	byRepository := make(map[*Repository][]groupedUpdate)
+	for _, update := range pending {
+		repo, err := g.server.repositoryFor(update.deployment, update.payload)
+		if err != nil {
+			g.server.resolveJob(update.job, update.deployment, update.payload, StatusFailed, "", err.Error())
+			continue
+		}
+		byRepository[repo] = append(byRepository[repo], update)
+	}
+	ctx, cancel := context.WithTimeout(ctx, prGroupFlushTimeout*time.Second)
+	defer cancel()
+	for repo, updates := range byRepository {
+		sort.Slice(updates, func(i, j int) bool {
+			return updates[i].deployment.Name < updates[j].deployment.Name
+		})
+		g.flushRepository(ctx, repo, updates)
+	}
+}
+
+// flushRepository commits the updates to the group's branch, and opens or updates its pull request
+func (g *PRGroup) flushRepository(ctx context.Context, repo *Repository, updates []groupedUpdate) {
+	logData := log.Fields{"group": g.Name, "repository": repo.url, "branch": g.branch}
+	fail := func(err error) {
+		log.WithFields(logData).WithError(err).Warn("Failed to update pull request group")
+		for _, update := range updates {
+			g.server.resolveJob(update.job, update.deployment, update.payload, StatusFailed, "", err.Error())
+		}
+	}
+	owner, name, err := githubRepository(repo.url)
+	if err != nil {
+		fail(err)
+		return
+	}
+	pull, err := g.github.findOpenPullRequest(ctx, owner, name, g.branch)
+	if err != nil {
+		fail(fmt.Errorf("could not look up pull request: %w", err))
+		return
+	}
+
+	unlock := repo.Lock(nil)
+	defer unlock()
+	// Build on the open pull request if there is one, otherwise start afresh from the base branch
+	var checkout *Checkout
+	var details string
+	if pull != nil {
+		checkout, err, details = repo.FetchBranch(ctx, g.branch)
+	} else {
+		checkout, err, details = repo.Fetch(ctx)
+	}
+	if err != nil {
+		log.WithFields(logData).WithError(err).Debugf("Details: %s", details)
+		fail(fmt.Errorf("could not fetch repository: %w", err))
+		return
+	}
+	defer checkout.Close()
+	baseBranch, err := checkout.Branch()
+	if err != nil {
+		fail(err)
+		return
+	}
+	wt, err := checkout.Worktree()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// Each deployment gets its own commit on the branch
+	applied := make(map[string]ApplyResult)
+	var committed []groupedUpdate
+	for _, update := range updates {
+		result, err := update.deployment.Apply(wt, update.payload)
+		if errors.Is(err, errorNoModification) {
+			g.server.resolveJob(update.job, update.deployment, update.payload, StatusUnchanged, "", "No changes made")
+			continue
+		} else if err != nil {
+			log.WithFields(logData).WithField("deployment", update.deployment.Name).WithError(err).Warn("Failed to apply deployment")
+			g.server.resolveJob(update.job, update.deployment, update.payload, StatusFailed, "", err.Error())
+			continue
+		}
+		applied[update.deployment.Name] = result
+		committed = append(committed, update)
+	}
+	if len(committed) == 0 {
+		return
+	}
+	updates = committed
+	if err, details := checkout.PushBranch(ctx, g.branch, pull == nil); err != nil {
+		log.WithFields(logData).WithError(err).Debugf("Details: %s", details)
+		fail(err)
+		return
+	}
+
+	// Describe everything the pull request contains
+	g.mutex.Lock()
+	if pull == nil || g.included[repo.url] == nil {
+		g.included[repo.url] = make(map[string]groupedUpdate)
+	}
+	for _, update := range updates {
+		g.included[repo.url][update.deployment.Name] = update
+	}
+	body := g.describe(g.included[repo.url])
+	g.mutex.Unlock()
+	if pull == nil {
+		pull, err = g.github.createPullRequest(ctx, owner, name, g.title, g.branch, baseBranch, body)
+	} else {
+		err = g.github.updatePullRequest(ctx, owner, name, pull.Number, body)
+	}
+	if err != nil {
+		fail(fmt.Errorf("could not open pull request: %w", err))
+		return
+	}
+
+	log.WithFields(logData).Infof("Pull request #%d now includes %d update(s)", pull.Number, len(updates))
+	for _, update := range updates {
+		revision := applied[update.deployment.Name].Revision
+		if repo.scm != nil {
+			templateData := update.deployment.templateData(update.payload)
+			templateData["revision"] = revision
+			templateData["pull_request"] = pull.Number
+			templateData["pull_request_url"] = pull.HtmlUrl
+			repo.scm.commentOnPullRequest(ctx, repo.url, pull.Number, templateData)
+		}
+		g.server.resolveJob(update.job, update.deployment, update.payload, StatusUpdated, revision,
+			fmt.Sprintf("Included in pull request %s", pull.HtmlUrl))
+	}
+}
+
+// describe summarizes the updates in a pull request as a markdown table
+func (g *PRGroup) describe(included map[string]groupedUpdate) string {
+	names := make([]string, 0, len(included))
+	for name := range included {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	body := strings.Builder{}
+	body.WriteString(fmt.Sprintf("This pull request groups image updates for **%s**.\n\n", g.Name))
+	body.WriteString("| Deployment | Tag | Requested by |\n|---|---|---|\n")
+	for _, name := range names {
+		update := included[name]
+		body.WriteString(fmt.Sprintf("| %s | `%s` | %s |\n", name, update.payload.Tags(), update.payload.AuthorizedBy))
+	}
+
+	return body.String()
+}
+
+// prGroupFor returns the first pull request group which the deployment belongs to, if any
+func (s *WebhookServer) prGroupFor(deployment *Deployment) *PRGroup {
+	for _, group := range s.prGroups {
+		if group.Matches(deployment) {
+			return group
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 10
+
+// The longest possible PROXY protocol v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ClientIPHandler replaces the remote address with the client's, as reported by a trusted proxy
+// in X-Forwarded-For or X-Real-IP, so that the allowlist and logs see the real client
+func ClientIPHandler(handler http.Handler, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedClientIP(r, trusted); ip != nil {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client address reported by a trusted proxy, or nil if there isn't one
+// NB: X-Forwarded-For is read from the right, as only entries added by trusted proxies can be believed
+func forwardedClientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !ipAllowed(net.ParseIP(host), trusted) {
+		return nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var toRet net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(hops[i])
+		if ip == nil {
+			return nil
+		}
+		toRet = ip
+		if !ipAllowed(ip, trusted) {
+			return ip
+		}
+	}
+	if toRet != nil {
+		// Every hop was a trusted proxy, so the first of them is the client
+		return toRet
+	}
+
+	return parseForwardedIP(r.Header.Get("X-Real-IP"))
+}
+
+// parseForwardedIP parses an address from a forwarding header, which may include a port
+func parseForwardedIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+
+	return net.ParseIP(value)
+}
+
+// proxyListener expects every connection to start with a PROXY protocol header, as sent by load
+// balancers such as HAProxy or AWS NLBs, and reports the client address it contains
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyListener(listener net.Listener, trusted []*net.IPNet) net.Listener {
+	return proxyListener{Listener: listener, trusted: trusted}
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyConn{Conn: conn, trusted: l.trusted}, nil
+}
+
+// proxyConn reads the PROXY header when first used, which happens in the connection's own
+// goroutine, so that slow clients can't hold up Accept
+type proxyConn struct {
+	net.Conn
+	trusted []*net.IPNet
+	once    sync.Once
+	reader  *bufio.Reader
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		c.reader = bufio.NewReader(c.Conn)
+		// Only trusted proxies may tell us who they're speaking for, when any are configured
+		if len(c.trusted) > 0 {
+			if tcpAddr, ok := c.remote.(*net.TCPAddr); !ok || !ipAllowed(tcpAddr.IP, c.trusted) {
+				c.err = fmt.Errorf("PROXY header from untrusted address %s", c.remote)
+			}
+		}
+		if c.err == nil {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout * time.Second))
+			var remote net.Addr
+			if remote, c.err = readProxyHeader(c.reader); remote != nil {
+				c.remote = remote
+			}
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}
+		if c.err != nil {
+			log.WithError(c.err).WithField("address", c.Conn.RemoteAddr().String()).Warn("Rejected connection")
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+
+	return c.remote
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header, returning the client's address, or nil for
+// connections which the proxy made on its own behalf, such as health checks
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2Header(reader)
+	}
+
+	// Version 1 is a single line of text
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY header source")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", versionCommand>>4)
+	}
+	// The LOCAL command, and anything other than TCP, carries no client address
+	if versionCommand&0xf == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("truncated PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("truncated PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+
+	return nil, nil
+}
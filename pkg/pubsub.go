@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const pubSubEndpoint = "https://pubsub.googleapis.com/v1"
+const pubSubScope = "https://www.googleapis.com/auth/pubsub"
+const pubSubBatchSize = 10
+const pubSubRetryDelay = 10
+
+// garNotification is the payload published by Artifact Registry to the "gcr" topic
+type garNotification struct {
+	Action string `json:"action"`
+	Digest string `json:"digest"`
+	Tag    string `json:"tag"`
+}
+
+type pubSubMessage struct {
+	Data       string            `json:"data"`
+	MessageId  string            `json:"messageId"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type pubSubReceivedMessage struct {
+	AckId   string        `json:"ackId"`
+	Message pubSubMessage `json:"message"`
+}
+
+type PubSubConsumer struct {
+	subscription    string
+	credentialsFile string
+	client          *http.Client
+}
+
+func init() {
+	RegisterSource(func(cfg Config) (Source, error) {
+		if cfg.PubSub == nil {
+			return nil, nil
+		}
+		return NewPubSubConsumer(*cfg.PubSub), nil
+	})
+}
+
+func NewPubSubConsumer(cfg PubSubConfig) *PubSubConsumer {
+	return &PubSubConsumer{
+		subscription:    fmt.Sprintf("projects/%s/subscriptions/%s", cfg.Project, cfg.Subscription),
+		credentialsFile: cfg.CredentialsFile,
+	}
+}
+
+func (c *PubSubConsumer) Name() string {
+	return "pubsub"
+}
+
+// Run pulls notifications from the subscription until the context is cancelled
+func (c *PubSubConsumer) Run(ctx context.Context, pipeline Pipeline) {
+	logFields := log.Fields{"subscription": c.subscription}
+	if err := c.connect(ctx); err != nil {
+		log.WithError(err).WithFields(logFields).Error("Could not create Pub/Sub client")
+		return
+	}
+	log.WithFields(logFields).Info("Listening for Artifact Registry notifications")
+
+	for ctx.Err() == nil {
+		messages, err := c.pull(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.WithError(err).WithFields(logFields).Warn("Failed to pull Pub/Sub messages")
+			select {
+			case <-time.After(pubSubRetryDelay * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			if c.handle(pipeline, msg.Message) {
+				err = c.acknowledge(ctx, msg.AckId)
+			} else {
+				err = c.nack(ctx, msg.AckId)
+			}
+			if err != nil {
+				log.WithError(err).WithFields(logFields).Warn("Failed to acknowledge Pub/Sub message")
+			}
+		}
+	}
+}
+
+func (c *PubSubConsumer) connect(ctx context.Context) error {
+	var creds *google.Credentials
+	var err error
+	if c.credentialsFile != "" {
+		var credBytes []byte
+		if credBytes, err = os.ReadFile(c.credentialsFile); err != nil {
+			return fmt.Errorf("could not read credentials file: %w", err)
+		}
+		creds, err = google.CredentialsFromJSON(ctx, credBytes, pubSubScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, pubSubScope)
+	}
+	if err != nil {
+		return fmt.Errorf("could not load credentials: %w", err)
+	}
+
+	c.client = oauth2.NewClient(ctx, creds.TokenSource)
+	return nil
+}
+
+// handle processes a single notification, returning false if it should be redelivered
+func (c *PubSubConsumer) handle(pipeline Pipeline, msg pubSubMessage) bool {
+	logData := log.Fields{"message_id": msg.MessageId}
+
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		log.WithError(err).WithFields(logData).Warn("Failed to decode Pub/Sub message")
+		return true
+	}
+	var notification garNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		log.WithError(err).WithFields(logData).Warn("Failed to decode Artifact Registry notification")
+		return true
+	}
+	// Only newly tagged images are of interest
+	if notification.Action != "INSERT" || notification.Tag == "" {
+		return true
+	}
+	imageName, tagName, ok := splitImageTag(notification.Tag)
+	if !ok {
+		log.WithFields(logData).Warnf("Could not parse image reference: %s", notification.Tag)
+		return true
+	}
+	logData["image"] = imageName
+	logData["tag"] = tagName
+
+	// Every deployment using the image is updated, and each one validates the request its own way
+	success := true
+	for _, deployment := range pipeline.Deployments() {
+		if !matchImage(deployment.Images, imageName) {
+			continue
+		}
+		deployData := log.Fields{"deployment": deployment.Name}
+		for k, v := range logData {
+			deployData[k] = v
+		}
+		job, done := pipeline.Submit(c.Name(), UpdateRequest{
+			Deployment:   deployment.Name,
+			TagName:      tagName,
+			AuthorizedBy: "pubsub",
+		})
+		if job == nil {
+			rejection := <-done
+			log.WithFields(deployData).Warnf("Deployment cannot be triggered by Pub/Sub: %s", rejection.Message)
+			// Shed requests are redelivered once the repository has caught up
+			if rejection.Code == http.StatusServiceUnavailable {
+				success = false
+			}
+			continue
+		}
+		// Updates can outlive the subscription's ack deadline, so the message is acknowledged once the
+		// job is accepted, and its outcome is tracked by the job store instead
+		deployData["job_id"] = job.ID
+		go func() {
+			result := <-done
+			if result.Code >= http.StatusBadRequest {
+				log.WithFields(deployData).Warnf("Pub/Sub triggered update failed: %s", result.Message)
+			}
+		}()
+	}
+
+	return success
+}
+
+func (c *PubSubConsumer) pull(ctx context.Context) ([]pubSubReceivedMessage, error) {
+	var response struct {
+		ReceivedMessages []pubSubReceivedMessage `json:"receivedMessages"`
+	}
+	err := c.call(ctx, "pull", map[string]interface{}{"maxMessages": pubSubBatchSize}, &response)
+
+	return response.ReceivedMessages, err
+}
+
+func (c *PubSubConsumer) acknowledge(ctx context.Context, ackId string) error {
+	return c.call(ctx, "acknowledge", map[string]interface{}{"ackIds": []string{ackId}}, nil)
+}
+
+func (c *PubSubConsumer) nack(ctx context.Context, ackId string) error {
+	// Setting the deadline to zero makes the message immediately available for redelivery
+	return c.call(ctx, "modifyAckDeadline", map[string]interface{}{
+		"ackIds":             []string{ackId},
+		"ackDeadlineSeconds": 0,
+	}, nil)
+}
+
+func (c *PubSubConsumer) call(ctx context.Context, method string, body interface{}, out interface{}) error {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("could not encode request: %w", err)
+	}
+	url := fmt.Sprintf("%s/%s:%s", pubSubEndpoint, c.subscription, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBytes, out); err != nil {
+			return fmt.Errorf("could not decode response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// splitImageTag separates a full image reference into its name and tag
+func splitImageTag(ref string) (string, string, bool) {
+	idx := strings.LastIndex(ref, ":")
+	// The colon must come after the last slash, or it's a registry port
+	if idx == -1 || idx < strings.LastIndex(ref, "/") {
+		return "", "", false
+	}
+
+	return ref[:idx], ref[idx+1:], true
+}
@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+const reconcileTimeout = 120
+
+const reconcileUser = "image-updater (reconcile)"
+
+var (
+	driftDetected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "image_updater",
+		Subsystem: "reconcile",
+		Name:      "drifted",
+		Help:      "Whether a deployment's files no longer hold the tags it was last updated to",
+	}, []string{"deployment"})
+	reconcileRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "image_updater",
+		Subsystem: "reconcile",
+		Name:      "checks_total",
+		Help:      "The number of drift checks, by deployment and result",
+	}, []string{"deployment", "result"})
+)
+
+// Reconciler periodically compares each deployment's files with its last update, to catch tags
+// which have been edited by hand
+// NB: Only updates made since the server started are known, so other deployments are skipped
+type Reconciler struct {
+	interval time.Duration
+	reapply  bool
+	server   *WebhookServer
+	// drifting tracks which deployments have already been reported, so we only alert once
+	drifting map[string]bool
+}
+
+func NewReconciler(cfg ReconcileConfig, server *WebhookServer) (*Reconciler, error) {
+	interval, err := time.ParseDuration(cfg.Interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid reconcile interval: %s", cfg.Interval)
+	}
+
+	return &Reconciler{
+		interval: interval,
+		reapply:  cfg.Reapply,
+		server:   server,
+		drifting: make(map[string]bool),
+	}, nil
+}
+
+// Run checks every deployment at each interval until the context is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, deployment := range r.server.allDeployments() {
+			if ctx.Err() != nil {
+				return
+			}
+			r.check(ctx, deployment)
+		}
+	}
+}
+
+func (r *Reconciler) check(ctx context.Context, deployment *Deployment) {
+	last, ok := r.server.state.LastUpdate(deployment.Name)
+	if !ok {
+		return
+	}
+	logFields := log.Fields{"deployment": deployment.Name, "revision": last.Revision}
+	checkCtx, cancel := context.WithTimeout(ctx, reconcileTimeout*time.Second)
+	defer cancel()
+
+	current, drifted, err := r.server.detectDrift(checkCtx, deployment, last)
+	if err != nil {
+		if ctx.Err() == nil {
+			reconcileRuns.WithLabelValues(deployment.Name, "error").Inc()
+			log.WithError(err).WithFields(logFields).Warn("Drift check failed")
+		}
+		return
+	}
+	// An update may have landed while we were looking, in which case we'll check again next time
+	if latest, _ := r.server.state.LastUpdate(deployment.Name); latest.Revision != last.Revision {
+		return
+	}
+	publishDeployedTags(deployment, current)
+	if len(drifted) == 0 {
+		reconcileRuns.WithLabelValues(deployment.Name, "in_sync").Inc()
+		driftDetected.WithLabelValues(deployment.Name).Set(0)
+		if r.drifting[deployment.Name] {
+			log.WithFields(logFields).Info("Deployment is back in sync")
+			delete(r.drifting, deployment.Name)
+		}
+		return
+	}
+
+	reconcileRuns.WithLabelValues(deployment.Name, "drifted").Inc()
+	driftDetected.WithLabelValues(deployment.Name).Set(1)
+	log.WithFields(logFields).Warnf("Deployment has drifted: %s", strings.Join(drifted, ", "))
+	if !r.drifting[deployment.Name] {
+		r.drifting[deployment.Name] = true
+		r.server.notify(deployment, notification{
+			Event:   EventDriftDetected,
+			Message: fmt.Sprintf("Tags were changed outside of image-updater: %s", strings.Join(drifted, ", ")),
+			Payload: UpdateRequest{Deployment: deployment.Name, TagName: last.TagName, Images: last.Images},
+		})
+	}
+	if r.reapply {
+		request := UpdateRequest{Deployment: deployment.Name, AuthorizedBy: reconcileUser}
+		if len(last.Images) > 0 {
+			request.Images = last.Images
+		} else {
+			request.TagName = last.TagName
+		}
+		if job, _ := r.server.Submit("reconcile", request); job != nil {
+			log.WithFields(logFields).WithField("job_id", job.ID).Info("Reapplying last update")
+		}
+	}
+}
+
+// detectDrift reads the deployment's current tags, returning them along with a description of each
+// image whose tag differs from the given update
+func (s *WebhookServer) detectDrift(ctx context.Context, deployment *Deployment, last HistoryEntry) (imageTags, []string, error) {
+	repo, err := s.repositoryFor(deployment, UpdateRequest{})
+	if err != nil {
+		return nil, nil, err
+	}
+	checkout, err, _ := repo.Fetch(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch repository: %w", err)
+	}
+	defer checkout.Close()
+	worktree, err := checkout.Worktree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Applying a selector which never changes anything just reports the current tags
+	unchanged := func(string) (string, bool) {
+		return "", false
+	}
+	current := make(imageTags)
+	for _, target := range deployment.Targets {
+		targetImages, _, err := target.Apply(worktree, unchanged, mapset.NewThreadUnsafeSet[string]())
+		if err != nil {
+			return nil, nil, err
+		}
+		current.merge(targetImages)
+	}
+
+	var toRet []string
+	for name, tag := range current {
+		expected := last.TagName
+		if len(last.Images) > 0 {
+			var ok bool
+			if expected, ok = last.Images[name]; !ok {
+				continue
+			}
+		}
+		if tag != expected {
+			toRet = append(toRet, fmt.Sprintf("%s is %s rather than %s", name, tag, expected))
+		}
+	}
+	sort.Strings(toRet)
+
+	return current, toRet, nil
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/go-git/go-git/v5"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Replacement updates an image tag stored in a file that kustomize doesn't understand, such as
+// a JSON parameters file or a plain-text VERSION file
+//
+// The tag is located either with a regex, whose first capture group (or whole match, if it has
+// no groups) is replaced, with a JSON pointer to a string value, or with a Jsonnet key path.
+type Replacement struct {
+	Path  string
+	Image string
+	// locate returns the byte range of the tag within the file
+	locate func(contents []byte) (int, int, error)
+	// quoted is set when the tag lives inside a string literal, and so can't contain quotes
+	quoted bool
+}
+
+func newReplacement(path string, image string, defaultImage string) (*Replacement, error) {
+	toRet := &Replacement{Path: path, Image: image}
+	if toRet.Image == "" {
+		toRet.Image = defaultImage
+	}
+	if toRet.Image == "" || strings.ContainsRune(toRet.Image, '*') {
+		return nil, fmt.Errorf("%s must name a single image", path)
+	}
+
+	return toRet, nil
+}
+
+func NewReplacement(cfg ReplaceConfig, defaultImage string) (*Replacement, error) {
+	toRet, err := newReplacement(cfg.Path, cfg.Image, defaultImage)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.Regex != "" && cfg.Pointer != "":
+		return nil, fmt.Errorf("replace %s cannot have both a regex and a json_pointer", cfg.Path)
+	case cfg.Regex != "":
+		regex, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace %s regex: %w", cfg.Path, err)
+		}
+		toRet.locate = func(contents []byte) (int, int, error) {
+			return findRegex(contents, regex)
+		}
+	case cfg.Pointer != "":
+		pointer, err := parseJSONPointer(cfg.Pointer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replace %s json_pointer: %w", cfg.Path, err)
+		}
+		toRet.locate = func(contents []byte) (int, int, error) {
+			return findJSONString(contents, pointer)
+		}
+		toRet.quoted = true
+	default:
+		return nil, fmt.Errorf("replace %s needs either a regex or a json_pointer", cfg.Path)
+	}
+
+	return toRet, nil
+}
+
+func (r *Replacement) Paths() []string {
+	return []string{r.Path}
+}
+
+func (r *Replacement) Apply(worktree *git.Worktree, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	foundImages, changed, err := r.apply(worktree, newTag)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update %s: %w", r.Path, err)
+	}
+
+	return foundImages, changed, nil
+}
+
+func (r *Replacement) Validate(*git.Worktree, string) error {
+	// Replacements can target any format, so there's nothing in general to check
+	return nil
+}
+
+// apply replaces the tag in the file, returning the tag it had and whether the file changed
+func (r *Replacement) apply(worktree *git.Worktree, newTag tagSelector) (imageTags, bool, error) {
+	contents, err := readWorktreeFile(worktree, r.Path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read file: %w", err)
+	}
+	start, end, err := r.locate(contents)
+	if err != nil {
+		return nil, false, err
+	}
+
+	oldValue := string(contents[start:end])
+	foundImages := imageTags{r.Image: oldValue}
+	tag, ok := newTag(r.Image)
+	if !ok || tag == oldValue {
+		return foundImages, false, nil
+	}
+	if r.quoted && strings.ContainsAny(tag, "\"'\\\n") {
+		return nil, false, fmt.Errorf("tag %q cannot be written into a string", tag)
+	}
+
+	newContents := append(append(append([]byte(nil), contents[:start]...), tag...), contents[end:]...)
+	if err := writeWorktreeFile(worktree, r.Path, newContents); err != nil {
+		return nil, false, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return foundImages, true, nil
+}
+
+// findRegex locates the regex's first capture group, or its whole match
+func findRegex(contents []byte, regex *regexp.Regexp) (int, int, error) {
+	loc := regex.FindSubmatchIndex(contents)
+	if loc == nil {
+		return 0, 0, fmt.Errorf("regex %q does not match", regex.String())
+	}
+	if len(loc) > 2 {
+		if loc[2] < 0 {
+			return 0, 0, fmt.Errorf("regex %q matched without its capture group", regex.String())
+		}
+		return loc[2], loc[3], nil
+	}
+
+	return loc[0], loc[1], nil
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into its unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// jsonFrame tracks our position within an object or array while walking a JSON document
+type jsonFrame struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+// findJSONString returns the byte range of the string's contents at the pointer, so that it can
+// be replaced without disturbing the rest of the document's formatting
+func findJSONString(contents []byte, pointer []string) (int, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	var stack []*jsonFrame
+	for {
+		before := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, 0, fmt.Errorf("json pointer /%s not found", strings.Join(pointer, "/"))
+			}
+			return 0, 0, fmt.Errorf("failed to decode JSON: %w", err)
+		}
+
+		// Object keys only tell us where the next value lives
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.expectKey {
+				if key, ok := token.(string); ok {
+					top.key = key
+					top.expectKey = false
+					continue
+				}
+			}
+		}
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			advanceJSONFrame(stack)
+			continue
+		}
+
+		// We're at a value, so check whether its path is the one we're looking for
+		if jsonPathMatches(stack, pointer) {
+			value, ok := token.(string)
+			if !ok {
+				return 0, 0, fmt.Errorf("json pointer /%s is not a string", strings.Join(pointer, "/"))
+			}
+			// NB: Only separators and whitespace can precede the string's opening quote
+			start := int(before) + bytes.IndexByte(contents[before:], '"') + 1
+			end := int(decoder.InputOffset()) - 1
+			if string(contents[start:end]) != value {
+				return 0, 0, fmt.Errorf("json pointer /%s contains escaped characters", strings.Join(pointer, "/"))
+			}
+			return start, end, nil
+		}
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &jsonFrame{expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &jsonFrame{array: true})
+		default:
+			advanceJSONFrame(stack)
+		}
+	}
+}
+
+// advanceJSONFrame moves the innermost container past the value that just ended
+func advanceJSONFrame(stack []*jsonFrame) {
+	if len(stack) == 0 {
+		return
+	}
+	top := stack[len(stack)-1]
+	if top.array {
+		top.index++
+	} else {
+		top.expectKey = true
+	}
+}
+
+func jsonPathMatches(stack []*jsonFrame, pointer []string) bool {
+	if len(stack) != len(pointer) {
+		return false
+	}
+	for i, frame := range stack {
+		if frame.array {
+			if strconv.Itoa(frame.index) != pointer[i] {
+				return false
+			}
+		} else if frame.key != pointer[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -3,99 +3,549 @@ package pkg
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"github.com/go-git/go-billy/v5"
-	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/storage/memory"
+	log "github.com/sirupsen/logrus"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 )
 
+// How submodules are treated when cloning
+const (
+	SubmodulesSkip    = "skip"
+	SubmodulesRecurse = "recurse"
+)
+
 type Repository struct {
-	Mutex       sync.Mutex
 	url         string
+	mirrors     []string
+	pushMirrors bool
 	branch      string
+	ref         plumbing.ReferenceName // Fully qualified, and empty for the remote's default
+	pushRef     plumbing.ReferenceName // Empty to push back to ref
+	forcePush   bool
+	cloneDepth  int
+	submodules  bool
+	storage     string
+	maxSize     int64
+	transport   transportOptions
 	commitName  string
 	commitEmail string
-	username    string
-	password    string
-	storage     *memory.Storage
-	filesystem  billy.Filesystem
-	repository  *git.Repository
+	auth        http.AuthMethod
+	credentials *credentialCommand
+	locks       *pathLocks
+	scm         *SCM
+	// Only the timeouts set for this repository, which override the server's
+	timeouts Timeouts
+}
+
+// Checkout is a private clone of a repository, so that updates to separate paths can proceed concurrently
+type Checkout struct {
+	parent     *Repository
+	repository *git.Repository
+	release    func()
+	closeOnce  sync.Once
 }
 
-func NewRepository(cfg RepositoryConfig) *Repository {
+func NewRepository(cfg RepositoryConfig) (*Repository, error) {
+	timeouts, err := parseTimeouts(cfg.Timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	if err := validateCloneOptions(cfg.CloneDepth, cfg.Submodules); err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	if err := validateStorage(cfg.Storage, cfg.MaxSize); err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	// Credentials from a command are only known once it has run
+	credentials, err := newCredentialCommand(cfg.CredentialCommand, cfg.Username, cfg.Password, cfg.Token, cfg.TokenScheme, cfg.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	var auth http.AuthMethod
+	if credentials == nil {
+		if auth, err = newRepositoryAuth(cfg.Username, cfg.Password, cfg.Token, cfg.TokenScheme, cfg.Headers); err != nil {
+			return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+		}
+	}
+	transportOpts, err := newTransportOptions(cfg.ProxyUrl, cfg.CACert, cfg.CAFile, cfg.InsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	ref, pushRef, err := validateRefs(cfg.Branch, cfg.Ref, cfg.PushRef, cfg.ForcePush)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+	}
+	var scm *SCM
+	if cfg.SCM != nil {
+		if scm, err = NewSCM(*cfg.SCM); err != nil {
+			return nil, fmt.Errorf("repository %s: %w", cfg.Name, err)
+		}
+	}
+
 	return &Repository{
 		url:         cfg.Url,
+		mirrors:     cfg.Mirrors,
+		pushMirrors: cfg.PushMirrors,
 		branch:      cfg.Branch,
+		ref:         ref,
+		pushRef:     pushRef,
+		forcePush:   cfg.ForcePush,
+		cloneDepth:  cfg.CloneDepth,
+		submodules:  cfg.Submodules == SubmodulesRecurse,
+		storage:     cfg.Storage,
+		maxSize:     int64(cfg.MaxSize) << 20,
+		transport:   transportOpts,
 		commitName:  cfg.CommitterName,
 		commitEmail: cfg.CommitterEmail,
-		username:    cfg.Username,
-		password:    cfg.Password,
-		storage:     nil,
-		filesystem:  nil,
+		auth:        auth,
+		credentials: credentials,
+		locks:       newPathLocks(),
+		scm:         scm,
+		timeouts:    timeouts,
+	}, nil
+}
+
+// validateRefs returns the refs to fetch and push, where the branch is shorthand for a ref under refs/heads
+func validateRefs(branch string, ref string, pushRef string, force bool) (plumbing.ReferenceName, plumbing.ReferenceName, error) {
+	fetchRef := plumbing.ReferenceName(ref)
+	if branch != "" {
+		if ref != "" {
+			return "", "", fmt.Errorf("branch and ref cannot both be set")
+		}
+		fetchRef = plumbing.NewBranchReferenceName(branch)
+	}
+	for _, name := range []string{ref, pushRef} {
+		if name != "" && (!strings.HasPrefix(name, "refs/") || strings.ContainsAny(name, " ~^:?*[\\") || strings.HasSuffix(name, "/")) {
+			return "", "", fmt.Errorf("invalid ref %q, expected a fully qualified ref such as refs/heads/main", name)
+		}
+	}
+	// Tags can't be fast-forwarded, so moving one always overwrites it
+	target := plumbing.ReferenceName(pushRef)
+	if target == "" {
+		target = fetchRef
+	}
+	if target.IsTag() && !force {
+		return "", "", fmt.Errorf("tags can only be pushed to with force_push")
 	}
+
+	return fetchRef, plumbing.ReferenceName(pushRef), nil
 }
 
-func (r *Repository) Discard() {
-	r.storage = nil
-	r.filesystem = nil
+func validateCloneOptions(depth int, submodules string) error {
+	if depth < 0 {
+		return fmt.Errorf("clone_depth cannot be negative")
+	}
+	switch submodules {
+	case "", SubmodulesSkip, SubmodulesRecurse:
+		return nil
+	default:
+		return fmt.Errorf("invalid submodules: %s", submodules)
+	}
 }
 
-func (r *Repository) Fetch(ctx context.Context) (error, string) {
-	// Create a fresh set of storage
-	r.storage = memory.NewStorage()
-	r.filesystem = memfs.New()
+// headerAuth authenticates with a token or arbitrary headers, for servers and proxies which
+// won't accept basic auth
+type headerAuth struct {
+	basic         *http.BasicAuth
+	authorization string
+	headers       map[string]string
+}
 
+func newRepositoryAuth(username string, password string, token string, tokenScheme string, headers map[string]string) (http.AuthMethod, error) {
+	basic := &http.BasicAuth{Username: username, Password: password}
+	if token == "" && len(headers) == 0 {
+		return basic, nil
+	}
+	if token != "" && (username != "" || password != "") {
+		return nil, fmt.Errorf("token cannot be combined with a username or password")
+	}
+	if tokenScheme != "" && token == "" {
+		return nil, fmt.Errorf("token_scheme requires a token")
+	}
+	toRet := &headerAuth{headers: headers}
+	if token != "" {
+		if tokenScheme == "" {
+			tokenScheme = "Bearer"
+		}
+		toRet.authorization = tokenScheme + " " + token
+	} else if username != "" || password != "" {
+		toRet.basic = basic
+	}
+
+	return toRet, nil
+}
+
+func (a *headerAuth) Name() string {
+	return "http-header-auth"
+}
+
+// String describes the method without revealing any credentials
+func (a *headerAuth) String() string {
+	names := make([]string, 0, len(a.headers))
+	for name := range a.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("%s - %s", a.Name(), strings.Join(names, ", "))
+}
+
+func (a *headerAuth) SetAuth(r *nethttp.Request) {
+	if a.basic != nil {
+		a.basic.SetAuth(r)
+	}
+	if a.authorization != "" {
+		r.Header.Set("Authorization", a.authorization)
+	}
+	for name, value := range a.headers {
+		r.Header.Set(name, value)
+	}
+}
+
+// transportOptions configures how a repository's HTTPS connections are made
+type transportOptions struct {
+	caBundle []byte
+	insecure bool
+	proxy    transport.ProxyOptions
+}
+
+func newTransportOptions(proxyUrl string, caCert string, caFile string, insecure bool) (transportOptions, error) {
+	toRet := transportOptions{insecure: insecure}
+	if caCert != "" && caFile != "" {
+		return toRet, fmt.Errorf("ca_cert and ca_file cannot both be set")
+	}
+	if caFile != "" {
+		contents, err := os.ReadFile(caFile)
+		if err != nil {
+			return toRet, fmt.Errorf("could not read ca_file: %w", err)
+		}
+		caCert = string(contents)
+	}
+	if caCert != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(caCert)) {
+			return toRet, fmt.Errorf("ca_cert contains no PEM certificates")
+		}
+		toRet.caBundle = []byte(caCert)
+	}
+	if proxyUrl != "" {
+		parsed, err := url.Parse(proxyUrl)
+		if err != nil || parsed.Host == "" {
+			return toRet, fmt.Errorf("invalid proxy_url")
+		}
+		// go-git takes the proxy's credentials separately
+		if parsed.User != nil {
+			toRet.proxy.Username = parsed.User.Username()
+			toRet.proxy.Password, _ = parsed.User.Password()
+			parsed.User = nil
+		}
+		toRet.proxy.URL = parsed.String()
+	}
+
+	return toRet, nil
+}
+
+// Lock waits until no other update holds an overlapping path, then holds the paths until unlocked
+func (r *Repository) Lock(paths []string) func() {
+	return r.locks.lock(paths)
+}
+
+// Locked reports whether any update currently holds part of the repository
+func (r *Repository) Locked() bool {
+	return r.locks.held()
+}
+
+func (r *Repository) Fetch(ctx context.Context) (*Checkout, error, string) {
+	return r.fetchRef(ctx, r.ref)
+}
+
+// FetchBranch checks out a branch other than the configured one, or the remote's default if empty
+func (r *Repository) FetchBranch(ctx context.Context, branch string) (*Checkout, error, string) {
+	var ref plumbing.ReferenceName
+	if branch != "" {
+		ref = plumbing.NewBranchReferenceName(branch)
+	}
+
+	return r.fetchRef(ctx, ref)
+}
+
+// fetchRef checks out a fully qualified ref, or the remote's default if empty
+// NB: Each mirror is tried in turn if the primary URL can't be fetched from
+func (r *Repository) fetchRef(ctx context.Context, ref plumbing.ReferenceName) (*Checkout, error, string) {
+	var errs []error
+	var details string
+	for _, repoUrl := range append([]string{r.url}, r.mirrors...) {
+		checkout, err, fetchDetails := r.fetchFrom(ctx, repoUrl, ref)
+		if err == nil {
+			if len(errs) > 0 {
+				log.WithError(errors.Join(errs...)).WithField("mirror", repoUrl).Warn("Fetched repository from a mirror")
+			}
+			return checkout, nil, ""
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", repoUrl, err))
+		details += fetchDetails
+		// There's no point trying the mirrors once we've run out of time, or if the repository is too large
+		if ctx.Err() != nil || errors.Is(err, errCheckoutTooLarge) {
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0]), details
+	}
+
+	return nil, errors.Join(errs...), details
+}
+
+func (r *Repository) fetchFrom(ctx context.Context, repoUrl string, ref plumbing.ReferenceName) (*Checkout, error, string) {
+	// Each checkout gets a fresh set of storage
+	var storage *checkoutStorage
+	if r.storage == StorageDisk {
+		var err error
+		if storage, err = newDiskStorage(); err != nil {
+			return nil, err, ""
+		}
+	} else {
+		storage = newMemoryStorage(r.maxSize)
+	}
+	checkout, err, details := r.clone(ctx, storage, repoUrl, ref)
+	if !errors.Is(err, errCheckoutTooLarge) {
+		return checkout, err, details
+	}
+	if r.storage != StorageAuto {
+		oversizedCheckouts.WithLabelValues("rejected").Inc()
+		return nil, err, details
+	}
+
+	// Start over on disk, where only the disk's size limits us
+	oversizedCheckouts.WithLabelValues("disk").Inc()
+	log.WithError(err).WithField("url", repoUrl).Info("Cloning repository to disk instead")
+	if storage, err = newDiskStorage(); err != nil {
+		return nil, err, ""
+	}
+
+	return r.clone(ctx, storage, repoUrl, ref)
+}
+
+// clone fetches into the given storage, which is released if the clone fails
+func (r *Repository) clone(ctx context.Context, storage *checkoutStorage, repoUrl string, ref plumbing.ReferenceName) (*Checkout, error, string) {
+	auth, err := r.authMethod(ctx, repoUrl)
+	if err != nil {
+		storage.release()
+		return nil, err, ""
+	}
 	// Actually perform the fetch
 	buf := bytes.Buffer{}
 	opts := git.CloneOptions{
-		URL: r.url,
-		Auth: &http.BasicAuth{
-			Username: r.username,
-			Password: r.password,
-		},
+		URL:      repoUrl,
+		Auth:     auth,
 		Progress: &buf,
 		Tags:     git.NoTags,
+		Depth:    r.cloneDepth,
+
+		CABundle:        r.transport.caBundle,
+		InsecureSkipTLS: r.transport.insecure,
+		ProxyOptions:    r.transport.proxy,
+	}
+	// NB: Submodules can't be updated, but their contents may be needed to validate the deployment
+	if r.submodules {
+		opts.RecurseSubmodules = git.DefaultSubmoduleRecursionDepth
+		opts.ShallowSubmodules = r.cloneDepth > 0
 	}
-	if r.branch != "" {
-		opts.ReferenceName = plumbing.NewBranchReferenceName(r.branch)
+	if ref != "" {
+		opts.ReferenceName = ref
 		opts.SingleBranch = true
 	}
-	if repo, err := git.CloneContext(ctx, r.storage, r.filesystem, &opts); err == nil {
-		r.repository = repo
-	} else {
-		return err, buf.String()
+	repo, err := git.CloneContext(ctx, storage.storer, storage.filesystem, &opts)
+	if err != nil {
+		storage.release()
+		return nil, err, buf.String()
 	}
 
 	// Configure the committer details
-	if cfg, err := r.repository.Config(); err != nil {
-		return fmt.Errorf("configuring repository failed: %w", err), ""
+	if cfg, err := repo.Config(); err != nil {
+		storage.release()
+		return nil, fmt.Errorf("configuring repository failed: %w", err), ""
 	} else {
 		cfg.Author.Name = r.commitName
 		cfg.Author.Email = r.commitEmail
-		if err := r.repository.SetConfig(cfg); err != nil {
-			return fmt.Errorf("configuring repository failed: %w", err), ""
+		if err := repo.SetConfig(cfg); err != nil {
+			storage.release()
+			return nil, fmt.Errorf("configuring repository failed: %w", err), ""
 		}
 	}
 
-	return nil, ""
+	return &Checkout{parent: r, repository: repo, release: storage.release}, nil, ""
+}
+
+// authMethod returns the credentials for a fetch or push, running the credential command if there is one
+func (r *Repository) authMethod(ctx context.Context, repoUrl string) (http.AuthMethod, error) {
+	if r.credentials == nil {
+		return r.auth, nil
+	}
+
+	return r.credentials.authMethod(ctx, repoUrl)
+}
+
+// Check verifies that the repository is reachable with the configured credentials
+func (r *Repository) Check(ctx context.Context) error {
+	_, err := r.listRefs(ctx)
+
+	return err
+}
+
+// Head returns the commit at the tip of the ref that updates are pushed to, without cloning the repository
+func (r *Repository) Head(ctx context.Context) (string, error) {
+	refs, err := r.listRefs(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Without a ref, we follow the remote's default like a clone would
+	name := plumbing.HEAD
+	if r.pushRef != "" {
+		name = r.pushRef
+	} else if r.ref != "" {
+		name = r.ref
+	}
+	for depth := 0; depth < 2; depth++ {
+		var target *plumbing.Reference
+		for _, ref := range refs {
+			if ref.Name() == name {
+				target = ref
+				break
+			}
+		}
+		if target == nil {
+			break
+		}
+		if target.Type() == plumbing.HashReference {
+			return target.Hash().String(), nil
+		}
+		name = target.Target()
+	}
+
+	return "", fmt.Errorf("could not resolve %s", name)
+}
+
+// listRefs lists the primary remote's references, as git ls-remote would
+func (r *Repository) listRefs(ctx context.Context) ([]*plumbing.Reference, error) {
+	auth, err := r.authMethod(ctx, r.url)
+	if err != nil {
+		return nil, err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{r.url},
+	})
+
+	return remote.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		CABundle:        r.transport.caBundle,
+		InsecureSkipTLS: r.transport.insecure,
+		ProxyOptions:    r.transport.proxy,
+	})
+}
+
+// Close frees the checkout's storage, after which it can no longer be used
+func (c *Checkout) Close() {
+	c.closeOnce.Do(c.release)
+}
+
+func (c *Checkout) Worktree() (*git.Worktree, error) {
+	return c.repository.Worktree()
+}
+
+// Push sends the update back to the ref it was fetched from, or the configured push_ref
+// NB: Fully qualified refs are pushed explicitly, as the checkout may not be on a branch at all
+func (c *Checkout) Push(ctx context.Context) (error, string) {
+	target := c.parent.pushRef
+	if target == "" && c.parent.branch == "" {
+		target = c.parent.ref
+	}
+	if target == "" {
+		return c.push(ctx, nil)
+	}
+	head, err := c.repository.Head()
+	if err != nil {
+		return fmt.Errorf("could not resolve HEAD: %w", err), ""
+	}
+	refSpec := config.RefSpec(fmt.Sprintf("%s:%s", head.Name(), target))
+	if c.parent.forcePush {
+		refSpec = "+" + refSpec
+	}
+
+	return c.push(ctx, []config.RefSpec{refSpec})
+}
+
+// PushBranch pushes the checked out branch to a different remote branch, optionally overwriting it
+func (c *Checkout) PushBranch(ctx context.Context, branch string, force bool) (error, string) {
+	head, err := c.repository.Head()
+	if err != nil {
+		return fmt.Errorf("could not resolve HEAD: %w", err), ""
+	}
+	refSpec := config.RefSpec(fmt.Sprintf("%s:%s", head.Name(), plumbing.NewBranchReferenceName(branch)))
+	if force {
+		refSpec = "+" + refSpec
+	}
+
+	return c.push(ctx, []config.RefSpec{refSpec})
+}
+
+// Branch returns the name of the checked out branch
+func (c *Checkout) Branch() (string, error) {
+	head, err := c.repository.Head()
+	if err != nil {
+		return "", fmt.Errorf("could not resolve HEAD: %w", err)
+	}
+
+	return head.Name().Short(), nil
 }
 
-func (r *Repository) Worktree() (*git.Worktree, error) {
-	return r.repository.Worktree()
+// push always goes to the primary URL, even if the checkout came from a mirror, and then to the
+// mirrors if enabled
+// NB: Mirrors are best effort, as they may well be catching up with the primary by themselves
+func (c *Checkout) push(ctx context.Context, refSpecs []config.RefSpec) (error, string) {
+	err, details := c.pushTo(ctx, c.parent.url, refSpecs)
+	if err != nil || !c.parent.pushMirrors {
+		return err, details
+	}
+	for _, mirror := range c.parent.mirrors {
+		if err, details := c.pushTo(ctx, mirror, refSpecs); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			log.WithError(err).WithField("mirror", mirror).Warn("Failed to push to mirror")
+			log.WithError(err).WithField("mirror", mirror).Debugf("Details: %s", details)
+		}
+	}
+
+	return nil, ""
 }
 
-func (r *Repository) Push(ctx context.Context) (error, string) {
+func (c *Checkout) pushTo(ctx context.Context, repoUrl string, refSpecs []config.RefSpec) (error, string) {
+	auth, err := c.parent.authMethod(ctx, repoUrl)
+	if err != nil {
+		return err, ""
+	}
 	buf := bytes.Buffer{}
-	err := r.repository.PushContext(ctx, &git.PushOptions{
-		Auth: &http.BasicAuth{
-			Username: r.username,
-			Password: r.password,
-		},
-		Progress: &buf,
+	err = c.repository.PushContext(ctx, &git.PushOptions{
+		RemoteURL: repoUrl,
+		Auth:      auth,
+		RefSpecs:  refSpecs,
+		Progress:  &buf,
+
+		CABundle:        c.parent.transport.caBundle,
+		InsecureSkipTLS: c.parent.transport.insecure,
+		ProxyOptions:    c.parent.transport.proxy,
 	})
 	if err != nil {
 		return fmt.Errorf("push failed: %w", err), buf.String()
@@ -103,3 +553,91 @@ func (r *Repository) Push(ctx context.Context) (error, string) {
 
 	return nil, ""
 }
+
+// isPushConflict reports whether a push failed because the branch moved on since it was fetched
+// NB: go-git doesn't expose a sentinel for this, whether detected locally or reported by the server
+func isPushConflict(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "non-fast-forward") || strings.Contains(message, "fetch first")
+}
+
+// pathLocks tracks which sets of paths within a repository are in use
+// NB: An empty set of paths covers the whole repository
+type pathLocks struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	sets  map[int][]string
+	next  int
+}
+
+func newPathLocks() *pathLocks {
+	toRet := &pathLocks{sets: make(map[int][]string)}
+	toRet.cond = sync.NewCond(&toRet.mutex)
+
+	return toRet
+}
+
+func (l *pathLocks) lock(paths []string) func() {
+	cleaned := cleanPaths(paths)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.conflicts(cleaned) {
+		l.cond.Wait()
+	}
+	id := l.next
+	l.next++
+	l.sets[id] = cleaned
+
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		delete(l.sets, id)
+		l.cond.Broadcast()
+	}
+}
+
+// cleanPaths makes paths absolute within the repository, so that they can be compared
+func cleanPaths(paths []string) []string {
+	toRet := make([]string, 0, len(paths))
+	for _, p := range paths {
+		toRet = append(toRet, path.Clean("/"+p))
+	}
+
+	return toRet
+}
+
+// conflicts reports whether any held set overlaps with the paths
+// NB: Must be called with the mutex held
+func (l *pathLocks) conflicts(paths []string) bool {
+	for _, held := range l.sets {
+		if len(held) == 0 || len(paths) == 0 {
+			return true
+		}
+		for _, heldPath := range held {
+			for _, p := range paths {
+				if pathsOverlap(heldPath, p) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func (l *pathLocks) held() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.sets) > 0
+}
+
+// pathsOverlap reports whether two cleaned paths are the same, or one contains the other
+// NB: The root contains everything, such as the base of a pattern starting with a wildcard
+func pathsOverlap(a string, b string) bool {
+	if a == "/" || b == "/" {
+		return true
+	}
+
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestPathLocksConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		held  [][]string
+		paths []string
+		want  bool
+	}{
+		{"nothing held", nil, []string{"app"}, false},
+		{"same path", [][]string{{"app"}}, []string{"app"}, true},
+		{"child path", [][]string{{"app"}}, []string{"app/kustomization.yaml"}, true},
+		{"parent path", [][]string{{"app/overlays/prod"}}, []string{"app"}, true},
+		{"sibling path", [][]string{{"app/overlays/prod"}}, []string{"app/overlays/staging"}, false},
+		{"prefix but not child", [][]string{{"app"}}, []string{"apps"}, false},
+		{"any of several paths", [][]string{{"one", "two"}}, []string{"three", "two/file.yaml"}, true},
+		{"whole repository held", [][]string{{}}, []string{"app"}, true},
+		{"whole repository wanted", [][]string{{"app"}}, nil, true},
+		{"root held", [][]string{{""}}, []string{"apps/x"}, true},
+		{"root wanted", [][]string{{"apps/x"}}, []string{""}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locks := newPathLocks()
+			for _, held := range test.held {
+				locks.lock(held)
+			}
+			if got := locks.conflicts(cleanPaths(test.paths)); got != test.want {
+				t.Errorf("conflicts(%v) with %v held = %v, want %v", test.paths, test.held, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want bool
+	}{
+		{"/app", "/app", true},
+		{"/app", "/app/kustomization.yaml", true},
+		{"/app/kustomization.yaml", "/app", true},
+		{"/app", "/apps", false},
+		{"/apps/one", "/apps/two", false},
+		{"/", "/apps/x", true},
+		{"/apps/x", "/", true},
+		{"/", "/", true},
+	}
+	for _, test := range tests {
+		if got := pathsOverlap(test.a, test.b); got != test.want {
+			t.Errorf("pathsOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
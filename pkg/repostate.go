@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"os"
+	"time"
+)
+
+// RepoStateEntry is a deployment's state, as committed to its repository
+type RepoStateEntry struct {
+	LastTag        string            `json:"last_tag,omitempty"`
+	LastImages     map[string]string `json:"last_images,omitempty"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	UpdatedBy      string            `json:"updated_by"`
+	UpdaterVersion string            `json:"updater_version"`
+}
+
+// readRepoState reads a state file, which holds the state of every deployment sharing it
+// NB: A missing file is treated as empty, so that it can be created on the first update
+func readRepoState(worktree *git.Worktree, path string) (map[string]RepoStateEntry, error) {
+	toRet := make(map[string]RepoStateEntry)
+	stateBytes, err := readWorktreeFile(worktree, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return toRet, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(stateBytes, &toRet); err != nil {
+		return nil, fmt.Errorf("could not decode state file: %w", err)
+	}
+
+	return toRet, nil
+}
+
+// RepoState returns the deployment's entry from its state file, if it has one
+func (d Deployment) RepoState(worktree *git.Worktree) (RepoStateEntry, bool, error) {
+	if d.StateFile == "" {
+		return RepoStateEntry{}, false, nil
+	}
+	state, err := readRepoState(worktree, d.StateFile)
+	if err != nil {
+		return RepoStateEntry{}, false, err
+	}
+	entry, ok := state[d.Name]
+
+	return entry, ok, nil
+}
+
+// updateStateFile records the payload as the deployment's latest update, and stages the file for commit
+func (d Deployment) updateStateFile(worktree *git.Worktree, payload UpdateRequest) error {
+	state, err := readRepoState(worktree, d.StateFile)
+	if err != nil {
+		return err
+	}
+	state[d.Name] = RepoStateEntry{
+		LastTag:        payload.TagName,
+		LastImages:     payload.Images,
+		UpdatedAt:      time.Now().UTC(),
+		UpdatedBy:      payload.AuthorizedBy,
+		UpdaterVersion: Version,
+	}
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode state file: %w", err)
+	}
+
+	return writeWorktreeFile(worktree, d.StateFile, append(stateBytes, '\n'))
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UpdateResponse describes the outcome of an update request, and is the JSON body returned to webhook callers
+type UpdateResponse struct {
+	Code     int            `json:"-"`
+	Message  string         `json:"message"`
+	JobId    string         `json:"job_id,omitempty"`
+	Revision string         `json:"revision,omitempty"`
+	Timings  *updateTimings `json:"timings,omitempty"`
+
+	// PreviousTag is only set when every image shared a tag, but PreviousTags lists each image's
+	PreviousTag  string            `json:"previous_tag,omitempty"`
+	PreviousTags map[string]string `json:"previous_tags,omitempty"`
+	// Sync names what was asked to deploy the revision, either argocd, flux or rollout
+	Sync string `json:"sync,omitempty"`
+
+	DuplicatePolicy string `json:"duplicate_policy,omitempty"`
+
+	// ErrorCode classifies a failure more finely than its status, and Retryable says whether it's likely transient
+	ErrorCode string `json:"error_code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	// RetryAfter is how many seconds a shed request should wait before trying again
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Images holds every image's tag after the update, for the deployment info metric
+	Images map[string]string `json:"-"`
+}
+
+// updateTimings records how long each stage of an update took, in milliseconds
+// NB: ArgoCD syncs run after the response is sent, so sync_ms is only reported in the logs
+type updateTimings struct {
+	LockWait int64 `json:"lock_wait_ms"`
+	Clone    int64 `json:"clone_ms"`
+	Apply    int64 `json:"apply_ms"`
+	Push     int64 `json:"push_ms"`
+}
+
+// stageTimer measures consecutive stages of the update pipeline
+type stageTimer struct {
+	last time.Time
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{last: time.Now()}
+}
+
+// lap returns the milliseconds elapsed since the previous lap
+func (t *stageTimer) lap() int64 {
+	now := time.Now()
+	elapsed := now.Sub(t.last).Milliseconds()
+	t.last = now
+
+	return elapsed
+}
+
+func (t updateTimings) logFields() log.Fields {
+	return log.Fields{
+		"lock_wait_ms": t.LockWait,
+		"clone_ms":     t.Clone,
+		"apply_ms":     t.Apply,
+		"push_ms":      t.Push,
+	}
+}
+
+// Values of UpdateResponse.ErrorCode
+const (
+	ErrorInvalidRequest   = "invalid_request"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorForbidden        = "forbidden"
+	ErrorNotFound         = "not_found"
+	ErrorConflict         = "conflict"
+	ErrorRefused          = "refused"
+	ErrorFrozen           = "frozen"
+	ErrorApplyFailed      = "apply_failed"
+	ErrorPushConflict     = "push_conflict"
+	ErrorUpstream         = "upstream_error"
+	ErrorUpstreamAuth     = "upstream_auth_failed"
+	ErrorOverloaded       = "overloaded"
+	ErrorTimeout          = "timeout"
+	ErrorInternal         = "internal_error"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorTooLarge         = "payload_too_large"
+)
+
+// defaultErrorCodes classifies failures which don't need anything more specific than their status
+var defaultErrorCodes = map[int]string{
+	http.StatusBadRequest:            ErrorInvalidRequest,
+	http.StatusUnauthorized:          ErrorUnauthorized,
+	http.StatusForbidden:             ErrorForbidden,
+	http.StatusNotFound:              ErrorNotFound,
+	http.StatusMethodNotAllowed:      ErrorMethodNotAllowed,
+	http.StatusConflict:              ErrorConflict,
+	http.StatusRequestEntityTooLarge: ErrorTooLarge,
+	http.StatusUnprocessableEntity:   ErrorRefused,
+	http.StatusLocked:                ErrorFrozen,
+	http.StatusInternalServerError:   ErrorInternal,
+	http.StatusBadGateway:            ErrorUpstream,
+	http.StatusServiceUnavailable:    ErrorOverloaded,
+	http.StatusGatewayTimeout:        ErrorTimeout,
+}
+
+// retryableErrors are those which may well succeed if the same request is sent again later
+var retryableErrors = map[string]bool{
+	ErrorPushConflict: true,
+	ErrorUpstream:     true,
+	ErrorOverloaded:   true,
+	ErrorTimeout:      true,
+}
+
+func newResponse(code int, message string) UpdateResponse {
+	return newError(code, defaultErrorCodes[code], message)
+}
+
+// newError creates a response for a failure which needs a more specific error code than its status implies
+func newError(code int, errorCode string, message string) UpdateResponse {
+	return UpdateResponse{Code: code, Message: message, ErrorCode: errorCode, Retryable: retryableErrors[errorCode]}
+}
+
+func writeResponse(resp http.ResponseWriter, body UpdateResponse) {
+	if body.RetryAfter > 0 {
+		resp.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	}
+	writeJSON(resp, body.Code, body)
+}
+
+func writeJSON(resp http.ResponseWriter, code int, body interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	if err := json.NewEncoder(resp).Encode(body); err != nil {
+		log.WithError(err).Debug("Failed to write response")
+	}
+}
@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const rollbackUser = "image-updater (rollback)"
+
+// rollback reverts a degraded deployment to its previous tags, if it has opted in and the
+// degraded update is recent enough
+func (s *WebhookServer) rollback(deployment *Deployment, revision string) {
+	if deployment.RollbackWindow == 0 {
+		return
+	}
+	logData := log.Fields{"deployment": deployment.Name, "revision": revision}
+
+	// Only roll back if the degraded update is still the latest one
+	last, ok := s.state.LastUpdate(deployment.Name)
+	if !ok || last.Revision != revision {
+		log.WithFields(logData).Debug("Not rolling back, revision is not the latest update")
+		return
+	}
+	if time.Since(last.Time) > deployment.RollbackWindow {
+		log.WithFields(logData).Debug("Not rolling back, update is outside the rollback window")
+		return
+	}
+	// Never roll back a rollback, or we could loop forever
+	if last.AuthorizedBy == rollbackUser {
+		log.WithFields(logData).Warn("Deployment is degraded, but cannot be rolled back")
+		return
+	}
+	payload, err := rollbackRequest(deployment, last, rollbackUser)
+	if err != nil {
+		log.WithFields(logData).WithError(err).Warn("Deployment is degraded, but cannot be rolled back")
+		return
+	}
+
+	previous := payload.Tags()
+	log.WithFields(logData).Errorf("Deployment is degraded, rolling back from %s to %s", last.TagName, previous)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeoutsFor(deployment, payload).Update)
+	defer cancel()
+	result := s.performRollback(ctx, payload, logData)
+
+	note := notification{
+		Event:   EventRolledBack,
+		Payload: payload,
+		Fields:  map[string]string{"revision": result.Revision, "failed_tag": last.TagName},
+	}
+	if result.Code == http.StatusOK {
+		note.Message = fmt.Sprintf(":rotating_light: %s was degraded, rolled back from %s to %s", deployment.Name, last.TagName, previous)
+	} else {
+		note.Message = fmt.Sprintf(":rotating_light: %s is degraded at %s, and rolling back to %s failed: %s", deployment.Name, last.TagName, previous, result.Message)
+	}
+	s.notify(deployment, note)
+}
+
+// rollbackLatest returns a deployment to the tags it had before its most recent update
+func (s *WebhookServer) rollbackLatest(ctx context.Context, deployment *Deployment, authorizedBy string, logData log.Fields) UpdateResponse {
+	// NB: Without any history, the request can't be built either
+	last, _ := s.state.LastUpdate(deployment.Name)
+	payload, err := rollbackRequest(deployment, last, authorizedBy)
+	if err != nil {
+		return newResponse(http.StatusConflict, "No previous tags to roll back to")
+	}
+	logData["rollback_from"] = last.TagName
+	log.WithFields(logData).Infof("Rolling back to %s", payload.Tags())
+
+	return s.performRollback(ctx, payload, logData)
+}
+
+// rollbackRequest builds the request which returns each of the deployment's images to its previous tag
+// NB: Images which had different tags must each be restored, as no single tag would recreate that state
+func rollbackRequest(deployment *Deployment, last HistoryEntry, authorizedBy string) (UpdateRequest, error) {
+	toRet := UpdateRequest{Deployment: deployment.Name, AuthorizedBy: authorizedBy}
+	switch {
+	case len(last.PreviousTags) > 1:
+		toRet.Images = last.PreviousTags
+	case len(last.PreviousTags) == 1:
+		for _, tag := range last.PreviousTags {
+			toRet.TagName = tag
+		}
+	case last.PreviousTag != "" && len(deployment.Images) == 1 && !strings.ContainsRune(deployment.Images[0], '*'):
+		// History from before each image's tag was recorded is only usable for a single image
+		toRet.TagName = last.PreviousTag
+	default:
+		return UpdateRequest{}, fmt.Errorf("no previous tags to roll back to")
+	}
+
+	return toRet, nil
+}
+
+// performRollback validates a rollback like any other update, so that pins and ignored tags are respected
+func (s *WebhookServer) performRollback(ctx context.Context, payload UpdateRequest, logData log.Fields) UpdateResponse {
+	deployment, rejection := s.prepareUpdate(&payload)
+	if rejection != nil {
+		return *rejection
+	}
+
+	return s.performUpdate(ctx, deployment, payload, logData)
+}
@@ -0,0 +1,192 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"time"
+)
+
+const rolloutDefaultNamespace = "default"
+const rolloutPollInterval = 2
+
+// restartAnnotation is the pod template annotation which `kubectl rollout restart` sets
+const restartAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// revisionAnnotation records the pushed revision on the workload itself, for apply jobs and other tooling to act on
+const revisionAnnotation = crdGroup + "/revision"
+
+// Values of RolloutConfig.Action
+const (
+	RolloutRestart  = "restart"
+	RolloutAnnotate = "annotate"
+)
+
+// rolloutResources maps the kinds of workload which can be restarted to their resources
+var rolloutResources = map[string]schema.GroupVersionResource{
+	"Deployment":  {Group: "apps", Version: "v1", Resource: "deployments"},
+	"StatefulSet": {Group: "apps", Version: "v1", Resource: "statefulsets"},
+	"DaemonSet":   {Group: "apps", Version: "v1", Resource: "daemonsets"},
+}
+
+var rolloutResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "rollout",
+	Name:      "requests_total",
+	Help:      "The number of workloads restarted or annotated directly, by workload and result",
+}, []string{"workload", "result"})
+
+func validateRollout(cfg *RolloutConfig) error {
+	if cfg.Kind == "" {
+		cfg.Kind = "Deployment"
+	}
+	if _, ok := rolloutResources[cfg.Kind]; !ok {
+		return fmt.Errorf("unsupported rollout kind: %s", cfg.Kind)
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = rolloutDefaultNamespace
+	}
+	switch cfg.Action {
+	case "":
+		cfg.Action = RolloutRestart
+	case RolloutRestart:
+	case RolloutAnnotate:
+		if cfg.Wait {
+			return fmt.Errorf("rollout wait is only supported for the restart action")
+		}
+	default:
+		return fmt.Errorf("unknown rollout action: %s", cfg.Action)
+	}
+
+	return nil
+}
+
+// rollout restarts or annotates a deployment's workload directly, for clusters without ArgoCD or Flux
+func (s *WebhookServer) rollout(job *Job, deployment *Deployment, payload UpdateRequest, revision string) {
+	workload := deployment.Rollout.Namespace + "/" + deployment.Rollout.Name
+	job.SetStatus(StatusSyncing, revision, "")
+	ctx, cancel := context.WithTimeout(context.Background(), deployment.RolloutTimeout)
+	defer cancel()
+	startTime := time.Now()
+
+	result, err := s.doRollout(ctx, deployment, revision)
+	logFields := requestLogFields(payload)
+	logFields["job_id"] = job.ID
+	logFields["workload"] = workload
+	logFields["revision"] = revision
+	logFields["sync_ms"] = time.Since(startTime).Milliseconds()
+	note := notification{
+		Payload: payload,
+		Fields:  map[string]string{"revision": revision, "workload": workload},
+	}
+	if err != nil {
+		result = StatusSyncFailed
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.WithFields(logFields).Warn("Timed out waiting for rollout")
+			rolloutResults.WithLabelValues(workload, "timeout").Inc()
+		} else {
+			log.WithError(err).WithFields(logFields).Warn("Rollout failed")
+			rolloutResults.WithLabelValues(workload, StatusSyncFailed).Inc()
+		}
+		note.Event = EventSyncFailed
+		note.Message = fmt.Sprintf("Rollout of %s failed: %v", workload, err)
+		s.notify(deployment, note)
+		s.resolveJob(job, deployment, payload, result, revision, err.Error())
+		return
+	}
+	log.WithFields(logFields).Infof("Rollout %s requested", deployment.Rollout.Action)
+	rolloutResults.WithLabelValues(workload, result).Inc()
+	note.Event = EventSyncSucceeded
+	note.Message = fmt.Sprintf("Rollout of %s requested for %s", workload, payload.Tags())
+	if result == StatusHealthy {
+		note.Message = fmt.Sprintf("Rollout of %s finished at %s", workload, payload.Tags())
+	}
+	s.notify(deployment, note)
+	s.resolveJob(job, deployment, payload, result, revision, "")
+}
+
+func (s *WebhookServer) doRollout(ctx context.Context, deployment *Deployment, revision string) (string, error) {
+	restConfig, err := kubernetesRestConfig(s.kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("could not load Kubernetes configuration: %w", err)
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return "", fmt.Errorf("could not create Kubernetes client: %w", err)
+	}
+	cfg := deployment.Rollout
+	workloads := client.Resource(rolloutResources[cfg.Kind]).Namespace(cfg.Namespace)
+
+	// NB: Only the pod template's annotations cause a rollout, the workload's own are informational
+	var patch string
+	if cfg.Action == RolloutAnnotate {
+		patch = fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, revisionAnnotation, revision)
+	} else {
+		patch = fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`,
+			restartAnnotation, time.Now().Format(time.RFC3339))
+	}
+	patched, err := workloads.Patch(ctx, cfg.Name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not patch %s: %w", cfg.Kind, err)
+	}
+	if !cfg.Wait {
+		return StatusSynced, nil
+	}
+
+	// Poll until the controller has replaced every pod
+	generation := patched.GetGeneration()
+	ticker := time.NewTicker(rolloutPollInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			workload, err := workloads.Get(ctx, cfg.Name, metav1.GetOptions{})
+			if err != nil {
+				log.WithError(err).WithField("workload", cfg.Name).Debug("Could not fetch workload")
+				continue
+			}
+			if rolloutComplete(workload, cfg.Kind, generation) {
+				return StatusHealthy, nil
+			}
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// rolloutComplete reports whether a workload's controller has rolled out the given generation,
+// using the same conditions as `kubectl rollout status`
+func rolloutComplete(workload *unstructured.Unstructured, kind string, generation int64) bool {
+	observed, _, _ := unstructured.NestedInt64(workload.Object, "status", "observedGeneration")
+	if observed < generation {
+		return false
+	}
+	status := func(field string) int64 {
+		value, _, _ := unstructured.NestedInt64(workload.Object, "status", field)
+		return value
+	}
+
+	switch kind {
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		return status("updatedNumberScheduled") >= desired && status("numberAvailable") >= desired
+	case "StatefulSet":
+		replicas := status("replicas")
+		return status("updatedReplicas") >= replicas && status("readyReplicas") >= replicas
+	default:
+		replicas, found, _ := unstructured.NestedInt64(workload.Object, "spec", "replicas")
+		if !found {
+			replicas = 1
+		}
+		return status("updatedReplicas") >= replicas && status("availableReplicas") >= replicas &&
+			status("replicas") <= replicas
+	}
+}
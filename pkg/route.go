@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	log "github.com/sirupsen/logrus"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+	"net/http"
+)
+
+// defaultRouteTag is used when a route doesn't say where to find the tag
+const defaultRouteTag = "payload.tag_name"
+
+// Route matches events by evaluating an expression over them, and turns each match into update
+// requests for its deployments
+//
+// Expressions can refer to the event as payload, and to whatever sent it as source, e.g.
+//
+//	match = payload.repository == "acme/api" && can(regex("^v", payload.tag))
+type Route struct {
+	Name         string
+	match        hcl.Expression
+	deployments  []string
+	tag          hcl.Expression
+	authorizedBy hcl.Expression
+}
+
+func NewRoute(cfg RouteConfig) (*Route, error) {
+	if len(cfg.Deployments) == 0 {
+		return nil, fmt.Errorf("route %s must list at least one deployment", cfg.Name)
+	}
+	toRet := &Route{
+		Name:         cfg.Name,
+		match:        cfg.Match,
+		deployments:  cfg.Deployments,
+		tag:          optionalExpression(cfg.Tag),
+		authorizedBy: optionalExpression(cfg.AuthorizedBy),
+	}
+	if toRet.tag == nil {
+		toRet.tag, _ = hclsyntax.ParseExpression([]byte(defaultRouteTag), "", hcl.InitialPos)
+	}
+
+	return toRet, nil
+}
+
+// optionalExpression returns nil for an optional attribute which wasn't set
+// NB: Unset attributes still have an expression, which evaluates to null without any variables
+func optionalExpression(expression hcl.Expression) hcl.Expression {
+	if expression == nil {
+		return nil
+	}
+	if value, diags := expression.Value(nil); !diags.HasErrors() && value.IsNull() {
+		return nil
+	}
+
+	return expression
+}
+
+// parseEvent converts a JSON event into a value that expressions can inspect
+func parseEvent(eventBytes []byte) (cty.Value, error) {
+	eventType, err := ctyjson.ImpliedType(eventBytes)
+	if err != nil {
+		return cty.NilVal, err
+	}
+
+	return ctyjson.Unmarshal(eventBytes, eventType)
+}
+
+// Requests returns an update request for each of the route's deployments, or nil if the event doesn't match
+// NB: Events from different sources rarely share a shape, so a match expression which fails is a mismatch
+func (r *Route) Requests(source string, event cty.Value) ([]UpdateRequest, error) {
+	variables := map[string]cty.Value{
+		"source":  cty.StringVal(source),
+		"payload": event,
+	}
+	matched, err := evaluateBool(r.match, variables)
+	if err != nil {
+		log.WithError(err).WithField("route", r.Name).Debug("Route expression failed")
+		return nil, nil
+	}
+	if !matched {
+		return nil, nil
+	}
+
+	tagName, err := evaluateString(r.tag, variables)
+	if err != nil {
+		return nil, fmt.Errorf("route %s has no tag for the event: %w", r.Name, err)
+	}
+	authorizedBy := fmt.Sprintf("image-updater (route %s)", r.Name)
+	if r.authorizedBy != nil {
+		if authorizedBy, err = evaluateString(r.authorizedBy, variables); err != nil {
+			return nil, fmt.Errorf("route %s has no authorized_by for the event: %w", r.Name, err)
+		}
+	}
+	toRet := make([]UpdateRequest, 0, len(r.deployments))
+	for _, deployment := range r.deployments {
+		toRet = append(toRet, UpdateRequest{
+			Deployment:   deployment,
+			TagName:      tagName,
+			AuthorizedBy: authorizedBy,
+		})
+	}
+
+	return toRet, nil
+}
+
+// RouteEvent matches an event against every route, returning a request for each deployment it should update
+// NB: Each deployment is only updated once, by the first route which matches it, and routes which
+// match but can't build a request only cause an error if no other route matched
+func (s *WebhookServer) RouteEvent(source string, eventBytes []byte) ([]UpdateRequest, error) {
+	event, err := parseEvent(eventBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode event: %w", err)
+	}
+	var toRet []UpdateRequest
+	var firstErr error
+	routed := make(map[string]bool)
+	for _, route := range s.routes {
+		requests, err := route.Requests(source, event)
+		if err != nil {
+			log.WithError(err).WithField("route", route.Name).Warn("Route matched, but could not build requests")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, request := range requests {
+			if !routed[request.Deployment] {
+				routed[request.Deployment] = true
+				toRet = append(toRet, request)
+			}
+		}
+	}
+	if len(toRet) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+
+	return toRet, nil
+}
+
+// routedResponse lists the jobs started for an event, by deployment
+type routedResponse struct {
+	Message string            `json:"message"`
+	Jobs    map[string]string `json:"jobs,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// EventHandler receives arbitrary JSON events, such as registry webhooks, and updates whichever
+// deployments the routes match them to
+type EventHandler struct {
+	server *WebhookServer
+}
+
+func (h EventHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	eventBytes, rejection := readPayload(req, h.server.maxJSONDepth)
+	if rejection != nil {
+		writeResponse(resp, *rejection)
+		return
+	}
+	logData := log.Fields{"request_id": RequestIDFromContext(req.Context())}
+	requests, err := h.server.RouteEvent("webhook", eventBytes)
+	if err != nil {
+		log.WithError(err).WithFields(logData).Warn("Failed to route event")
+		writeResponse(resp, newResponse(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if len(requests) == 0 {
+		log.WithFields(logData).Debug("Event did not match any routes")
+		writeJSON(resp, http.StatusOK, routedResponse{Message: "No routes matched"})
+		return
+	}
+
+	// Routed updates always continue in the background, as there may be several of them
+	toRet := routedResponse{Message: fmt.Sprintf("Routed to %d deployment(s)", len(requests))}
+	for _, request := range requests {
+		request.RequestID = RequestIDFromContext(req.Context())
+		job, done := h.server.Submit("route", request)
+		if job == nil {
+			if toRet.Errors == nil {
+				toRet.Errors = make(map[string]string)
+			}
+			toRet.Errors[request.Deployment] = (<-done).Message
+			continue
+		}
+		if toRet.Jobs == nil {
+			toRet.Jobs = make(map[string]string)
+		}
+		toRet.Jobs[request.Deployment] = job.ID
+	}
+	log.WithFields(logData).Infof("Event routed to %d deployment(s)", len(toRet.Jobs))
+	writeJSON(resp, http.StatusAccepted, toRet)
+}
@@ -0,0 +1,407 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const scmTimeout = 30
+const defaultSCMContext = "image-updater"
+const defaultSCMDescription = "{{ .name }} updated to {{ .tag }} by {{ .user }}"
+
+// States of a commit status, which each provider translates into its own
+const (
+	CommitStatusPending = "pending"
+	CommitStatusSuccess = "success"
+	CommitStatusFailure = "failure"
+)
+
+var scmRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "scm",
+	Name:      "requests_total",
+	Help:      "The number of commit statuses and comments posted to SCM providers, by provider, kind and result",
+}, []string{"provider", "kind", "result"})
+
+// CommitStatus is shown next to a commit by the repository's hosting service
+type CommitStatus struct {
+	State       string
+	Context     string
+	Description string
+	TargetUrl   string
+}
+
+// SCMProvider posts feedback about updates to the service which hosts a repository, so that reviewers
+// can see where each config commit came from
+type SCMProvider interface {
+	// SetCommitStatus attaches a status to a commit in the repository
+	SetCommitStatus(ctx context.Context, repoUrl string, revision string, status CommitStatus) error
+	// CommentOnPullRequest adds a comment to one of the repository's pull (or merge) requests
+	CommentOnPullRequest(ctx context.Context, repoUrl string, number int, body string) error
+}
+
+// SCMProviderFactory creates a provider, where the API URL is empty unless configured
+type SCMProviderFactory func(apiUrl string, token string) SCMProvider
+
+var scmProviders = map[string]SCMProviderFactory{
+	"github": func(apiUrl string, token string) SCMProvider {
+		return githubProvider{newGithubClient(apiUrl, token)}
+	},
+	"gitlab": func(apiUrl string, token string) SCMProvider {
+		return gitlabProvider{apiUrl: apiUrl, token: token}
+	},
+	"gitea": func(apiUrl string, token string) SCMProvider {
+		return giteaProvider{apiUrl: apiUrl, token: token}
+	},
+	"bitbucket": func(apiUrl string, token string) SCMProvider {
+		return bitbucketProvider{apiUrl: apiUrl, token: token}
+	},
+}
+
+// RegisterSCMProvider adds a kind of SCM provider, which repositories can then name in their scm block
+func RegisterSCMProvider(name string, factory SCMProviderFactory) {
+	scmProviders[name] = factory
+}
+
+// SCM is a repository's SCM provider, along with what to tell it about each update
+type SCM struct {
+	Provider    SCMProvider
+	name        string
+	context     string
+	targetUrl   *template.Template
+	description *template.Template
+	comment     *template.Template
+}
+
+func NewSCM(cfg SCMConfig) (*SCM, error) {
+	factory, ok := scmProviders[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown scm provider: %s", cfg.Provider)
+	}
+	toRet := &SCM{Provider: factory(cfg.ApiUrl, cfg.Token), name: cfg.Provider, context: cfg.Context}
+	if toRet.context == "" {
+		toRet.context = defaultSCMContext
+	}
+	if cfg.Description == "" {
+		cfg.Description = defaultSCMDescription
+	}
+	var err error
+	if toRet.description, err = template.New("").Parse(cfg.Description); err != nil {
+		return nil, fmt.Errorf("failed to parse scm description template: %w", err)
+	}
+	if toRet.targetUrl, err = template.New("").Parse(cfg.TargetUrl); err != nil {
+		return nil, fmt.Errorf("failed to parse scm target_url template: %w", err)
+	}
+	if cfg.Comment != "" {
+		if toRet.comment, err = template.New("").Parse(cfg.Comment); err != nil {
+			return nil, fmt.Errorf("failed to parse scm comment template: %w", err)
+		}
+	}
+
+	return toRet, nil
+}
+
+// commitStatusStates maps the statuses which end a job with a pushed revision to the commit status they report
+var commitStatusStates = map[string]string{
+	StatusUpdated:    CommitStatusSuccess,
+	StatusSynced:     CommitStatusSuccess,
+	StatusHealthy:    CommitStatusSuccess,
+	StatusSyncFailed: CommitStatusFailure,
+	StatusDegraded:   CommitStatusFailure,
+}
+
+// reportToSCM sets a commit status on the revision an update pushed, in the background
+func (s *WebhookServer) reportToSCM(deployment *Deployment, payload UpdateRequest, status string, revision string) {
+	state, ok := commitStatusStates[status]
+	if !ok || revision == "" {
+		return
+	}
+	repo, err := s.repositoryFor(deployment, payload)
+	if err != nil || repo.scm == nil {
+		return
+	}
+	templateData := deployment.templateData(payload)
+	templateData["revision"] = revision
+	templateData["status"] = status
+	go repo.scm.setCommitStatus(repo.url, revision, state, templateData)
+}
+
+func (c *SCM) setCommitStatus(repoUrl string, revision string, state string, templateData map[string]interface{}) {
+	logFields := log.Fields{"provider": c.name, "repository": repoUrl, "revision": revision}
+	status := CommitStatus{State: state, Context: c.context}
+	var err error
+	if status.Description, err = renderSCMTemplate(c.description, templateData); err == nil {
+		status.TargetUrl, err = renderSCMTemplate(c.targetUrl, templateData)
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), scmTimeout*time.Second)
+		err = c.Provider.SetCommitStatus(ctx, repoUrl, revision, status)
+		cancel()
+	}
+	if err != nil {
+		log.WithFields(logFields).WithError(err).Warn("Failed to set commit status")
+		scmRequests.WithLabelValues(c.name, "status", "error").Inc()
+		return
+	}
+	scmRequests.WithLabelValues(c.name, "status", "success").Inc()
+}
+
+// commentOnPullRequest posts the comment template for an update to a pull request, if there is one
+func (c *SCM) commentOnPullRequest(ctx context.Context, repoUrl string, number int, templateData map[string]interface{}) {
+	if c.comment == nil {
+		return
+	}
+	logFields := log.Fields{"provider": c.name, "repository": repoUrl, "pull_request": number}
+	body, err := renderSCMTemplate(c.comment, templateData)
+	if err == nil && body != "" {
+		err = c.Provider.CommentOnPullRequest(ctx, repoUrl, number, body)
+	}
+	if err != nil {
+		log.WithFields(logFields).WithError(err).Warn("Failed to comment on pull request")
+		scmRequests.WithLabelValues(c.name, "comment", "error").Inc()
+		return
+	}
+	scmRequests.WithLabelValues(c.name, "comment", "success").Inc()
+}
+
+func renderSCMTemplate(tpl *template.Template, templateData map[string]interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	if err := tpl.Execute(&buf, templateData); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// scmRequest sends a JSON request to an SCM provider's API, decoding the response into out if given
+func scmRequest(ctx context.Context, method string, requestUrl string, authorization string, body interface{}, out interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not encode body: %w", err)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestUrl, bodyReader)
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", authorization)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("unexpected status %d from %s %s", resp.StatusCode, method, req.URL.Path)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return nil
+}
+
+type githubProvider struct {
+	client *githubClient
+}
+
+func (p githubProvider) SetCommitStatus(ctx context.Context, repoUrl string, revision string, status CommitStatus) error {
+	owner, name, err := githubRepository(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]string{"state": status.State, "context": status.Context, "description": status.Description}
+	if status.TargetUrl != "" {
+		request["target_url"] = status.TargetUrl
+	}
+
+	return p.client.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/%s/statuses/%s", owner, name, revision), request, nil)
+}
+
+func (p githubProvider) CommentOnPullRequest(ctx context.Context, repoUrl string, number int, body string) error {
+	owner, name, err := githubRepository(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]string{"body": body}
+
+	return p.client.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/%s/issues/%d/comments", owner, name, number), request, nil)
+}
+
+// gitlabProvider uses the GitLab API, where projects may be nested in any number of groups
+type gitlabProvider struct {
+	apiUrl string
+	token  string
+}
+
+const gitlabDefaultApiUrl = "https://gitlab.com/api/v4"
+
+func (p gitlabProvider) project(repoUrl string) (string, string, error) {
+	parsedUrl, err := url.Parse(repoUrl)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid repository url: %w", err)
+	}
+	project := strings.Trim(strings.TrimSuffix(parsedUrl.Path, ".git"), "/")
+	if !strings.Contains(project, "/") {
+		return "", "", fmt.Errorf("repository url %s does not name a GitLab project", repoUrl)
+	}
+	apiUrl := p.apiUrl
+	if apiUrl == "" {
+		apiUrl = gitlabDefaultApiUrl
+	}
+
+	return strings.TrimRight(apiUrl, "/") + "/projects/" + url.PathEscape(project), "Bearer " + p.token, nil
+}
+
+func (p gitlabProvider) SetCommitStatus(ctx context.Context, repoUrl string, revision string, status CommitStatus) error {
+	projectUrl, authorization, err := p.project(repoUrl)
+	if err != nil {
+		return err
+	}
+	// NB: GitLab calls a failed status "failed"
+	state := status.State
+	if state == CommitStatusFailure {
+		state = "failed"
+	}
+	request := map[string]string{"state": state, "name": status.Context, "description": status.Description}
+	if status.TargetUrl != "" {
+		request["target_url"] = status.TargetUrl
+	}
+
+	return scmRequest(ctx, http.MethodPost, projectUrl+"/statuses/"+revision, authorization, request, nil)
+}
+
+func (p gitlabProvider) CommentOnPullRequest(ctx context.Context, repoUrl string, number int, body string) error {
+	projectUrl, authorization, err := p.project(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]string{"body": body}
+
+	return scmRequest(ctx, http.MethodPost, fmt.Sprintf("%s/merge_requests/%d/notes", projectUrl, number), authorization, request, nil)
+}
+
+// giteaProvider uses the Gitea (or Forgejo) API, which is served from the same host as the repository
+// unless configured otherwise
+type giteaProvider struct {
+	apiUrl string
+	token  string
+}
+
+func (p giteaProvider) repository(repoUrl string) (string, error) {
+	owner, name, err := githubRepository(repoUrl)
+	if err != nil {
+		return "", err
+	}
+	apiUrl := p.apiUrl
+	if apiUrl == "" {
+		parsedUrl, _ := url.Parse(repoUrl)
+		apiUrl = fmt.Sprintf("%s://%s/api/v1", parsedUrl.Scheme, parsedUrl.Host)
+	}
+
+	return fmt.Sprintf("%s/repos/%s/%s", strings.TrimRight(apiUrl, "/"), owner, name), nil
+}
+
+func (p giteaProvider) SetCommitStatus(ctx context.Context, repoUrl string, revision string, status CommitStatus) error {
+	repoApiUrl, err := p.repository(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]string{"state": status.State, "context": status.Context, "description": status.Description}
+	if status.TargetUrl != "" {
+		request["target_url"] = status.TargetUrl
+	}
+
+	return scmRequest(ctx, http.MethodPost, repoApiUrl+"/statuses/"+revision, "token "+p.token, request, nil)
+}
+
+func (p giteaProvider) CommentOnPullRequest(ctx context.Context, repoUrl string, number int, body string) error {
+	repoApiUrl, err := p.repository(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]string{"body": body}
+
+	return scmRequest(ctx, http.MethodPost, fmt.Sprintf("%s/issues/%d/comments", repoApiUrl, number), "token "+p.token, request, nil)
+}
+
+// bitbucketProvider uses the Bitbucket Cloud API
+type bitbucketProvider struct {
+	apiUrl string
+	token  string
+}
+
+const bitbucketDefaultApiUrl = "https://api.bitbucket.org/2.0"
+
+// bitbucketStates maps commit status states to Bitbucket's build states
+var bitbucketStates = map[string]string{
+	CommitStatusPending: "INPROGRESS",
+	CommitStatusSuccess: "SUCCESSFUL",
+	CommitStatusFailure: "FAILED",
+}
+
+func (p bitbucketProvider) repository(repoUrl string) (string, error) {
+	workspace, slug, err := githubRepository(repoUrl)
+	if err != nil {
+		return "", err
+	}
+	apiUrl := p.apiUrl
+	if apiUrl == "" {
+		apiUrl = bitbucketDefaultApiUrl
+	}
+
+	return fmt.Sprintf("%s/repositories/%s/%s", strings.TrimRight(apiUrl, "/"), workspace, slug), nil
+}
+
+func (p bitbucketProvider) SetCommitStatus(ctx context.Context, repoUrl string, revision string, status CommitStatus) error {
+	repoApiUrl, err := p.repository(repoUrl)
+	if err != nil {
+		return err
+	}
+	// NB: Bitbucket requires every status to link somewhere
+	if status.TargetUrl == "" {
+		return fmt.Errorf("bitbucket commit statuses need a target_url")
+	}
+	request := map[string]string{
+		"key":         status.Context,
+		"name":        status.Context,
+		"state":       bitbucketStates[status.State],
+		"description": status.Description,
+		"url":         status.TargetUrl,
+	}
+
+	return scmRequest(ctx, http.MethodPost, repoApiUrl+"/commit/"+revision+"/statuses/build", "Bearer "+p.token, request, nil)
+}
+
+func (p bitbucketProvider) CommentOnPullRequest(ctx context.Context, repoUrl string, number int, body string) error {
+	repoApiUrl, err := p.repository(repoUrl)
+	if err != nil {
+		return err
+	}
+	request := map[string]interface{}{"content": map[string]string{"raw": body}}
+
+	return scmRequest(ctx, http.MethodPost, fmt.Sprintf("%s/pullrequests/%d/comments", repoApiUrl, number), "Bearer "+p.token, request, nil)
+}
@@ -0,0 +1,140 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+const selfCheckTimeout = 120
+
+// What to do when a deployment fails the startup check
+const (
+	StartupCheckWarn = "warn"
+	StartupCheckFail = "fail"
+)
+
+// CheckProblem is something wrong with a deployment which would make every update to it fail
+type CheckProblem struct {
+	Deployment string
+	Repository string
+	Err        error
+}
+
+func (p CheckProblem) Error() string {
+	return fmt.Sprintf("deployment %s: %v", p.Deployment, p.Err)
+}
+
+// CheckDeployments fetches each repository once, and checks that every deployment's paths exist and
+// contain each of its images, so that mistakes are caught before the first webhook rather than during a release
+// NB: Deployments using a repository template are skipped, as each request picks their repository
+func (s *WebhookServer) CheckDeployments(ctx context.Context) []CheckProblem {
+	byRepository := make(map[string][]*Deployment)
+	for _, deployment := range s.allDeployments() {
+		if _, ok := s.repositoryTemplates[deployment.RepositoryName]; ok {
+			continue
+		}
+		byRepository[deployment.RepositoryName] = append(byRepository[deployment.RepositoryName], deployment)
+	}
+	names := make([]string, 0, len(byRepository))
+	for name, deployments := range byRepository {
+		names = append(names, name)
+		sort.Slice(deployments, func(i, j int) bool {
+			return deployments[i].Name < deployments[j].Name
+		})
+	}
+	sort.Strings(names)
+
+	var toRet []CheckProblem
+	for _, name := range names {
+		for _, problem := range s.checkRepository(ctx, name, byRepository[name]) {
+			log.WithError(problem.Err).WithFields(log.Fields{
+				"deployment": problem.Deployment,
+				"repository": problem.Repository,
+			}).Warn("Deployment failed its startup check")
+			toRet = append(toRet, problem)
+		}
+	}
+	if len(toRet) == 0 {
+		log.WithField("repositories", len(names)).Info("Every deployment passed its startup check")
+	}
+
+	return toRet
+}
+
+// checkRepository checks each of a repository's deployments against a single checkout
+func (s *WebhookServer) checkRepository(ctx context.Context, name string, deployments []*Deployment) []CheckProblem {
+	var toRet []CheckProblem
+	failAll := func(err error) []CheckProblem {
+		for _, deployment := range deployments {
+			toRet = append(toRet, CheckProblem{Deployment: deployment.Name, Repository: name, Err: err})
+		}
+		return toRet
+	}
+	repo, ok := s.lookupRepository(name)
+	if !ok {
+		return failAll(errRepositoryNotFound)
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, selfCheckTimeout*time.Second)
+	defer cancel()
+	checkout, err, _ := repo.Fetch(checkCtx)
+	if err != nil {
+		return failAll(fmt.Errorf("failed to fetch repository: %w", err))
+	}
+	defer checkout.Close()
+	worktree, err := checkout.Worktree()
+	if err != nil {
+		return failAll(err)
+	}
+
+	for _, deployment := range deployments {
+		if err := checkDeployment(worktree, deployment); err != nil {
+			toRet = append(toRet, CheckProblem{Deployment: deployment.Name, Repository: name, Err: err})
+		}
+	}
+
+	return toRet
+}
+
+// checkDeployment reads the deployment's current tags, which fails if any of its paths are missing,
+// then makes sure that every image without a wildcard was found
+func checkDeployment(worktree *git.Worktree, deployment *Deployment) error {
+	// Applying a selector which never changes anything just reports the current tags
+	unchanged := func(string) (string, bool) {
+		return "", false
+	}
+	found := make(imageTags)
+	for _, target := range deployment.Targets {
+		targetImages, _, err := target.Apply(worktree, unchanged, mapset.NewThreadUnsafeSet[string]())
+		if err != nil {
+			return err
+		}
+		found.merge(targetImages)
+	}
+
+	var missing []string
+	for _, image := range deployment.Images {
+		if _, ok := found[image]; !ok && !strings.ContainsRune(image, '*') {
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	foundNames := make([]string, 0, len(found))
+	for image := range found {
+		foundNames = append(foundNames, image)
+	}
+	sort.Strings(foundNames)
+	if len(foundNames) == 0 {
+		return fmt.Errorf("deployment files do not contain image(s): %s, nor any others", strings.Join(missing, ", "))
+	}
+
+	return fmt.Errorf("deployment files do not contain image(s): %s, but do contain: %s",
+		strings.Join(missing, ", "), strings.Join(foundNames, ", "))
+}
@@ -1,185 +1,1043 @@
 package pkg
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
-	"io"
+	"google.golang.org/grpc"
+	"net"
 	"net/http"
-	"sigs.k8s.io/json"
+	"sync"
 	"time"
 )
 
 const webhookTimeout = 30
 
+// pushAttempts limits how often an update is retried when the repository changes underneath it
+const pushAttempts = 3
+
+// updateTimeout bounds updates which outlive their request
+const updateTimeout = 600
+
+// Request body limits, unless configured otherwise
+const defaultMaxBodySize = 1 << 20
+const defaultMaxJSONDepth = 16
+
+var errRepositoryNotFound = errors.New("repository not found")
+
 type WebhookServer struct {
 	repositories map[string]*Repository
 	deployments  map[string]*Deployment
-	argoToken    string
-	argoUrl      string
-	http.Server
+	// Templates are fixed by the config file, but manage their own repositories
+	repositoryTemplates map[string]*RepositoryTemplate
+	argoServers         map[string]*ArgoClient
+	kubeconfig          string
+	notifiers           []*Notifier
+	prGroups            []*PRGroup
+	routes              []*Route
+	failures            *failureTracker
+	syncs               *syncWorkers
+	backlog             *backlog
+	freezes             *FreezeQueue
+	sources             []Source
+	watcher             *ResourceWatcher
+	checker             *CredentialChecker
+	reconciler          *Reconciler
+	jobs                *JobStore
+	state               *StateStore
+	persister           *statePersister
+	grpcAddr            string
+	trustedProxies      []*net.IPNet
+	proxyProtocol       bool
+	maxBodySize         int64
+	maxJSONDepth        int
+	idempotency         *idempotencyStore
+	timeouts            Timeouts
+	grpcServer          *grpc.Server
+	// The webhook listener comes first, followed by any dedicated admin and metrics listeners
+	listeners []*http.Server
+
+	// Deployments and repositories defined by Kubernetes resources can change at runtime
+	resourceMutex        sync.RWMutex
+	resourceRepositories map[string]*Repository
+	resourceDeployments  map[string]*Deployment
+	// Resources are looked up by name alone, so each name is owned by the first namespace to define it
+	resourceRepositoryNamespaces map[string]string
+	resourceDeploymentNamespaces map[string]string
 }
 
-func NewServer(cfg Config) *WebhookServer {
+// NewServer creates the update pipeline along with the webhook and any other listeners
+func NewServer(cfg Config) (*WebhookServer, error) {
 	// Unskippable warning if the user hasn't set up any authentication
 	if cfg.SecretKey == "" && len(cfg.AllowedIPs) == 0 {
 		log.Warn("Your secret_key and allowed_ips have not been configured.")
 		log.Warn("This is extremely insecure, and should never be done outside of testing.")
 	}
+	toRet, err := newPipeline(cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	// Wrap our main HTTP handler
+	// NB: Timeouts are handled by ServeHTTP, so that slow updates can continue as a job
+	var handler http.Handler = toRet
+	if cfg.SecretKey != "" {
+		handler = SecretKeyHandler(handler, "X-Key", cfg.SecretKey)
+	}
+	handler = InstrumentHandler(handler)
+	// Job status and ArgoCD notifications share the webhook's authentication
+	var jobHandler http.Handler = toRet.jobs
+	var argoHandler http.Handler = ArgoNotificationHandler{server: toRet}
+	var eventHandler http.Handler = EventHandler{server: toRet}
+	var groupHandler http.Handler = GroupHandler{server: toRet}
+	if cfg.SecretKey != "" {
+		jobHandler = SecretKeyHandler(jobHandler, "X-Key", cfg.SecretKey)
+		argoHandler = SecretKeyHandler(argoHandler, "X-Key", cfg.SecretKey)
+		eventHandler = SecretKeyHandler(eventHandler, "X-Key", cfg.SecretKey)
+		groupHandler = SecretKeyHandler(groupHandler, "X-Key", cfg.SecretKey)
+	}
+	// The admin API can have its own key, as it exposes more than the webhook
+	adminKey := cfg.AdminKey
+	if cfg.AdminListener != nil && cfg.AdminListener.SecretKey != "" {
+		adminKey = cfg.AdminListener.SecretKey
+	}
+	if adminKey == "" {
+		adminKey = cfg.SecretKey
+	}
+	var adminHandler http.Handler = AdminHandler{server: toRet}
+	var approvalHandler http.Handler = ApprovalHandler{server: toRet}
+	if adminKey != "" {
+		adminHandler = SecretKeyHandler(adminHandler, "X-Key", adminKey)
+		approvalHandler = SecretKeyHandler(approvalHandler, "X-Key", adminKey)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+		_, _ = resp.Write([]byte("OK"))
+	})
+	mux.Handle("/healthz/details", NewHealthDetailsHandler(cfg, toRet))
+	mux.Handle("/jobs/", jobHandler)
+	mux.Handle("/argocd/notifications", argoHandler)
+	mux.Handle("/groups/", InstrumentHandler(groupHandler))
+	if len(toRet.routes) > 0 {
+		mux.Handle("/events", eventHandler)
+	}
+	mux.Handle("/", handler)
+	if toRet.trustedProxies, err = ParseCIDRs(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	toRet.proxyProtocol = cfg.ProxyProtocol
+	toRet.maxBodySize, toRet.maxJSONDepth = defaultMaxBodySize, defaultMaxJSONDepth
+	if cfg.MaxBodySize > 0 {
+		toRet.maxBodySize = cfg.MaxBodySize
+	}
+	if cfg.MaxJSONDepth > 0 {
+		toRet.maxJSONDepth = cfg.MaxJSONDepth
+	}
+	// Admin and metrics endpoints move to their own listeners when configured
+	networks, err := ParseCIDRs(cfg.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed_ips: %w", err)
+	}
+	if cfg.AdminListener != nil {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/admin/", adminHandler)
+		adminMux.Handle("/approvals/", approvalHandler)
+		if err := toRet.addListener(cfg, cfg.AdminListener.Address, adminMux, cfg.AdminListener.AllowedIPs, networks); err != nil {
+			return nil, fmt.Errorf("invalid admin_listener: %w", err)
+		}
+	} else {
+		mux.Handle("/admin/", adminHandler)
+		mux.Handle("/approvals/", approvalHandler)
+	}
+	if cfg.MetricsListener != nil {
+		metricsMux := http.NewServeMux()
+		metricsHandler := promhttp.Handler()
+		if cfg.MetricsListener.SecretKey != "" {
+			metricsHandler = SecretKeyHandler(metricsHandler, "X-Key", cfg.MetricsListener.SecretKey)
+		}
+		metricsMux.Handle("/metrics", metricsHandler)
+		if err := toRet.addListener(cfg, cfg.MetricsListener.Address, metricsMux, cfg.MetricsListener.AllowedIPs, networks); err != nil {
+			return nil, fmt.Errorf("invalid metrics_listener: %w", err)
+		}
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	// NB: The webhook listener must always be first
+	toRet.listeners = append([]*http.Server{toRet.newListener(cfg, cfg.ListenAddr, mux, networks)}, toRet.listeners...)
+
+	// The gRPC API is served separately, but shares the same protections
+	if cfg.GRPCListenAddr != "" {
+		toRet.grpcAddr = cfg.GRPCListenAddr
+		toRet.grpcServer = newGRPCServer(toRet, cfg.SecretKey, networks)
+	}
+
+	return toRet, nil
+}
+
+// newPipeline creates everything needed to run updates, but none of the listeners
+func newPipeline(cfg Config) (*WebhookServer, error) {
 	toRet := &WebhookServer{
-		repositories: make(map[string]*Repository),
-		deployments:  make(map[string]*Deployment),
-		argoToken:    cfg.ArgoToken,
-		argoUrl:      cfg.ArgoUrl,
-		Server: http.Server{
-			Addr:         cfg.ListenAddr,
-			WriteTimeout: (webhookTimeout + 1) * time.Second,
-		},
+		repositories:        make(map[string]*Repository),
+		deployments:         make(map[string]*Deployment),
+		repositoryTemplates: make(map[string]*RepositoryTemplate),
+		jobs:                NewJobStore(),
+		state:               NewStateStore(),
+
+		resourceRepositories: make(map[string]*Repository),
+		resourceDeployments:  make(map[string]*Deployment),
+
+		resourceRepositoryNamespaces: make(map[string]string),
+		resourceDeploymentNamespaces: make(map[string]string),
+	}
+	toRet.freezes = NewFreezeQueue(toRet)
+	if cfg.FailureAlertThreshold < 0 {
+		return nil, fmt.Errorf("failure_alert_threshold cannot be negative")
+	}
+	toRet.failures = newFailureTracker(cfg.FailureAlertThreshold)
+	if cfg.StartupCheck != "" && cfg.StartupCheck != StartupCheckWarn && cfg.StartupCheck != StartupCheckFail {
+		return nil, fmt.Errorf("invalid startup_check: %s", cfg.StartupCheck)
+	}
+	if cfg.MaxConcurrentSyncs < 0 {
+		return nil, fmt.Errorf("max_concurrent_syncs cannot be negative")
+	} else if cfg.MaxConcurrentSyncs == 0 {
+		cfg.MaxConcurrentSyncs = defaultMaxConcurrentSyncs
+	}
+	toRet.syncs = newSyncWorkers(cfg.MaxConcurrentSyncs)
+	if backlog, err := newBacklog(cfg.Backpressure); err != nil {
+		return nil, err
+	} else {
+		toRet.backlog = backlog
 	}
 
+	SetMemoryBudget(int64(cfg.MemoryBudget) << 20)
+	idempotencyWindow := defaultIdempotencyWindow * time.Second
+	if cfg.IdempotencyWindow != "" {
+		window, err := time.ParseDuration(cfg.IdempotencyWindow)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid idempotency_window: %s", cfg.IdempotencyWindow)
+		}
+		idempotencyWindow = window
+	}
+	toRet.idempotency = newIdempotencyStore(idempotencyWindow)
+	if cfg.State != nil {
+		if err := toRet.loadState(*cfg.State, cfg.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	if timeouts, err := parseTimeouts(cfg.Timeouts); err != nil {
+		return nil, err
+	} else {
+		toRet.timeouts = defaultTimeouts.override(timeouts)
+	}
 	for _, repoCfg := range cfg.Repositories {
-		toRet.repositories[repoCfg.Name] = NewRepository(repoCfg)
+		if repo, err := NewRepository(repoCfg); err != nil {
+			return nil, err
+		} else {
+			toRet.repositories[repoCfg.Name] = repo
+		}
+	}
+	for _, templateCfg := range cfg.RepositoryTemplates {
+		if _, ok := toRet.repositories[templateCfg.Name]; ok {
+			return nil, fmt.Errorf("repository template %s has the same name as a repository", templateCfg.Name)
+		}
+		if template, err := NewRepositoryTemplate(templateCfg); err != nil {
+			return nil, err
+		} else {
+			toRet.repositoryTemplates[templateCfg.Name] = template
+		}
 	}
 	for _, deployCfg := range cfg.Deployments {
 		if deploy, err := NewDeployment(deployCfg); err != nil {
-			log.WithError(err).Fatal("Invalid config")
+			return nil, err
 		} else {
 			toRet.deployments[deployCfg.Name] = deploy
 		}
 	}
 
-	// Wrap our main HTTP handler
-	handler := http.TimeoutHandler(toRet, webhookTimeout*time.Second, "Request timed out")
-	if cfg.SecretKey != "" {
-		handler = SecretKeyHandler(handler, "X-Key", cfg.SecretKey)
+	// ArgoCD is optional, but the old top-level attributes are still honoured
+	if len(cfg.Argo) == 0 && cfg.ArgoUrl != "" {
+		log.Warn("argocd_url and argocd_token are deprecated, use an argocd block instead")
+		cfg.Argo = []ArgoConfig{{Url: cfg.ArgoUrl, Token: cfg.ArgoToken}}
+	}
+	toRet.argoServers = make(map[string]*ArgoClient)
+	for _, argoCfg := range cfg.Argo {
+		if argoCfg.Name == "" {
+			argoCfg.Name = defaultArgoServer
+		}
+		if _, ok := toRet.argoServers[argoCfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate argocd server: %s", argoCfg.Name)
+		}
+		toRet.argoServers[argoCfg.Name] = NewArgoClient(argoCfg)
+	}
+	for _, deployment := range toRet.deployments {
+		if err := toRet.checkArgoServer(deployment); err != nil {
+			return nil, err
+		}
 	}
-	handler = InstrumentHandler(handler)
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/health", func(resp http.ResponseWriter, req *http.Request) {
-		resp.WriteHeader(http.StatusOK)
-		_, _ = resp.Write([]byte("OK"))
-	})
-	mux.Handle("/", handler)
+	for _, notifierCfg := range cfg.Notifiers {
+		if notifier, err := NewNotifier(notifierCfg); err != nil {
+			return nil, err
+		} else {
+			toRet.notifiers = append(toRet.notifiers, notifier)
+		}
+	}
+	for _, routeCfg := range cfg.Routes {
+		if route, err := NewRoute(routeCfg); err != nil {
+			return nil, err
+		} else {
+			toRet.routes = append(toRet.routes, route)
+		}
+	}
+	for _, groupCfg := range cfg.PRGroups {
+		if group, err := NewPRGroup(groupCfg, toRet); err != nil {
+			return nil, err
+		} else {
+			toRet.prGroups = append(toRet.prGroups, group)
+		}
+	}
+	if sources, err := newSources(cfg); err != nil {
+		return nil, err
+	} else {
+		toRet.sources = sources
+	}
+	if cfg.CredentialCheckInterval != "" {
+		if interval, err := time.ParseDuration(cfg.CredentialCheckInterval); err != nil {
+			return nil, fmt.Errorf("invalid credential_check_interval: %w", err)
+		} else {
+			toRet.checker = NewCredentialChecker(interval, toRet)
+		}
+	}
+	if cfg.Reconcile != nil {
+		if reconciler, err := NewReconciler(*cfg.Reconcile, toRet); err != nil {
+			return nil, err
+		} else {
+			toRet.reconciler = reconciler
+		}
+	}
+	if cfg.Kubernetes != nil {
+		toRet.kubeconfig = cfg.Kubernetes.Kubeconfig
+	}
+	if cfg.Kubernetes != nil && cfg.Kubernetes.WatchResources {
+		toRet.watcher = NewResourceWatcher(*cfg.Kubernetes, toRet)
+	}
 
+	return toRet, nil
+}
+
+// newListener wraps a mux with the configured headers and allowlist, and serves it on the address
+func (s *WebhookServer) newListener(cfg Config, address string, mux *http.ServeMux, allowed []*net.IPNet) *http.Server {
+	// Headers and CORS apply to every response, including authentication failures
+	handler := BodyLimitHandler(mux, s.maxBodySize)
+	if cfg.CORS != nil {
+		handler = CORSHandler(handler, *cfg.CORS)
+	}
+	if len(cfg.ResponseHeaders) > 0 {
+		handler = HeadersHandler(handler, cfg.ResponseHeaders)
+	}
 	// Allowed IPs should protect the entire mux
-	if len(cfg.AllowedIPs) > 0 {
-		// Parse each IP as a CIDR
-		networks := ParseCIDRs(cfg.AllowedIPs)
-		toRet.Server.Handler = IPAllowlistHandler(mux, networks)
-	} else {
-		toRet.Server.Handler = mux
+	if len(allowed) > 0 {
+		handler = IPAllowlistHandler(handler, allowed)
+	}
+	// Which needs to see the client's address, rather than the proxy's
+	if len(s.trustedProxies) > 0 {
+		handler = ClientIPHandler(handler, s.trustedProxies)
+	}
+	// Every response gets a request ID, even if it's rejected
+	handler = RequestIDHandler(handler)
+
+	return &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		WriteTimeout: s.timeouts.Webhook + time.Second,
+	}
+}
+
+// addListener adds a dedicated listener, whose allowed IPs replace the webhook's if set
+func (s *WebhookServer) addListener(cfg Config, address string, mux *http.ServeMux, allowedIPs []string, fallback []*net.IPNet) error {
+	allowed := fallback
+	if len(allowedIPs) > 0 {
+		var err error
+		if allowed, err = ParseCIDRs(allowedIPs); err != nil {
+			return err
+		}
+	}
+	s.listeners = append(s.listeners, s.newListener(cfg, address, mux, allowed))
+
+	return nil
+}
+
+// Handler returns the webhook listener's handler, including its middleware, for programs which serve it themselves
+func (s *WebhookServer) Handler() http.Handler {
+	return s.listeners[0].Handler
+}
+
+// ListenAndServe runs every listener, including the gRPC API, until they are shut down
+// or one of them fails
+func (s *WebhookServer) ListenAndServe() error {
+	errChan := make(chan error, len(s.listeners)+1)
+	for _, listener := range s.listeners {
+		go func(listener *http.Server) {
+			log.WithField("address", listener.Addr).Debug("Serving HTTP")
+			address := listener.Addr
+			if address == "" {
+				address = ":http"
+			}
+			netListener, err := s.listen(address)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			errChan <- listener.Serve(netListener)
+		}(listener)
+	}
+	running := len(s.listeners)
+	if s.grpcServer != nil {
+		go func() {
+			errChan <- s.serveGRPC()
+		}()
+		running++
+	}
+	for ; running > 0; running-- {
+		if err := <-errChan; err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, grpc.ErrServerStopped) {
+			return err
+		}
+	}
+
+	return http.ErrServerClosed
+}
+
+// Shutdown gracefully stops every listener together
+func (s *WebhookServer) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(s.listeners))
+	for _, listener := range s.listeners {
+		wg.Add(1)
+		go func(listener *http.Server) {
+			defer wg.Done()
+			errChan <- listener.Shutdown(ctx)
+		}(listener)
+	}
+	if s.grpcServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.grpcServer.GracefulStop()
+		}()
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunConsumers starts any configured background consumers, which run until the context is cancelled
+func (s *WebhookServer) RunConsumers(ctx context.Context) {
+	for _, source := range s.sources {
+		go source.Run(ctx, s)
+	}
+	if s.watcher != nil {
+		go s.watcher.Run(ctx)
+	}
+	if s.checker != nil {
+		go s.checker.Run(ctx)
+	}
+	if s.reconciler != nil {
+		go s.reconciler.Run(ctx)
+	}
+	for _, group := range s.prGroups {
+		go group.Run(ctx)
+	}
+	if s.persister != nil {
+		go s.persister.Run(ctx)
+	}
+	go s.expireApprovals(ctx)
+}
+
+// loadState starts saving the state to its backend, after taking on whatever was saved before
+func (s *WebhookServer) loadState(cfg StateConfig, checksum string) error {
+	persister, err := newStatePersister(cfg, checksum, s)
+	if err != nil {
+		return err
+	}
+	s.state.enableJournal()
+	s.idempotency.persist = s.state.recordDelivery
+	ctx, cancel := context.WithTimeout(context.Background(), stateSyncTimeout*time.Second)
+	defer cancel()
+	if err := persister.sync(ctx); err != nil {
+		return fmt.Errorf("could not load state from %s backend: %w", cfg.Backend, err)
+	}
+	s.persister = persister
+
+	return nil
+}
+
+// serveGRPC runs the gRPC API, returning once it is stopped
+func (s *WebhookServer) serveGRPC() error {
+	listener, err := s.listen(s.grpcAddr)
+	if err != nil {
+		return fmt.Errorf("could not listen for gRPC: %w", err)
+	}
+	log.WithField("address", s.grpcAddr).Info("Serving gRPC API")
+
+	return s.grpcServer.Serve(listener)
+}
+
+// listen opens a TCP listener, which expects PROXY headers if configured to
+func (s *WebhookServer) listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if s.proxyProtocol {
+		listener = newProxyListener(listener, s.trustedProxies)
+	}
+
+	return listener, nil
+}
+
+// lookupDeployment finds a deployment by name, preferring those from the config file
+func (s *WebhookServer) lookupDeployment(name string) (*Deployment, bool) {
+	if deployment, ok := s.deployments[name]; ok {
+		return deployment, true
+	}
+	s.resourceMutex.RLock()
+	defer s.resourceMutex.RUnlock()
+	deployment, ok := s.resourceDeployments[name]
+
+	return deployment, ok
+}
+
+// lookupRepository finds a repository by name, preferring those from the config file
+func (s *WebhookServer) lookupRepository(name string) (*Repository, bool) {
+	if repo, ok := s.repositories[name]; ok {
+		return repo, true
+	}
+	s.resourceMutex.RLock()
+	defer s.resourceMutex.RUnlock()
+	repo, ok := s.resourceRepositories[name]
+
+	return repo, ok
+}
+
+// allDeployments returns a snapshot of every known deployment
+func (s *WebhookServer) allDeployments() []*Deployment {
+	s.resourceMutex.RLock()
+	defer s.resourceMutex.RUnlock()
+	toRet := make([]*Deployment, 0, len(s.deployments)+len(s.resourceDeployments))
+	for _, deployment := range s.deployments {
+		toRet = append(toRet, deployment)
+	}
+	for name, deployment := range s.resourceDeployments {
+		if _, ok := s.deployments[name]; !ok {
+			toRet = append(toRet, deployment)
+		}
 	}
 
 	return toRet
 }
 
-func (s *WebhookServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	logData := make(log.Fields)
+// allRepositories returns a snapshot of every known repository, keyed by name
+func (s *WebhookServer) allRepositories() map[string]*Repository {
+	s.resourceMutex.RLock()
+	defer s.resourceMutex.RUnlock()
+	toRet := make(map[string]*Repository, len(s.repositories)+len(s.resourceRepositories))
+	for name, repo := range s.resourceRepositories {
+		toRet[name] = repo
+	}
+	for name, repo := range s.repositories {
+		toRet[name] = repo
+	}
+
+	return toRet
+}
+
+func (s *WebhookServer) addRepository(namespace string, cfg RepositoryConfig) error {
+	repo, err := NewRepository(cfg)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.repositories[cfg.Name]; ok {
+		log.WithField("repository", cfg.Name).Warn("Repository resource is shadowed by the config file")
+	}
+	s.resourceMutex.Lock()
+	defer s.resourceMutex.Unlock()
+	if owner, ok := s.resourceRepositoryNamespaces[cfg.Name]; ok && owner != namespace {
+		return fmt.Errorf("repository %s is already defined in namespace %s", cfg.Name, owner)
+	}
+	// Informers resend resources on every update and resync, so the replacement must share the
+	// existing locks, or in-flight updates would race with new ones on the same paths
+	if existing, ok := s.resourceRepositories[cfg.Name]; ok {
+		repo.locks = existing.locks
+	}
+	s.resourceRepositories[cfg.Name] = repo
+	s.resourceRepositoryNamespaces[cfg.Name] = namespace
+	log.WithField("repository", cfg.Name).Info("Repository loaded from Kubernetes")
+
+	return nil
+}
+
+func (s *WebhookServer) removeRepository(namespace string, name string) {
+	s.resourceMutex.Lock()
+	defer s.resourceMutex.Unlock()
+	if s.resourceRepositoryNamespaces[name] != namespace {
+		return
+	}
+	delete(s.resourceRepositories, name)
+	delete(s.resourceRepositoryNamespaces, name)
+	log.WithField("repository", name).Info("Repository removed from Kubernetes")
+}
+
+func (s *WebhookServer) addDeployment(namespace string, cfg DeploymentConfig) error {
+	deployment, err := NewDeployment(cfg)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.deployments[cfg.Name]; ok {
+		log.WithField("deployment", cfg.Name).Warn("Deployment resource is shadowed by the config file")
+	}
+	if err := s.checkArgoServer(deployment); err != nil {
+		return err
+	}
+	s.resourceMutex.Lock()
+	defer s.resourceMutex.Unlock()
+	if owner, ok := s.resourceDeploymentNamespaces[cfg.Name]; ok && owner != namespace {
+		return fmt.Errorf("deployment %s is already defined in namespace %s", cfg.Name, owner)
+	}
+	s.resourceDeployments[cfg.Name] = deployment
+	s.resourceDeploymentNamespaces[cfg.Name] = namespace
+	log.WithField("deployment", cfg.Name).Info("Deployment loaded from Kubernetes")
+
+	return nil
+}
+
+func (s *WebhookServer) removeDeployment(namespace string, name string) {
+	s.resourceMutex.Lock()
+	defer s.resourceMutex.Unlock()
+	if s.resourceDeploymentNamespaces[name] != namespace {
+		return
+	}
+	delete(s.resourceDeployments, name)
+	delete(s.resourceDeploymentNamespaces, name)
+	forgetDeployedTags(name)
+	log.WithField("deployment", name).Info("Deployment removed from Kubernetes")
+}
 
+func (s *WebhookServer) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	if req.Method != http.MethodPost {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		_, _ = resp.Write([]byte("Method not allowed"))
+		writeResponse(resp, newResponse(http.StatusMethodNotAllowed, "Method not allowed"))
 		return
 	}
 	// Read the payload
-	payloadBytes, err := io.ReadAll(req.Body)
-	if err != nil {
-		log.WithError(err).Warn("Failed to read payload")
-		resp.WriteHeader(500)
-		_, _ = io.WriteString(resp, "Failed to read payload")
+	payloadBytes, rejection := readPayload(req, s.maxJSONDepth)
+	if rejection != nil {
+		writeResponse(resp, *rejection)
 		return
 	}
 	// Decode the request
-	var payload webhookPayload
-	strictErr, err := json.UnmarshalStrict(payloadBytes, &payload, json.DisallowDuplicateFields, json.DisallowUnknownFields)
-	firstError := err
-	if firstError == nil && len(strictErr) > 0 {
-		firstError = strictErr[0]
-	}
+	var payload UpdateRequest
+	firstError := decodePayload(payloadBytes, &payload)
 	if firstError != nil {
-		log.WithError(firstError).Warn("Failed to decode payload")
-		resp.WriteHeader(500)
-		_, _ = io.WriteString(resp, "Failed to decode payload")
+		log.WithError(firstError).WithField("request_id", RequestIDFromContext(req.Context())).Warn("Failed to decode payload")
+		writeResponse(resp, newResponse(http.StatusBadRequest, "Failed to decode payload"))
 		return
 	}
 	// And validate it
-	if err := payload.Validate(); err != nil {
-		resp.WriteHeader(http.StatusBadRequest)
-		_, _ = io.WriteString(resp, err.Error())
+	payload.RequestID = RequestIDFromContext(req.Context())
+	if payload.isFanOut() {
+		s.fanOut(resp, payload)
 		return
 	}
+	logData := requestLogFields(payload)
+	logData["source"] = "webhook"
+	deployment, rejection := s.prepareUpdate(&payload)
+	if rejection != nil {
+		writeResponse(resp, *rejection)
+		return
+	}
+	// Turn the request away now if its repository is saturated, rather than letting it time out in the queue
+	if rejection := s.admit(deployment, payload, "webhook"); rejection != nil {
+		writeResponse(resp, *rejection)
+		return
+	}
+	// Repositories may allow longer than the server's own write timeout
+	webhookTimeout := s.timeoutsFor(deployment, payload).Webhook
+	_ = http.NewResponseController(resp).SetWriteDeadline(time.Now().Add(webhookTimeout + time.Second))
+	timer := time.NewTimer(webhookTimeout)
+	defer timer.Stop()
+	// Repeated deliveries get the original's result, rather than being applied again
+	var delivery *idempotentDelivery
+	if key := idempotencyKey(req); key != "" {
+		var repeated bool
+		if delivery, repeated = s.idempotency.claim(key, payloadBytes); repeated {
+			logData["idempotency_key"] = key
+			s.backlog.leave(backlogKey(deployment, payload), deployment.RepositoryName)
+			s.replayDelivery(resp, delivery, payloadBytes, timer, logData)
+			return
+		}
+	}
+	// Hand off to the update pipeline, which carries on in the background if it outlives the request
+	job, done := s.submit(deployment, payload, logData)
+	if delivery != nil {
+		done = delivery.track(job, done)
+	}
+	select {
+	case result := <-done:
+		writeResponse(resp, result)
+	case <-timer.C:
+		log.WithFields(logData).Info("Update is taking too long, continuing in the background")
+		accepted := newResponse(http.StatusAccepted, "Update is still in progress")
+		accepted.JobId = job.ID
+		writeResponse(resp, accepted)
+	}
+}
+
+// replayDelivery responds to a repeated delivery with the outcome of the first, waiting for it if needed
+func (s *WebhookServer) replayDelivery(resp http.ResponseWriter, delivery *idempotentDelivery, payloadBytes []byte, timer *time.Timer, logData log.Fields) {
+	if !delivery.matches(payloadBytes) {
+		log.WithFields(logData).Warn("Idempotency key was reused for a different request")
+		writeResponse(resp, newResponse(http.StatusUnprocessableEntity, "Idempotency key was already used for a different request"))
+		return
+	}
+	log.WithFields(logData).Info("Repeated delivery, replaying the original result")
+	resp.Header().Set(idempotentReplayHeader, "true")
+	<-delivery.started
+	select {
+	case <-delivery.done:
+		writeResponse(resp, delivery.response)
+	case <-timer.C:
+		accepted := newResponse(http.StatusAccepted, "Update is still in progress")
+		accepted.JobId = delivery.jobID
+		writeResponse(resp, accepted)
+	}
+}
+
+// prepareUpdate validates a payload and finds its deployment, returning a response if it should be rejected
+// NB: The payload's tag is normalized in place
+func (s *WebhookServer) prepareUpdate(payload *UpdateRequest) (*Deployment, *UpdateResponse) {
+	reject := func(code int, message string) (*Deployment, *UpdateResponse) {
+		resp := newResponse(code, message)
+		return nil, &resp
+	}
+	if err := payload.Validate(); err != nil {
+		return reject(http.StatusBadRequest, err.Error())
+	}
 	// Look up the deployment
-	logData["deployment"] = payload.Deployment
-	logData["authorized_by"] = payload.AuthorizedBy
-	deployment, ok := s.deployments[payload.Deployment]
+	deployment, ok := s.lookupDeployment(payload.Deployment)
 	if !ok {
-		resp.WriteHeader(http.StatusNotFound)
-		_, _ = resp.Write([]byte("Deployment not found"))
-		return
+		return reject(http.StatusNotFound, "Deployment not found")
+	}
+	// Now that we know the deployment, normalize the tag and check any extra fields against it
+	var err error
+	if len(payload.Images) > 0 {
+		if err := deployment.ValidateImages(payload.Images); err != nil {
+			return reject(http.StatusBadRequest, err.Error())
+		}
+		for image, tag := range payload.Images {
+			if payload.Images[image], err = deployment.NormalizeTag(tag); err != nil {
+				return reject(http.StatusBadRequest, err.Error())
+			}
+		}
+	} else if payload.TagName, err = deployment.NormalizeTag(payload.TagName); err != nil {
+		return reject(http.StatusBadRequest, err.Error())
+	}
+	if err := deployment.ValidateExtra(payload.Extra); err != nil {
+		return reject(http.StatusBadRequest, err.Error())
+	}
+	// The payload is well formed, but the deployment may still refuse its tags
+	if err := deployment.AllowTags(*payload); err != nil {
+		return reject(http.StatusUnprocessableEntity, err.Error())
+	}
+	// As well as any repository that it names
+	if _, err := s.repositoryFor(deployment, *payload); err != nil && !errors.Is(err, errRepositoryNotFound) {
+		return reject(http.StatusBadRequest, err.Error())
+	}
+
+	return deployment, nil
+}
+
+// performUpdate runs the update pipeline for a single deployment and kicks off any follow-up actions,
+// returning the response that describes the outcome
+func (s *WebhookServer) performUpdate(ctx context.Context, deployment *Deployment, payload UpdateRequest, logData log.Fields) UpdateResponse {
+	return s.runUpdate(ctx, s.jobs.Create(payload), deployment, payload, logData)
+}
+
+// runUpdate runs the update pipeline on behalf of an existing job
+func (s *WebhookServer) runUpdate(ctx context.Context, job *Job, deployment *Deployment, payload UpdateRequest, logData log.Fields) UpdateResponse {
+	logData["job_id"] = job.ID
+	// Policies are checked first, so that nobody is asked to approve something which can't be deployed
+	if deployment.Policy != nil {
+		policyCtx, cancel := context.WithTimeout(ctx, policyTimeout*time.Second)
+		digests, err := deployment.Policy.Verify(policyCtx, deployment, payload)
+		cancel()
+		if err != nil {
+			log.WithFields(logData).WithError(err).Warn("Update rejected by policy")
+			toRet := newResponse(http.StatusForbidden, err.Error())
+			toRet.JobId = job.ID
+			s.resolveJob(job, deployment, payload, StatusFailed, "", err.Error())
+			return toRet
+		}
+		// Tags can be moved after they're verified, so verified images are pinned to their digests
+		payload.Digests = digests
+	}
+	if payload.DryRun {
+		return s.dryRun(ctx, job, deployment, payload, logData)
+	}
+	// Updates which need a human in the loop wait until they're approved
+	if deployment.RequiresApproval {
+		s.requestApproval(job, deployment, payload)
+		log.WithFields(logData).Info("Update is awaiting approval")
+		toRet := newResponse(http.StatusAccepted, "Awaiting approval")
+		toRet.JobId = job.ID
+		return toRet
+	}
+
+	return s.runApprovedUpdate(ctx, job, deployment, payload, logData)
+}
+
+// dryRun applies an update without pushing it, skipping approval, freezes and pull request groups
+// NB: Dry runs never count as updated, as nothing was pushed
+func (s *WebhookServer) dryRun(ctx context.Context, job *Job, deployment *Deployment, payload UpdateRequest, logData log.Fields) UpdateResponse {
+	logData["dry_run"] = true
+	result := s.applyUpdate(ctx, deployment, payload, logData)
+	result.JobId = job.ID
+	status := StatusUnchanged
+	if result.Code != http.StatusOK && result.Code != http.StatusNotModified {
+		status = StatusFailed
+	}
+	s.resolveJob(job, deployment, payload, status, "", result.Message)
+
+	return result
+}
+
+// runApprovedUpdate runs the update pipeline for a job which doesn't need (or has been given) approval
+func (s *WebhookServer) runApprovedUpdate(ctx context.Context, job *Job, deployment *Deployment, payload UpdateRequest, logData log.Fields) UpdateResponse {
+	// Frozen deployments either turn updates away, or hold them until the freeze ends
+	if until, frozen := deployment.frozenUntil(time.Now()); frozen {
+		message := fmt.Sprintf("Deployment is frozen until %s", until.Format(time.RFC3339))
+		if deployment.FreezeAction == FreezeActionReject {
+			log.WithFields(logData).Info("Update rejected by freeze")
+			toRet := newResponse(http.StatusLocked, message)
+			toRet.JobId = job.ID
+			s.resolveJob(job, deployment, payload, StatusFailed, "", message)
+			return toRet
+		}
+		s.freezes.Enqueue(job, deployment, payload, until)
+		log.WithFields(logData).Infof("Update queued until %s", until.Format(time.RFC3339))
+		toRet := newResponse(http.StatusAccepted, message)
+		toRet.JobId = job.ID
+		return toRet
+	}
+	// Grouped deployments are proposed in a pull request later, rather than pushed now
+	if group := s.prGroupFor(deployment); group != nil {
+		group.Enqueue(job, deployment, payload)
+		log.WithFields(logData).Infof("Update queued for pull request group %s", group.Name)
+		toRet := newResponse(http.StatusAccepted, fmt.Sprintf("Queued for pull request group %s", group.Name))
+		toRet.JobId = job.ID
+		return toRet
+	}
+
+	result := s.applyUpdate(ctx, deployment, payload, logData)
+	result.JobId = job.ID
+	if result.Code != http.StatusOK {
+		status := StatusFailed
+		if result.Code == http.StatusNotModified {
+			status = StatusUnchanged
+		}
+		s.resolveJob(job, deployment, payload, status, "", result.Message)
+		return result
+	}
+
+	log.Infof("Deployment %s was updated to %s by %s", deployment.Name, payload.Tags(), payload.AuthorizedBy)
+	s.state.RecordUpdate(HistoryEntry{
+		Deployment:   deployment.Name,
+		TagName:      payload.Tags(),
+		PreviousTag:  result.PreviousTag,
+		PreviousTags: result.PreviousTags,
+		Images:       payload.Images,
+		Digests:      payload.Digests,
+		Revision:     result.Revision,
+		AuthorizedBy: payload.AuthorizedBy,
+		Time:         time.Now(),
+	})
+	publishDeployedTags(deployment, result.Images)
+	s.notify(deployment, notification{
+		Event:   EventUpdated,
+		Message: fmt.Sprintf("Updated to %s by %s", payload.Tags(), payload.AuthorizedBy),
+		Payload: payload,
+		Fields:  map[string]string{"revision": result.Revision},
+	})
+
+	// Finally trigger ArgoCD, Flux or a rollout in the background, because we have to wait for them to refresh
+	if result.Sync = s.startSync(job, deployment, payload, result.Revision); result.Sync == "" {
+		s.resolveJob(job, deployment, payload, StatusUpdated, result.Revision, "")
 	}
+
+	return result
+}
+
+// Values of UpdateResponse.Sync
+const (
+	SyncArgoCD  = "argocd"
+	SyncFlux    = "flux"
+	SyncRollout = "rollout"
+)
+
+// startSync triggers the deployment's ArgoCD application, Flux kustomization or workload rollout in the background,
+// returning which it triggered, or an empty string if it has none
+func (s *WebhookServer) startSync(job *Job, deployment *Deployment, payload UpdateRequest, revision string) string {
+	if s.argoFor(deployment) != nil && deployment.ApplicationName != "" {
+		go s.argoSync(job, deployment, payload, revision)
+		return SyncArgoCD
+	}
+	if deployment.Flux != nil {
+		go s.fluxReconcile(job, deployment, payload, revision)
+		return SyncFlux
+	}
+	if deployment.Rollout != nil {
+		go s.rollout(job, deployment, payload, revision)
+		return SyncRollout
+	}
+
+	return ""
+}
+
+// applyUpdate runs the fetch, apply and push cycle for a single deployment
+func (s *WebhookServer) applyUpdate(ctx context.Context, deployment *Deployment, payload UpdateRequest, logData log.Fields) UpdateResponse {
 	// Look up the repository
 	logData["repository"] = deployment.RepositoryName
-	repo, ok := s.repositories[deployment.RepositoryName]
-	if !ok {
-		log.WithFields(logData).Error("Repository not found")
-		resp.WriteHeader(http.StatusInternalServerError)
-		_, _ = resp.Write([]byte("Internal server error"))
-		return
+	if payload.RepositoryUrl != "" {
+		logData["repository_url"] = payload.RepositoryUrl
 	}
-	// Lock the repository, to avoid merge conflicts
-	repo.Mutex.Lock()
-	defer repo.Mutex.Unlock()
+	repo, err := s.repositoryFor(deployment, payload)
+	if err != nil {
+		log.WithFields(logData).WithError(err).Error("Repository not found")
+		return newResponse(http.StatusInternalServerError, "Internal server error")
+	}
+	timer := newStageTimer()
+	timings := &updateTimings{}
+	// Lock the paths we modify, to avoid merge conflicts with other deployments in the repository
+	// NB: Force pushes would silently drop commits made to other paths in the meantime, so they lock everything
+	paths := deployment.Paths()
+	if repo.forcePush {
+		paths = nil
+	}
+	unlock := repo.Lock(paths)
+	defer unlock()
+	timings.LockWait = timer.lap()
 	// Short circuit the repo allocations if we've already timed out
-	if req.Context().Err() != nil {
-		return
+	if ctx.Err() != nil {
+		return newResponse(http.StatusGatewayTimeout, "Update timed out")
 	}
-	// Attempt to fetch the repository, with timeout
-	defer repo.Discard()
-	if err, details := repo.Fetch(req.Context()); err != nil {
-		log.WithFields(logData).WithError(err).Warn("Failed to fetch repository")
-		log.WithFields(logData).WithError(err).Debugf("Details: %s", details)
-		resp.WriteHeader(http.StatusInternalServerError)
-		_, _ = resp.Write([]byte("Internal server error"))
-		return
+	timeouts := s.timeouts.override(repo.timeouts)
+	// Repeated requests can usually be answered without a clone
+	precheckCtx, cancel := withTimeout(ctx, timeouts.Clone)
+	unchanged := s.alreadyApplied(precheckCtx, repo, deployment, payload)
+	cancel()
+	if unchanged {
+		log.WithFields(logData).Debug("Deployment is already up to date")
+		toRet := newResponse(http.StatusNotModified, "No changes made")
+		toRet.Timings = timings
+		return toRet
 	}
-	// Hand the worktree to the deployment, to update
-	var newRevision string
-	if wt, err := repo.Worktree(); err != nil {
-		log.WithFields(logData).WithError(err).Warn("Failed to fetch worktree")
-		resp.WriteHeader(http.StatusInternalServerError)
-		_, _ = resp.Write([]byte("Internal server error"))
-		return
-	} else {
-		if newRevision, err = deployment.Apply(wt, payload.TagName, payload.AuthorizedBy); err != nil {
-			if errors.Is(err, errorNoModification) {
-				resp.WriteHeader(http.StatusNotModified)
-				_, _ = resp.Write([]byte("No changes made"))
-				return
+
+	// Updates to other paths may push first, in which case we start over from their commit
+	var applied ApplyResult
+	for attempt := 1; ; attempt++ {
+		// Attempt to fetch the repository, with timeout
+		cloneCtx, cancel := withTimeout(ctx, timeouts.Clone)
+		checkout, err, details := repo.Fetch(cloneCtx)
+		cancel()
+		if err != nil {
+			log.WithFields(logData).WithError(err).Warn("Failed to fetch repository")
+			log.WithFields(logData).WithError(err).Debugf("Details: %s", details)
+			return upstreamFailure(err, "Failed to fetch repository")
+		}
+		// NB: Each attempt closes its own checkout on the way out, so that retries don't hold on to them
+		timings.Clone += timer.lap()
+		// Hand the worktree to the deployment, to update
+		if wt, err := checkout.Worktree(); err != nil {
+			checkout.Close()
+			log.WithFields(logData).WithError(err).Warn("Failed to fetch worktree")
+			return newResponse(http.StatusInternalServerError, "Internal server error")
+		} else {
+			if applied, err = deployment.Apply(wt, payload); err != nil {
+				checkout.Close()
+				if errors.Is(err, errorNoModification) {
+					return newResponse(http.StatusNotModified, "No changes made")
+				}
+				log.WithFields(logData).WithError(err).Warn("Failed to apply deployment")
+				// NB: These are problems with the deployment's files or config, which retrying won't fix
+				return newError(http.StatusUnprocessableEntity, ErrorApplyFailed, fmt.Sprintf("Failed to apply deployment: %v", err))
 			}
-			log.WithFields(logData).WithError(err).Warn("Failed to apply deployment")
-			resp.WriteHeader(http.StatusInternalServerError)
-			_, _ = resp.Write([]byte("Internal server error"))
-			return
 		}
-	}
-	// And finally, push the changes upstream
-	if err, details := repo.Push(req.Context()); err != nil {
+		timings.Apply += timer.lap()
+		if payload.DryRun {
+			checkout.Close()
+			log.WithFields(logData).Info("Dry run succeeded, not pushing")
+			break
+		}
+		// And finally, push the changes upstream
+		pushCtx, cancel := withTimeout(ctx, timeouts.Push)
+		err, details = checkout.Push(pushCtx)
+		cancel()
+		checkout.Close()
+		timings.Push += timer.lap()
+		if err == nil {
+			break
+		}
+		if isPushConflict(err) && attempt < pushAttempts {
+			log.WithFields(logData).Debug("Repository changed during update, retrying")
+			continue
+		}
 		log.WithFields(logData).WithError(err).Warn("Failed to push repository")
 		log.WithFields(logData).WithError(err).Debugf("Details: %s", details)
-		resp.WriteHeader(http.StatusInternalServerError)
-		_, _ = resp.Write([]byte("Internal server error"))
-		return
+		s.notify(deployment, notification{
+			Event:   EventPushFailed,
+			Message: fmt.Sprintf("Failed to push %s: %v", payload.Tags(), err),
+			Payload: payload,
+		})
+		if isPushConflict(err) {
+			return newError(http.StatusConflict, ErrorPushConflict, "Repository kept changing during the update")
+		}
+		return upstreamFailure(err, "Failed to push repository")
 	}
-	// Let the caller know we're done
-	log.Infof("Deployment %s was updated to %s by %s", payload.Deployment, payload.TagName, payload.AuthorizedBy)
-	resp.WriteHeader(http.StatusOK)
-	_, _ = resp.Write([]byte("OK"))
+	log.WithFields(logData).WithFields(timings.logFields()).Debug("Update timings")
+
+	toRet := newResponse(http.StatusOK, "OK")
+	toRet.Revision = applied.Revision
+	// The commit only exists in the discarded checkout
+	if payload.DryRun {
+		toRet.Message = "Dry run succeeded, nothing was pushed"
+		toRet.Revision = ""
+	}
+	toRet.PreviousTag = applied.PreviousTag
+	toRet.PreviousTags = applied.PreviousTags
+	toRet.Images = applied.Images
+	toRet.Timings = timings
+	toRet.DuplicatePolicy = deployment.DuplicatePolicy
+	return toRet
+}
 
-	// Finally trigger ArgoCD in the background, because we have to wait for it to refresh
-	if s.argoUrl != "" && deployment.ApplicationName != "" {
-		go s.argoSync(deployment.ApplicationName, newRevision)
+// upstreamFailure describes a failed fetch or push, distinguishing timeouts and rejected credentials from other
+// failures of the git server
+func upstreamFailure(err error, message string) UpdateResponse {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return newResponse(http.StatusGatewayTimeout, message+": timed out")
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed):
+		return newError(http.StatusBadGateway, ErrorUpstreamAuth, message+": credentials were rejected")
+	default:
+		return newResponse(http.StatusBadGateway, message)
 	}
 }
@@ -0,0 +1,75 @@
+package pkg_test
+
+import (
+	"fmt"
+	"github.com/predakanga/image-updater/pkg"
+	"github.com/predakanga/image-updater/pkg/pkgtest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKustomization = `resources:
+  - deployment.yaml
+images:
+  - name: example/app
+    newTag: v1
+`
+
+func TestUpdatePushesAndSyncs(t *testing.T) {
+	git := pkgtest.NewGitServer(t)
+	repoUrl := git.CreateRepository(t, "config", map[string]string{"app/kustomization.yaml": testKustomization})
+	argo := pkgtest.NewArgoServer(t)
+	argo.AddApplication("app")
+	argo.Follow(git, "config", pkgtest.DefaultBranch, "app")
+
+	harness := pkgtest.NewHarness(t, fmt.Sprintf(`
+secret_key = "test"
+
+argocd {
+  url       = %q
+  token     = "token"
+  plaintext = true
+}
+
+repository "config" {
+  url             = %q
+  committer_name  = "Image Updater"
+  committer_email = "updater@example.com"
+}
+
+deployment "app" {
+  repository = "config"
+  path       = "app/kustomization.yaml"
+  image      = ["example/app"]
+  argocd_app = "app"
+}
+`, argo.Address(), repoUrl))
+
+	resp := harness.Update(t, pkg.UpdateRequest{Deployment: "app", TagName: "v2", AuthorizedBy: "ci"})
+	if resp.Code != http.StatusOK && resp.Code != http.StatusAccepted {
+		t.Fatalf("unexpected update response %d: %s", resp.Code, resp.Message)
+	}
+	job := harness.WaitForJob(t, resp.JobId, 10*time.Second)
+	if job.Status != pkg.StatusSynced {
+		t.Fatalf("job finished as %s: %s", job.Status, job.Message)
+	}
+
+	// The pushed commit carries the new tag, and is what ArgoCD was asked to sync
+	head := git.Head(t, "config", "refs/heads/"+pkgtest.DefaultBranch)
+	if head.Hash.String() != job.Revision {
+		t.Errorf("job revision %s does not match pushed commit %s", job.Revision, head.Hash)
+	}
+	kustomization := git.ReadFile(t, "config", pkgtest.DefaultBranch, "app/kustomization.yaml")
+	if !strings.Contains(kustomization, "newTag: v2") {
+		t.Errorf("pushed kustomization was not updated:\n%s", kustomization)
+	}
+	syncs := argo.Syncs("app")
+	if len(syncs) != 1 {
+		t.Fatalf("expected 1 sync, got %d", len(syncs))
+	}
+	if app := argo.Application("app"); app.Status.Sync.Revision != head.Hash.String() {
+		t.Errorf("application synced %s rather than %s", app.Status.Sync.Revision, head.Hash)
+	}
+}
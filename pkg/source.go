@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Source produces update requests from somewhere other than the webhook, such as a registry
+// poller or a queue consumer
+//
+// NB: The webhook and gRPC API are served from the server's own listeners, but submit their
+// requests to the same pipeline
+type Source interface {
+	// Name identifies the source in logs
+	Name() string
+	// Run submits requests to the pipeline until the context is cancelled
+	Run(ctx context.Context, pipeline Pipeline)
+}
+
+// Pipeline is the core update pipeline, as seen by sources
+type Pipeline interface {
+	// Deployments lists every deployment that requests may target
+	Deployments() []*Deployment
+	// Submit validates a request and starts updating its deployment in the background
+	// The channel receives the outcome; the job is nil if the request was rejected outright
+	Submit(source string, request UpdateRequest) (*Job, <-chan UpdateResponse)
+	// RouteEvent matches an event to deployments using the configured routes, for sources which
+	// don't know which deployments their events are for
+	RouteEvent(source string, event []byte) ([]UpdateRequest, error)
+}
+
+// SourceFactory creates a source from the config, returning nil if it isn't configured
+type SourceFactory func(cfg Config) (Source, error)
+
+var sourceFactories []SourceFactory
+
+// RegisterSource adds a kind of source, usually from an init function in the file which defines it
+func RegisterSource(factory SourceFactory) {
+	sourceFactories = append(sourceFactories, factory)
+}
+
+func newSources(cfg Config) ([]Source, error) {
+	var toRet []Source
+	for _, factory := range sourceFactories {
+		source, err := factory(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if source != nil {
+			toRet = append(toRet, source)
+		}
+	}
+
+	return toRet, nil
+}
+
+// AddSource adds a source which isn't created from the config, and must be called before RunConsumers
+func (s *WebhookServer) AddSource(source Source) {
+	s.sources = append(s.sources, source)
+}
+
+// Deployments lists both the configured deployments and those defined by Kubernetes resources
+func (s *WebhookServer) Deployments() []*Deployment {
+	return s.allDeployments()
+}
+
+// Submit validates a request and starts updating its deployment in the background
+func (s *WebhookServer) Submit(source string, request UpdateRequest) (*Job, <-chan UpdateResponse) {
+	deployment, rejection := s.prepareUpdate(&request)
+	if rejection != nil {
+		done := make(chan UpdateResponse, 1)
+		done <- *rejection
+		return nil, done
+	}
+	if request.RequestID == "" {
+		request.RequestID = newRequestID()
+	}
+	if rejection := s.admit(deployment, request, source); rejection != nil {
+		done := make(chan UpdateResponse, 1)
+		done <- *rejection
+		return nil, done
+	}
+	logData := requestLogFields(request)
+	logData["source"] = source
+
+	return s.submit(deployment, request, logData)
+}
+
+// submit runs an already prepared and admitted request, which carries on in the background regardless of its caller
+func (s *WebhookServer) submit(deployment *Deployment, request UpdateRequest, logData log.Fields) (*Job, <-chan UpdateResponse) {
+	job := s.jobs.Create(request)
+	done := make(chan UpdateResponse, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeoutsFor(deployment, request).Update)
+		defer cancel()
+		defer s.backlog.leave(backlogKey(deployment, request), deployment.RepositoryName)
+		done <- s.runUpdate(ctx, job, deployment, request, logData)
+	}()
+
+	return job, done
+}
+
+// awaitResponse waits for a submitted request's outcome, unless the context is cancelled first
+func awaitResponse(ctx context.Context, job *Job, done <-chan UpdateResponse) (UpdateResponse, error) {
+	if job == nil {
+		return <-done, nil
+	}
+	select {
+	case result := <-done:
+		return result, nil
+	case <-ctx.Done():
+		return UpdateResponse{}, fmt.Errorf("gave up waiting for job %s: %w", job.ID, ctx.Err())
+	}
+}
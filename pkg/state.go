@@ -0,0 +1,305 @@
+package pkg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const historyLimit = 20
+
+// HistoryEntry records a single successful update
+type HistoryEntry struct {
+	Deployment   string    `json:"deployment"`
+	TagName      string    `json:"tag_name"`
+	PreviousTag  string    `json:"previous_tag,omitempty"`
+	Revision     string    `json:"revision"`
+	AuthorizedBy string    `json:"authorized_by"`
+	Time         time.Time `json:"time"`
+
+	// Images is only set when the images were given independent tags
+	Images map[string]string `json:"images,omitempty"`
+	// PreviousTags lists each image's tag before the update, so that it can be rolled back image by image
+	PreviousTags map[string]string `json:"previous_tags,omitempty"`
+	// Digests holds the verified digests which the tags were pinned to, if the deployment checks signatures
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// PendingUpdate is an update which is waiting to be approved
+type PendingUpdate struct {
+	ID           string            `json:"id"`
+	Deployment   string            `json:"deployment"`
+	TagName      string            `json:"tag_name"`
+	Images       map[string]string `json:"images,omitempty"`
+	AuthorizedBy string            `json:"authorized_by"`
+	RequestedAt  time.Time         `json:"requested_at"`
+	ExpiresAt    time.Time         `json:"expires_at"`
+
+	job     *Job
+	payload UpdateRequest
+}
+
+// StateStore keeps track of what has been done to each deployment, and what is waiting to be done
+type StateStore struct {
+	mutex   sync.Mutex
+	history map[string][]HistoryEntry
+	pending map[string]PendingUpdate
+
+	// The journal is only kept when the state is saved to a backend, which changed prompts to save
+	journal *stateJournal
+	changed chan struct{}
+}
+
+func NewStateStore() *StateStore {
+	return &StateStore{
+		history: make(map[string][]HistoryEntry),
+		pending: make(map[string]PendingUpdate),
+	}
+}
+
+// RecordUpdate appends to a deployment's history, discarding the oldest entries as required
+func (s *StateStore) RecordUpdate(entry HistoryEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history[entry.Deployment] = mergeHistory(s.history[entry.Deployment], entry)
+	s.record(func(journal *stateJournal) {
+		journal.history = append(journal.history, entry)
+	})
+}
+
+// mergeHistory adds an entry to a history in order of time, unless it's already there
+func mergeHistory(history []HistoryEntry, entry HistoryEntry) []HistoryEntry {
+	for _, existing := range history {
+		if existing.Revision == entry.Revision && existing.Time.Equal(entry.Time) {
+			return history
+		}
+	}
+	history = append(history, entry)
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+
+	return history
+}
+
+// History returns a deployment's updates, most recent last
+func (s *StateStore) History(deployment string) []HistoryEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]HistoryEntry(nil), s.history[deployment]...)
+}
+
+// LastUpdate returns the most recent update to a deployment
+func (s *StateStore) LastUpdate(deployment string) (HistoryEntry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := s.history[deployment]
+	if len(history) == 0 {
+		return HistoryEntry{}, false
+	}
+
+	return history[len(history)-1], true
+}
+
+// AddPending stores an update until it is approved, rejected or expires
+func (s *StateStore) AddPending(update PendingUpdate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending[update.ID] = update
+	s.record(func(journal *stateJournal) {
+		journal.added[update.ID] = update
+		delete(journal.removed, update.ID)
+	})
+}
+
+// TakePending removes and returns a pending update, provided it hasn't expired
+func (s *StateStore) TakePending(id string) (PendingUpdate, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update, ok := s.pending[id]
+	if !ok || time.Now().After(update.ExpiresAt) {
+		return PendingUpdate{}, false
+	}
+	delete(s.pending, id)
+	s.record(func(journal *stateJournal) {
+		journal.removed[id] = true
+		delete(journal.added, id)
+	})
+
+	return update, true
+}
+
+// Pending returns every update awaiting approval, oldest first
+func (s *StateStore) Pending() []PendingUpdate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	toRet := make([]PendingUpdate, 0, len(s.pending))
+	for _, update := range s.pending {
+		toRet = append(toRet, update)
+	}
+	sort.Slice(toRet, func(i, j int) bool {
+		return toRet[i].RequestedAt.Before(toRet[j].RequestedAt)
+	})
+
+	return toRet
+}
+
+// ExpirePending removes and returns any pending updates which have passed their expiry
+func (s *StateStore) ExpirePending(now time.Time) []PendingUpdate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var toRet []PendingUpdate
+	for id, update := range s.pending {
+		if now.After(update.ExpiresAt) {
+			toRet = append(toRet, update)
+			delete(s.pending, id)
+			s.record(func(journal *stateJournal) {
+				journal.removed[id] = true
+				delete(journal.added, id)
+			})
+		}
+	}
+
+	return toRet
+}
+
+// recordDelivery notes an idempotent delivery's outcome, which is otherwise kept by the idempotency store
+func (s *StateStore) recordDelivery(key string, delivery persistedDelivery) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.record(func(journal *stateJournal) {
+		journal.deliveries[key] = delivery
+	})
+}
+
+// stateJournal holds the changes made since the state was last saved, so that they can be merged
+// into whatever other replicas have saved in the meantime
+type stateJournal struct {
+	history    []HistoryEntry
+	added      map[string]PendingUpdate
+	removed    map[string]bool
+	deliveries map[string]persistedDelivery
+}
+
+func newStateJournal() *stateJournal {
+	return &stateJournal{
+		added:      make(map[string]PendingUpdate),
+		removed:    make(map[string]bool),
+		deliveries: make(map[string]persistedDelivery),
+	}
+}
+
+func (j *stateJournal) empty() bool {
+	return len(j.history) == 0 && len(j.added) == 0 && len(j.removed) == 0 && len(j.deliveries) == 0
+}
+
+// merge adds a later journal's changes to this one
+func (j *stateJournal) merge(later *stateJournal) {
+	j.history = append(j.history, later.history...)
+	for id, update := range later.added {
+		j.added[id] = update
+		delete(j.removed, id)
+	}
+	for id := range later.removed {
+		j.removed[id] = true
+		delete(j.added, id)
+	}
+	for key, delivery := range later.deliveries {
+		j.deliveries[key] = delivery
+	}
+}
+
+// apply makes the journal's changes to a saved snapshot, dropping any deliveries which have expired
+func (j *stateJournal) apply(snapshot *stateSnapshot, now time.Time) {
+	for _, entry := range j.history {
+		snapshot.History[entry.Deployment] = mergeHistory(snapshot.History[entry.Deployment], entry)
+	}
+	for id := range j.removed {
+		delete(snapshot.Pending, id)
+	}
+	for id, update := range j.added {
+		snapshot.Pending[id] = newPersistedPending(update)
+	}
+	for key, delivery := range j.deliveries {
+		snapshot.Deliveries[key] = delivery
+	}
+	for key, delivery := range snapshot.Deliveries {
+		if now.After(delivery.Expires) {
+			delete(snapshot.Deliveries, key)
+		}
+	}
+}
+
+// enableJournal starts keeping track of changes, so that they can be saved
+func (s *StateStore) enableJournal() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.journal = newStateJournal()
+	s.changed = make(chan struct{}, 1)
+}
+
+// record notes a change for the next save, if the state is being saved
+// NB: Must be called with the mutex held
+func (s *StateStore) record(change func(journal *stateJournal)) {
+	if s.journal == nil {
+		return
+	}
+	change(s.journal)
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// takeJournal returns the changes made since the last save, and starts afresh
+func (s *StateStore) takeJournal() *stateJournal {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	toRet := s.journal
+	s.journal = newStateJournal()
+
+	return toRet
+}
+
+// returnJournal puts back changes which couldn't be saved, ahead of any made since they were taken
+func (s *StateStore) returnJournal(journal *stateJournal) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	journal.merge(s.journal)
+	s.journal = journal
+}
+
+// install replaces the history and pending updates with those of a saved snapshot, then reapplies any
+// changes made since it was taken. Pending updates which are already known keep their jobs, while
+// restore recreates those which were added elsewhere.
+// NB: Updates approved or rejected by another replica are dropped, leaving their jobs to that replica
+func (s *StateStore) install(snapshot *stateSnapshot, restore func(persisted persistedPending) PendingUpdate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := make(map[string]PendingUpdate, len(snapshot.Pending))
+	for id, persisted := range snapshot.Pending {
+		if existing, ok := s.pending[id]; ok {
+			pending[id] = existing
+		} else {
+			pending[id] = restore(persisted)
+		}
+	}
+	history := make(map[string][]HistoryEntry, len(snapshot.History))
+	for deployment, entries := range snapshot.History {
+		history[deployment] = append([]HistoryEntry(nil), entries...)
+	}
+	for _, entry := range s.journal.history {
+		history[entry.Deployment] = mergeHistory(history[entry.Deployment], entry)
+	}
+	for id := range s.journal.removed {
+		delete(pending, id)
+	}
+	for id, update := range s.journal.added {
+		pending[id] = update
+	}
+	s.history, s.pending = history, pending
+}
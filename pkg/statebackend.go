@@ -0,0 +1,313 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	stateFormat              = 1
+	defaultStateSyncInterval = 30
+	// Changes are saved after a short delay, so that those made together are saved together
+	stateSaveDelay   = 1
+	stateSyncTimeout = 30
+	stateSaveRetries = 5
+)
+
+var stateSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "image_updater",
+	Subsystem: "state",
+	Name:      "syncs_total",
+	Help:      "The number of times the state was synced with its backend, by result",
+}, []string{"result"})
+
+// errStateConflict is returned by Save when the state has been saved elsewhere since it was loaded
+var errStateConflict = errors.New("state was saved by another replica")
+
+// StateBackend stores the state snapshot, using versions for optimistic locking
+type StateBackend interface {
+	// Load returns the saved snapshot and its version, or no data if nothing has been saved yet
+	Load(ctx context.Context) ([]byte, string, error)
+	// Save replaces the snapshot if it's still at the given version, returning the new version
+	// NB: An empty version means that nothing should have been saved yet
+	Save(ctx context.Context, data []byte, version string) (string, error)
+}
+
+// StateBackendFactory creates a backend from the state block
+type StateBackendFactory func(cfg StateConfig) (StateBackend, error)
+
+var stateBackends = map[string]StateBackendFactory{
+	"file": newFileStateBackend,
+}
+
+// RegisterStateBackend adds a kind of state backend, which the state block can then name
+func RegisterStateBackend(name string, factory StateBackendFactory) {
+	stateBackends[name] = factory
+}
+
+// stateSnapshot is what's saved to the backend
+type stateSnapshot struct {
+	Format     int                          `json:"format"`
+	History    map[string][]HistoryEntry    `json:"history"`
+	Pending    map[string]persistedPending  `json:"pending"`
+	Deliveries map[string]persistedDelivery `json:"deliveries"`
+
+	// Which config, and which replica, saved it last
+	ConfigChecksum string    `json:"config_checksum"`
+	SavedBy        string    `json:"saved_by"`
+	SavedAt        time.Time `json:"saved_at"`
+}
+
+// persistedPending is a pending update along with the request needed to apply it once approved
+// NB: The request's extra fields, ID and verified digests aren't part of its JSON, so they're saved alongside it
+type persistedPending struct {
+	PendingUpdate
+	Payload   UpdateRequest     `json:"payload"`
+	Extra     map[string]string `json:"extra,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Digests   map[string]string `json:"digests,omitempty"`
+}
+
+func newPersistedPending(update PendingUpdate) persistedPending {
+	return persistedPending{
+		PendingUpdate: update,
+		Payload:       update.payload,
+		Extra:         update.payload.Extra,
+		RequestID:     update.payload.RequestID,
+		Digests:       update.payload.Digests,
+	}
+}
+
+// persistedDelivery is the outcome of an idempotent delivery, which is replayed to repeats
+type persistedDelivery struct {
+	Fingerprint string         `json:"fingerprint"`
+	Expires     time.Time      `json:"expires"`
+	JobID       string         `json:"job_id"`
+	Code        int            `json:"code"`
+	Response    UpdateResponse `json:"response"`
+}
+
+func decodeStateSnapshot(data []byte) (*stateSnapshot, error) {
+	toRet := &stateSnapshot{Format: stateFormat}
+	if data != nil {
+		if err := json.Unmarshal(data, toRet); err != nil {
+			return nil, fmt.Errorf("could not decode state: %w", err)
+		}
+		if toRet.Format > stateFormat {
+			return nil, fmt.Errorf("state was saved in a newer format (%d)", toRet.Format)
+		}
+	}
+	if toRet.History == nil {
+		toRet.History = make(map[string][]HistoryEntry)
+	}
+	if toRet.Pending == nil {
+		toRet.Pending = make(map[string]persistedPending)
+	}
+	if toRet.Deliveries == nil {
+		toRet.Deliveries = make(map[string]persistedDelivery)
+	}
+
+	return toRet, nil
+}
+
+// statePersister keeps the state store in step with its backend
+type statePersister struct {
+	backend  StateBackend
+	interval time.Duration
+	checksum string
+	hostname string
+	server   *WebhookServer
+}
+
+func newStatePersister(cfg StateConfig, checksum string, server *WebhookServer) (*statePersister, error) {
+	factory, ok := stateBackends[cfg.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown state backend: %s", cfg.Backend)
+	}
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("state path is required")
+	}
+	backend, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	toRet := &statePersister{
+		backend:  backend,
+		interval: defaultStateSyncInterval * time.Second,
+		checksum: checksum,
+		server:   server,
+	}
+	if cfg.SyncInterval != "" {
+		if toRet.interval, err = time.ParseDuration(cfg.SyncInterval); err != nil || toRet.interval <= 0 {
+			return nil, fmt.Errorf("invalid state sync_interval: %s", cfg.SyncInterval)
+		}
+	}
+	toRet.hostname, _ = os.Hostname()
+
+	return toRet, nil
+}
+
+// Run saves changes as they're made, and picks up those made elsewhere every interval, until
+// the context is cancelled, when anything outstanding is saved
+func (p *statePersister) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.server.state.changed:
+			select {
+			case <-time.After(stateSaveDelay * time.Second):
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), stateSyncTimeout*time.Second)
+			if err := p.sync(flushCtx); err != nil {
+				log.WithError(err).Error("Failed to save state before shutting down")
+			}
+			cancel()
+			return
+		}
+		syncCtx, cancel := context.WithTimeout(ctx, stateSyncTimeout*time.Second)
+		if err := p.sync(syncCtx); err != nil {
+			log.WithError(err).Warn("Failed to sync state")
+		}
+		cancel()
+	}
+}
+
+// sync merges local changes into the saved state, retrying if another replica saves first, then
+// takes on the result
+// NB: Local changes are kept for the next attempt if they can't be saved
+func (p *statePersister) sync(ctx context.Context) error {
+	journal := p.server.state.takeJournal()
+	for attempt := 0; ; attempt++ {
+		snapshot, err := p.saveJournal(ctx, journal)
+		if errors.Is(err, errStateConflict) && attempt < stateSaveRetries {
+			stateSyncs.WithLabelValues("conflict").Inc()
+			log.WithField("attempt", attempt+1).Debug("State was saved elsewhere, retrying")
+			continue
+		}
+		if err != nil {
+			stateSyncs.WithLabelValues("error").Inc()
+			p.server.state.returnJournal(journal)
+			return err
+		}
+		p.server.state.install(snapshot, p.server.restorePending)
+		p.server.idempotency.restore(snapshot.Deliveries)
+		stateSyncs.WithLabelValues("success").Inc()
+
+		return nil
+	}
+}
+
+// saveJournal loads the latest snapshot and, if there's anything to add, saves the journal over it
+func (p *statePersister) saveJournal(ctx context.Context, journal *stateJournal) (*stateSnapshot, error) {
+	data, version, err := p.backend.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not load state: %w", err)
+	}
+	toRet, err := decodeStateSnapshot(data)
+	if err != nil || journal.empty() {
+		return toRet, err
+	}
+	journal.apply(toRet, time.Now())
+	toRet.Format = stateFormat
+	toRet.ConfigChecksum = p.checksum
+	toRet.SavedBy = p.hostname
+	toRet.SavedAt = time.Now()
+	if data, err = json.Marshal(toRet); err != nil {
+		return nil, err
+	}
+	if _, err = p.backend.Save(ctx, data, version); err != nil {
+		if errors.Is(err, errStateConflict) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not save state: %w", err)
+	}
+
+	return toRet, nil
+}
+
+// restorePending recreates the job for an update which was left pending elsewhere
+func (s *WebhookServer) restorePending(persisted persistedPending) PendingUpdate {
+	toRet := persisted.PendingUpdate
+	toRet.payload = persisted.Payload
+	toRet.payload.Extra = persisted.Extra
+	toRet.payload.RequestID = persisted.RequestID
+	toRet.payload.Digests = persisted.Digests
+	toRet.job = s.jobs.Restore(toRet.ID, toRet.payload, StatusPending, "Waiting for approval", toRet.RequestedAt)
+
+	return toRet
+}
+
+// fileStateBackend keeps the state in a local file, which is only useful with a persistent volume
+// NB: The version is the file's hash, so concurrent writers are only detected within one process
+type fileStateBackend struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func newFileStateBackend(cfg StateConfig) (StateBackend, error) {
+	return &fileStateBackend{path: cfg.Path}, nil
+}
+
+func (b *fileStateBackend) Load(_ context.Context) ([]byte, string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.load()
+}
+
+func (b *fileStateBackend) load() ([]byte, string, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(data)
+
+	return data, hex.EncodeToString(hash[:]), nil
+}
+
+func (b *fileStateBackend) Save(_ context.Context, data []byte, version string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, current, err := b.load(); err != nil {
+		return "", err
+	} else if current != version {
+		return "", errStateConflict
+	}
+
+	// Write to a temporary file first, so that a crash can't leave the state half-written
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp.Name(), b.path); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+)
+
+const defaultMaxConcurrentSyncs = 10
+
+var errSyncSuperseded = errors.New("superseded")
+
+var argoSyncWaiters = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "image_updater",
+	Subsystem: "argocd",
+	Name:      "sync_waiters",
+	Help:      "The number of ArgoCD syncs in progress, by whether they are queued for a slot or active",
+}, []string{"state"})
+
+// syncKey identifies an application, which may have the same name on different servers
+type syncKey struct {
+	argo        *ArgoClient
+	application string
+}
+
+// syncWorkers keeps at most one sync running per application, cancelling the wait for an older revision once
+// a newer one is pushed, and caps how many syncs can wait on ArgoCD at once
+type syncWorkers struct {
+	slots   chan struct{}
+	mutex   sync.Mutex
+	waiters map[syncKey]*syncWaiter
+}
+
+type syncWaiter struct {
+	cancel context.CancelCauseFunc
+}
+
+func newSyncWorkers(maxConcurrent int) *syncWorkers {
+	return &syncWorkers{
+		slots:   make(chan struct{}, maxConcurrent),
+		waiters: make(map[syncKey]*syncWaiter),
+	}
+}
+
+// begin registers a sync for an application, superseding any sync which is already running for it
+// NB: The returned function must be called once the sync is finished, to release its slot
+func (w *syncWorkers) begin(parent context.Context, key syncKey, tags string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	waiter := &syncWaiter{cancel: cancel}
+	w.mutex.Lock()
+	if previous, ok := w.waiters[key]; ok {
+		previous.cancel(fmt.Errorf("%w by %s", errSyncSuperseded, tags))
+	}
+	w.waiters[key] = waiter
+	w.mutex.Unlock()
+
+	acquired := false
+	done := func() {
+		w.mutex.Lock()
+		// NB: A newer sync may have replaced us already
+		if w.waiters[key] == waiter {
+			delete(w.waiters, key)
+		}
+		w.mutex.Unlock()
+		cancel(nil)
+		if acquired {
+			<-w.slots
+			argoSyncWaiters.WithLabelValues("active").Dec()
+		}
+	}
+
+	// Wait for a slot, unless we're superseded or time out first
+	argoSyncWaiters.WithLabelValues("queued").Inc()
+	defer argoSyncWaiters.WithLabelValues("queued").Dec()
+	select {
+	case w.slots <- struct{}{}:
+		acquired = true
+		argoSyncWaiters.WithLabelValues("active").Inc()
+	case <-ctx.Done():
+	}
+
+	return ctx, done
+}
+
+// supersededBy returns why a sync was cancelled, if it was because of a newer one
+func supersededBy(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errSyncSuperseded) {
+		return cause
+	}
+
+	return nil
+}
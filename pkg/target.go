@@ -0,0 +1,357 @@
+package pkg
+
+import (
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"gopkg.in/yaml.v3"
+	"path"
+	"regexp"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sort"
+	"strings"
+)
+
+// Kinds of file that a deployment's paths can point at
+const (
+	TargetKustomize  = "kustomize"
+	TargetHelmValues = "helm"
+	TargetManifest   = "manifest"
+	TargetRegex      = "regex"
+)
+
+// Target writes new tags into some of a deployment's files
+//
+// Each deployment has a target for its paths, chosen by its type, plus one for each patch,
+// replace, jsonnet or helm_chart block. Everything they have in common, from checking that each
+// image was found through to committing, is handled by Deployment.Apply.
+type Target interface {
+	// Paths lists the files or directories within the repository that the target may modify
+	Paths() []string
+	// Apply replaces the tags, returning the images found with their previous tags, and whether any file changed
+	// NB: wanted lists the images that the update expects to find, which some targets can add
+	Apply(worktree *git.Worktree, newTag tagSelector, wanted mapset.Set[string]) (imageTags, bool, error)
+	// Validate checks the target's files once every target has been applied
+	Validate(worktree *git.Worktree, mode string) error
+}
+
+// FileTarget applies a single file format to every file matched by a deployment's paths
+type FileTarget struct {
+	Type     string
+	Patterns []string // May contain globs, which are expanded when applying
+	format   fileFormat
+	// Discovered targets only update the matched files which reference their images
+	discover bool
+	images   []string
+}
+
+// fileFormat reads and writes the tags in one kind of file
+type fileFormat interface {
+	update(worktree *git.Worktree, filePath string, newTag tagSelector, wanted mapset.Set[string]) (imageTags, bool, error)
+	validate(worktree *git.Worktree, files []string, mode string) error
+}
+
+// NewFileTarget creates the target for a deployment's paths, which may have no patterns if the
+// deployment only uses other targets
+// NB: The duplicates policy must already have been defaulted
+func NewFileTarget(cfg DeploymentConfig) (*FileTarget, error) {
+	toRet := &FileTarget{Type: cfg.Type, Patterns: cfg.Paths, discover: cfg.Discover, images: cfg.Images}
+	if cfg.Path != "" {
+		if len(cfg.Paths) > 0 {
+			return nil, fmt.Errorf("path and paths cannot both be set")
+		}
+		toRet.Patterns = []string{cfg.Path}
+	}
+	if toRet.Type == "" {
+		toRet.Type = TargetKustomize
+	}
+	if cfg.AddMissing && toRet.Type != TargetKustomize {
+		return nil, fmt.Errorf("add_missing is only supported by %s deployments", TargetKustomize)
+	}
+	if cfg.Discover && toRet.Type != TargetKustomize {
+		return nil, fmt.Errorf("discover is only supported by %s deployments", TargetKustomize)
+	}
+	if cfg.Discover && (cfg.AddMissing || len(toRet.Patterns) == 0) {
+		return nil, fmt.Errorf("discover needs a path, and cannot be combined with add_missing")
+	}
+	if cfg.Regex != "" && toRet.Type != TargetRegex {
+		return nil, fmt.Errorf("regex is only supported by %s deployments", TargetRegex)
+	}
+
+	switch toRet.Type {
+	case TargetKustomize:
+		toRet.format = kustomizeFormat{images: cfg.Images, duplicates: cfg.Duplicates, addMissing: cfg.AddMissing}
+		// Deployments which only use replacements or charts may not have a kustomization file at all
+		if len(toRet.Patterns) == 0 && len(cfg.Replaces) == 0 && len(cfg.Jsonnet) == 0 && len(cfg.Charts) == 0 {
+			toRet.Patterns = []string{"kustomization.yaml"}
+		}
+	case TargetHelmValues:
+		toRet.format = helmValuesFormat{images: cfg.Images}
+		if len(toRet.Patterns) == 0 {
+			toRet.Patterns = []string{"values.yaml"}
+		}
+	case TargetManifest:
+		if len(toRet.Patterns) == 0 {
+			return nil, fmt.Errorf("%s deployments need a path", TargetManifest)
+		}
+		toRet.format = manifestFormat{template: Patch{kind: "*", name: "*", images: cfg.Images}}
+	case TargetRegex:
+		if len(toRet.Patterns) == 0 || cfg.Regex == "" {
+			return nil, fmt.Errorf("%s deployments need a path and a regex", TargetRegex)
+		}
+		if len(cfg.Images) != 1 || strings.ContainsRune(cfg.Images[0], '*') {
+			return nil, fmt.Errorf("%s deployments must have a single image", TargetRegex)
+		}
+		regex, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		toRet.format = regexFormat{template: Replacement{
+			Image: cfg.Images[0],
+			locate: func(contents []byte) (int, int, error) {
+				return findRegex(contents, regex)
+			},
+		}}
+	default:
+		return nil, fmt.Errorf("invalid deployment type: %s", toRet.Type)
+	}
+
+	for _, pattern := range toRet.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", pattern, err)
+		}
+	}
+
+	return toRet, nil
+}
+
+// Paths returns the longest fixed prefix of each pattern, which contains every file it can match
+func (t *FileTarget) Paths() []string {
+	toRet := make([]string, 0, len(t.Patterns))
+	for _, pattern := range t.Patterns {
+		toRet = append(toRet, globBase(pattern))
+	}
+
+	return toRet
+}
+
+// Apply updates every matched file, which all move together in one commit
+func (t *FileTarget) Apply(worktree *git.Worktree, newTag tagSelector, wanted mapset.Set[string]) (imageTags, bool, error) {
+	files, err := t.files(worktree)
+	if err != nil {
+		return nil, false, err
+	}
+	foundImages := make(imageTags)
+	changeMade := false
+	for _, filePath := range files {
+		fileImages, fileChanged, err := t.format.update(worktree, filePath, newTag, wanted)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update %s: %w", filePath, err)
+		}
+		foundImages.merge(fileImages)
+		changeMade = changeMade || fileChanged
+	}
+
+	return foundImages, changeMade, nil
+}
+
+func (t *FileTarget) Validate(worktree *git.Worktree, mode string) error {
+	files, err := t.files(worktree)
+	if err != nil {
+		return err
+	}
+
+	return t.format.validate(worktree, files, mode)
+}
+
+// files expands the target's patterns into the files they match
+func (t *FileTarget) files(worktree *git.Worktree) ([]string, error) {
+	var toRet []string
+	seen := mapset.NewThreadUnsafeSet[string]()
+	for _, pattern := range t.Patterns {
+		var matches []string
+		var err error
+		if t.discover {
+			matches, err = t.discoverFiles(worktree, pattern)
+		} else {
+			matches, err = util.Glob(worktree.Filesystem, pattern)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand path %q: %w", pattern, err)
+		}
+		if len(matches) == 0 && t.discover {
+			return nil, fmt.Errorf("no %s files matching %q reference the deployment's images", t.Type, pattern)
+		} else if len(matches) == 0 {
+			return nil, fmt.Errorf("no %s files match %q", t.Type, pattern)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if seen.Add(match) {
+				toRet = append(toRet, match)
+			}
+		}
+	}
+
+	return toRet, nil
+}
+
+// globBase returns the longest leading part of a pattern without wildcards, which contains
+// every file the pattern can match
+func globBase(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if strings.ContainsAny(part, "*?[\\") {
+			return strings.Join(parts[:i], "/")
+		}
+	}
+
+	return pattern
+}
+
+// kustomizeFormat replaces the tags in a kustomization file's images list
+type kustomizeFormat struct {
+	images     []string
+	duplicates string
+	addMissing bool
+}
+
+// update returns the images that were found and whether the file was modified
+// NB: When the deployment adds missing images, any wanted images the file lacks are added to it
+func (f kustomizeFormat) update(worktree *git.Worktree, kustomizationPath string, newTag tagSelector, wanted mapset.Set[string]) (imageTags, bool, error) {
+	foundImages := make(imageTags)
+
+	// Start by reading the kustomization file
+	kustomizationBytes, err := readWorktreeFile(worktree, kustomizationPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read kustomization file: %w", err)
+	}
+
+	// Then unmarshal it so that we have a source of truth to work from
+	var kustomization types.Kustomization
+	err = yaml.Unmarshal(kustomizationBytes, &kustomization)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode kustomization file: %w", err)
+	}
+	// Also convert the bytes to a string
+	kustomizationString := string(kustomizationBytes[:])
+
+	// Loop over the deployment's images, replacing their tags
+	changeMade := false
+	for _, im := range kustomization.Images {
+		if !matchImage(f.images, im.Name) {
+			continue
+		}
+		foundImages.merge(imageTags{im.Name: im.NewTag})
+		tag, ok := newTag(im.Name)
+		if !ok {
+			continue
+		}
+		if newKustomizationString, err := changeTag(kustomizationString, im.Name, tag, f.duplicates); err != nil {
+			return nil, false, fmt.Errorf("failed to replace image %s: %w", im.Name, err)
+		} else {
+			changeMade = changeMade || newKustomizationString != kustomizationString
+			kustomizationString = newKustomizationString
+		}
+	}
+	if f.addMissing {
+		missing := wanted.Clone()
+		for _, im := range kustomization.Images {
+			missing.Remove(im.Name)
+		}
+		names := missing.ToSlice()
+		sort.Strings(names)
+		for _, name := range names {
+			tag, ok := newTag(name)
+			if !ok {
+				continue
+			}
+			if kustomizationString, err = addImageEntry(kustomizationString, name, tag); err != nil {
+				return nil, false, fmt.Errorf("failed to add image %s: %w", name, err)
+			}
+			foundImages.merge(imageTags{name: ""})
+			changeMade = true
+		}
+	}
+	if !changeMade {
+		return foundImages, false, nil
+	}
+
+	// Write it back and stage the file for commit
+	if err := writeWorktreeFile(worktree, kustomizationPath, []byte(kustomizationString)); err != nil {
+		return nil, false, fmt.Errorf("failed to write kustomization file: %w", err)
+	}
+
+	return foundImages, true, nil
+}
+
+func (f kustomizeFormat) validate(worktree *git.Worktree, kustomizationFiles []string, mode string) error {
+	for _, kustomizationPath := range kustomizationFiles {
+		if err := validateKustomization(worktree, kustomizationPath); err != nil {
+			return fmt.Errorf("%s is invalid: %w", kustomizationPath, err)
+		}
+	}
+	if mode != ValidateBuild || len(kustomizationFiles) == 0 {
+		return nil
+	}
+
+	// Building needs everything the kustomizations might refer to, so copy the whole checkout
+	fs, err := kustomizeFilesystem(worktree)
+	if err != nil {
+		return fmt.Errorf("failed to prepare kustomize build: %w", err)
+	}
+	kustomizer := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	for _, kustomizationPath := range kustomizationFiles {
+		if _, err := kustomizer.Run(fs, path.Dir("/"+kustomizationPath)); err != nil {
+			return fmt.Errorf("kustomize build of %s failed: %w", kustomizationPath, err)
+		}
+	}
+
+	return nil
+}
+
+// validateYAMLFiles checks that each file decodes, for formats with nothing more specific to check
+func validateYAMLFiles(worktree *git.Worktree, files []string) error {
+	for _, filePath := range files {
+		if err := validateYAML(worktree, filePath); err != nil {
+			return fmt.Errorf("%s is invalid: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// manifestFormat updates every matching container in plain manifests, like a patch which selects
+// every resource
+type manifestFormat struct {
+	template Patch
+}
+
+func (f manifestFormat) update(worktree *git.Worktree, filePath string, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	patch := f.template
+	patch.Path = filePath
+
+	return patch.apply(worktree, newTag)
+}
+
+func (f manifestFormat) validate(worktree *git.Worktree, files []string, _ string) error {
+	return validateYAMLFiles(worktree, files)
+}
+
+// regexFormat replaces the tag located by a regex in each file
+type regexFormat struct {
+	template Replacement
+}
+
+func (f regexFormat) update(worktree *git.Worktree, filePath string, newTag tagSelector, _ mapset.Set[string]) (imageTags, bool, error) {
+	replacement := f.template
+	replacement.Path = filePath
+
+	return replacement.apply(worktree, newTag)
+}
+
+func (f regexFormat) validate(*git.Worktree, []string, string) error {
+	// Files edited by regex can be in any format, so there's nothing we can check
+	return nil
+}
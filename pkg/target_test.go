@@ -0,0 +1,25 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestGlobBase(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"app/kustomization.yaml", "app/kustomization.yaml"},
+		{"apps/*/kustomization.yaml", "apps"},
+		{"apps/prod-?/kustomization.yaml", "apps"},
+		{"apps/[ab]/kustomization.yaml", "apps"},
+		{"apps/overlays/**/kustomization.yaml", "apps/overlays"},
+		{"*/kustomization.yaml", ""},
+		{"**/kustomization.yaml", ""},
+	}
+	for _, test := range tests {
+		if got := globBase(test.pattern); got != test.want {
+			t.Errorf("globBase(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
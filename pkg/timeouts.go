@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Timeouts bounds each stage of an update
+// NB: Clone and push are unbounded by default, other than by the update as a whole
+type Timeouts struct {
+	// Webhook is how long a request waits for its update before being told it continues in the background
+	Webhook time.Duration
+	// Update bounds the whole update, including any time spent awaiting approval
+	Update time.Duration
+	Clone  time.Duration
+	Push   time.Duration
+	// ArgoCD is how long to wait for applications to sync, unless the deployment sets argocd_timeout
+	ArgoCD time.Duration
+}
+
+var defaultTimeouts = Timeouts{
+	Webhook: webhookTimeout * time.Second,
+	Update:  updateTimeout * time.Second,
+	ArgoCD:  argoTimeout * time.Second,
+}
+
+// parseTimeouts parses a timeouts block, leaving anything unset as zero
+func parseTimeouts(cfg *TimeoutsConfig) (Timeouts, error) {
+	var toRet Timeouts
+	if cfg == nil {
+		return toRet, nil
+	}
+	fields := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"webhook", cfg.Webhook, &toRet.Webhook},
+		{"update", cfg.Update, &toRet.Update},
+		{"clone", cfg.Clone, &toRet.Clone},
+		{"push", cfg.Push, &toRet.Push},
+		{"argocd", cfg.ArgoCD, &toRet.ArgoCD},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		timeout, err := time.ParseDuration(field.value)
+		if err != nil || timeout <= 0 {
+			return Timeouts{}, fmt.Errorf("invalid %s timeout: %s", field.name, field.value)
+		}
+		*field.dest = timeout
+	}
+
+	return toRet, nil
+}
+
+// override returns the timeouts with any set in other taking precedence
+func (t Timeouts) override(other Timeouts) Timeouts {
+	toRet := t
+	for _, pair := range []struct{ dest, src *time.Duration }{
+		{&toRet.Webhook, &other.Webhook},
+		{&toRet.Update, &other.Update},
+		{&toRet.Clone, &other.Clone},
+		{&toRet.Push, &other.Push},
+		{&toRet.ArgoCD, &other.ArgoCD},
+	} {
+		if *pair.src > 0 {
+			*pair.dest = *pair.src
+		}
+	}
+
+	return toRet
+}
+
+// timeoutsFor resolves the timeouts for an update, where the repository's take precedence
+func (s *WebhookServer) timeoutsFor(deployment *Deployment, payload UpdateRequest) Timeouts {
+	repo, err := s.repositoryFor(deployment, payload)
+	if err != nil {
+		return s.timeouts
+	}
+
+	return s.timeouts.override(repo.timeouts)
+}
+
+// withTimeout bounds a context if the timeout is set, and otherwise leaves it to its parent
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by Updater.Apply, which can be matched with errors.Is
+var (
+	ErrInvalidRequest     = errors.New("invalid update request")
+	ErrDeploymentNotFound = errors.New("deployment not found")
+	ErrUpdateRefused      = errors.New("update refused")
+	ErrUpdateTimedOut     = errors.New("update timed out")
+	ErrUpdateFailed       = errors.New("update failed")
+)
+
+// UpdateError carries the response for an update which didn't succeed
+type UpdateError struct {
+	Response UpdateResponse
+}
+
+func (e *UpdateError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind().Error(), e.Response.Message)
+}
+
+// Is matches the error against the sentinel for its response code
+func (e *UpdateError) Is(target error) bool {
+	return target == e.kind()
+}
+
+func (e *UpdateError) kind() error {
+	switch e.Response.Code {
+	case http.StatusBadRequest:
+		return ErrInvalidRequest
+	case http.StatusNotFound:
+		return ErrDeploymentNotFound
+	case http.StatusForbidden, http.StatusConflict, http.StatusLocked, http.StatusUnprocessableEntity:
+		return ErrUpdateRefused
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrUpdateTimedOut
+	default:
+		return ErrUpdateFailed
+	}
+}
+
+// Updater runs the update pipeline for programs which embed it, without any of the server's listeners
+type Updater struct {
+	server *WebhookServer
+}
+
+// NewUpdater creates the update pipeline from a config, as loaded by LoadConfig or ParseConfig
+func NewUpdater(cfg Config) (*Updater, error) {
+	server, err := newPipeline(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Updater{server: server}, nil
+}
+
+// Apply runs an update and waits for its outcome, which is bounded by the context
+// NB: Updates which are queued (for approval, a freeze or a pull request group) succeed with a 202 response
+func (u *Updater) Apply(ctx context.Context, request UpdateRequest) (UpdateResponse, error) {
+	deployment, rejection := u.server.prepareUpdate(&request)
+	if rejection != nil {
+		return *rejection, &UpdateError{Response: *rejection}
+	}
+	if request.RequestID == "" {
+		request.RequestID = newRequestID()
+	}
+	logData := requestLogFields(request)
+	logData["source"] = "library"
+
+	updateCtx, cancel := withTimeout(ctx, u.server.timeoutsFor(deployment, request).Update)
+	defer cancel()
+	toRet := u.server.performUpdate(updateCtx, deployment, request, logData)
+	switch toRet.Code {
+	case http.StatusOK, http.StatusAccepted, http.StatusNotModified:
+		return toRet, nil
+	default:
+		return toRet, &UpdateError{Response: toRet}
+	}
+}
+
+// Run starts any background work, such as configured sources and queued updates, until the context is cancelled
+func (u *Updater) Run(ctx context.Context) {
+	u.server.RunConsumers(ctx)
+}
+
+// Deployments lists every deployment that updates may target
+func (u *Updater) Deployments() []*Deployment {
+	return u.server.Deployments()
+}
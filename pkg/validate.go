@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"strings"
+)
+
+// How thoroughly to check a deployment's files before committing them
+const (
+	ValidateNone  = "none"
+	ValidateYAML  = "yaml"
+	ValidateBuild = "build"
+)
+
+// validTag matches the tags that a container registry will accept, optionally pinned to a digest
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}(@sha256:[a-f0-9]{64})?$`)
+
+// validate checks the edited files, so that a bad tag can't break every application built from them
+func (d Deployment) validate(worktree *git.Worktree) error {
+	if d.Validate == ValidateNone {
+		return nil
+	}
+	for _, target := range d.Targets {
+		if err := target.Validate(worktree, d.Validate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateYAML checks that every document in a file can be decoded
+func validateYAML(worktree *git.Worktree, filePath string) error {
+	contents, err := readWorktreeFile(worktree, filePath)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(contents)))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// validateKustomization checks that a kustomization decodes, and that its tags are usable
+func validateKustomization(worktree *git.Worktree, kustomizationPath string) error {
+	if err := validateYAML(worktree, kustomizationPath); err != nil {
+		return err
+	}
+	contents, err := readWorktreeFile(worktree, kustomizationPath)
+	if err != nil {
+		return err
+	}
+	var kustomization types.Kustomization
+	if err := yaml.Unmarshal(contents, &kustomization); err != nil {
+		return err
+	}
+	for _, im := range kustomization.Images {
+		if im.NewTag != "" && !validTag.MatchString(im.NewTag) {
+			return fmt.Errorf("image %s has an invalid tag %q", im.Name, im.NewTag)
+		}
+	}
+
+	return nil
+}
+
+// kustomizeFilesystem copies a worktree into an in-memory filesystem that kustomize can build from
+func kustomizeFilesystem(worktree *git.Worktree) (filesys.FileSystem, error) {
+	fs := filesys.MakeFsInMemory()
+	err := util.Walk(worktree.Filesystem, "/", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return fs.MkdirAll(path.Join("/", filePath))
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		contents, err := readWorktreeFile(worktree, filePath)
+		if err != nil {
+			return err
+		}
+		return fs.WriteFile(path.Join("/", filePath), contents)
+	})
+
+	return fs, err
+}
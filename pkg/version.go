@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"runtime"
+)
+
+// Details of the running build, which are set from the linker flags at release time
+var (
+	// Version is the running version of image-updater, recorded in state files
+	Version   = "0.0.0"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+var buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "image_updater",
+	Name:      "build_info",
+	Help:      "The version of image-updater which is running, always 1",
+}, []string{"version", "commit", "build_date", "go_version"})
+
+// SetBuildInfo records the details of the running build, for state files, health checks and metrics
+func SetBuildInfo(version string, commit string, buildDate string) {
+	Version, Commit, BuildDate = version, commit, buildDate
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(Version, Commit, BuildDate, runtime.Version()).Set(1)
+}